@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"fmt"
+	"jpm/db"
+	"jpm/lib"
+	"jpm/model"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	doctorRepair bool
+	doctorResume bool
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Find and recover installations that were interrupted",
+	Long: `Check for installations that never finished, e.g. because jpm was killed
+or the machine crashed while a package was being installed.
+
+Every install is journaled in the local database before it touches the
+filesystem. With --repair, the undo log recorded in the journal of each
+interrupted installation is replayed: files it overwrote or deleted are
+restored from their backups and its PATH and environment changes are
+reverted. The files it created are removed again, except files owned by an
+installed package. With --resume, the installation is started again after
+the cleanup.
+
+Examples:
+  jpm doctor                   # Report interrupted installations
+  jpm doctor --repair          # Undo them
+  jpm doctor --resume          # Undo them and install again`,
+	Annotations: mutating,
+	Run:         runDoctor,
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().BoolVar(&doctorRepair, "repair", false, "Undo interrupted installations")
+	doctorCmd.Flags().BoolVar(&doctorResume, "resume", false, "Undo interrupted installations and install them again")
+}
+
+func runDoctor(cmd *cobra.Command, args []string) {
+	ldb := db.NewLocalDB()
+	defer ldb.Close()
+
+	journals, err := ldb.GetInterruptedJournals()
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+		return
+	}
+
+	if len(journals) == 0 {
+		fmt.Printf("%s✓ No interrupted installations%s\n", lib.Green, lib.Reset)
+		return
+	}
+
+	fmt.Printf("%sFound %d interrupted installation(s):%s\n", lib.Yellow, len(journals), lib.Reset)
+	for _, j := range journals {
+		fmt.Printf("  • %s (v%s), stopped after step %d of %d, started %s\n",
+			j.PackageName, j.Version, j.CurrentStep, j.TotalSteps,
+			j.StartedAt.Format("2006-01-02 15:04:05"))
+		fmt.Printf("    %d path(s), %d PATH entry(s), %d environment variable(s) recorded\n",
+			len(j.Paths), len(j.PathEntries), len(j.EnvEntries))
+	}
+
+	if !doctorRepair && !doctorResume {
+		fmt.Println("\nRun 'jpm doctor --repair' to undo them, or 'jpm doctor --resume' to install them again")
+		return
+	}
+
+	var resume []string
+	for _, j := range journals {
+		fmt.Printf("\n%sRolling back %s (v%s)...%s\n", lib.Blue, j.PackageName, j.Version, lib.Reset)
+		undoJournal(ldb, j)
+		resume = append(resume, j.PackageName+"@"+j.Version)
+	}
+
+	if !doctorResume {
+		return
+	}
+
+	for _, spec := range resume {
+		fmt.Println()
+		forceInstall = true
+		install(cmd, []string{spec})
+	}
+}
+
+// undoJournal removes what an interrupted installation left behind and
+// closes its journal
+func undoJournal(ldb db.LocalDB, j model.InstallJournal) {
+	existing, _ := ldb.GetByName(j.PackageName)
+
+	// PATH entries and variables still used by the previously installed version stay
+	keep := make(map[string]bool)
+	if existing != nil {
+		mods, _ := ldb.GetEnvModifications(existing.ID)
+		for _, mod := range mods {
+			if mod.ModificationType == "path_addition" {
+				keep[mod.VariableValue] = true
+			} else {
+				keep[envKey(mod)] = true
+			}
+		}
+	}
+
+	// Replay the undo log first: overwritten and deleted files come back from
+	// their backups, moved files go back and PATH and environment changes
+	// are reverted
+	restored := make(map[string]bool)
+	if len(j.Undo) > 0 {
+		var records []model.UndoRecord
+		for _, rec := range j.Undo {
+			switch rec.Kind {
+			case model.UndoPathEntry:
+				if keep[rec.Value] {
+					continue
+				}
+			case model.UndoEnv:
+				if mod, err := lib.DecodeEnv(rec.Value); err != nil || keep[envKey(mod)] {
+					continue
+				}
+			case model.UndoCreated:
+				// Left to the journaled paths below, which spare installed packages' files
+				continue
+			case model.UndoBackup, model.UndoReplaced:
+				restored[rec.Path] = true
+			}
+			records = append(records, rec)
+		}
+		if err := lib.ReplayUndo(records, false); err != nil {
+			fmt.Printf("%sWarning: Some changes could not be undone:\n%v%s\n", lib.Yellow, err, lib.Reset)
+		}
+	} else {
+		undoJournalEnv(j, keep)
+	}
+
+	// Newest paths first, so nested entries go before their parents
+	for i := len(j.Paths) - 1; i >= 0; i-- {
+		path := j.Paths[i]
+		if path == j.WorkDir || restored[path] {
+			continue
+		}
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			continue
+		}
+		if owners, err := ldb.GetFileOwners(path); err != nil || len(owners) > 0 {
+			fmt.Printf("  Kept (owned by an installed package): %s\n", path)
+			continue
+		}
+		if err := lib.Delete(path); err != nil {
+			fmt.Printf("%sWarning: Failed to remove %s: %v%s\n", lib.Yellow, path, err, lib.Reset)
+		}
+	}
+
+	msg := fmt.Sprintf("interrupted at step %d of %d", j.CurrentStep, j.TotalSteps)
+	_ = ldb.FinishJournal(j.ID, "rolled_back", msg)
+	_ = ldb.AddHistory(j.PackageName, j.Version, "install", "", false, msg+", rolled back")
+
+	if existing != nil {
+		fmt.Printf("%s%s (v%s) is still installed; run 'jpm verify %s' and 'jpm repair %s' if the interrupted install damaged it%s\n",
+			lib.Yellow, existing.Name, existing.Version, existing.Name, existing.Name, lib.Reset)
+	}
+	fmt.Printf("%s✓ Rolled back %s (v%s)%s\n", lib.Green, j.PackageName, j.Version, lib.Reset)
+}
+
+// undoJournalEnv reverts the PATH entries and environment changes of a
+// journal written without undo records, except those in keep
+func undoJournalEnv(j model.InstallJournal, keep map[string]bool) {
+	for _, entry := range j.PathEntries {
+		if keep[entry] {
+			continue
+		}
+		if err := lib.RemoveFromPath(entry); err != nil {
+			fmt.Printf("%sWarning: Failed to remove PATH entry %s: %v%s\n", lib.Yellow, entry, err, lib.Reset)
+		} else {
+			fmt.Printf("  ✓ Removed PATH entry: %s\n", entry)
+		}
+	}
+
+	// Newest changes first, so a variable set twice gets its original value back
+	for i := len(j.EnvEntries) - 1; i >= 0; i-- {
+		mod, err := lib.DecodeEnv(j.EnvEntries[i])
+		if err != nil || keep[envKey(mod)] {
+			continue
+		}
+		if err := lib.RevertEnv(mod); err != nil {
+			fmt.Printf("%sWarning: Failed to revert %s: %v%s\n", lib.Yellow, mod.VariableName, err, lib.Reset)
+		} else {
+			fmt.Printf("  ✓ Reverted environment variable: %s\n", mod.VariableName)
+		}
+	}
+}
+
+// warnInterruptedInstalls points at 'jpm doctor' when a previous run died in
+// the middle of an install. Only meaningful while the jpm lock is held.
+func warnInterruptedInstalls() {
+	ldb := db.NewLocalDB()
+	defer ldb.Close()
+
+	journals, err := ldb.GetInterruptedJournals()
+	if err != nil || len(journals) == 0 {
+		return
+	}
+
+	for _, j := range journals {
+		fmt.Printf("%sWarning: installation of %s (v%s) was interrupted%s\n",
+			lib.Yellow, j.PackageName, j.Version, lib.Reset)
+	}
+	fmt.Printf("%sRun 'jpm doctor --repair' to clean it up or 'jpm doctor --resume' to finish it%s\n\n",
+		lib.Yellow, lib.Reset)
+}
+
+// envKey identifies the change a modification makes, whatever the variable held before
+func envKey(mod model.EnvModification) string {
+	return mod.ModificationType + "\x00" + mod.VariableName + "\x00" + mod.VariableValue
+}
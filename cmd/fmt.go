@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"jpm/lib"
+	"jpm/parser"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	fmtWrite bool
+	fmtCheck bool
+)
+
+var fmtCmd = &cobra.Command{
+	Use:   "fmt-instructions <file>",
+	Short: "Rewrite release instructions in canonical form",
+	Long: `Print instruction text with commands in upper case, arguments quoted
+only where needed, single spaces between words and IF/ELSE blocks indented
+by two spaces. Comments and blank lines are kept; continued lines are joined.
+A JSON manifest is re-indented.
+
+Files with errors are left alone; run 'jpm lint-instructions' to see them.
+
+Examples:
+  jpm fmt-instructions install.txt            # Print the formatted file
+  jpm fmt-instructions install.txt -w         # Rewrite the file in place
+  jpm fmt-instructions install.txt --check    # Exit non-zero if not formatted`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if !formatInstructions(args[0]) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fmtCmd)
+	fmtCmd.Flags().BoolVarP(&fmtWrite, "write", "w", false, "Write the result back to the file")
+	fmtCmd.Flags().BoolVar(&fmtCheck, "check", false, "Only report whether the file is formatted")
+}
+
+// formatInstructions formats one file as requested by the flags and returns
+// false on errors or, with --check, when the file is not formatted
+func formatInstructions(file string) bool {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Printf("%sError reading %s: %v%s\n", lib.Red, file, err, lib.Reset)
+		return false
+	}
+
+	// USE lines are formatted as they are, so no registry is needed
+	p := parser.NewParser()
+	p.KeepMacros = true
+	formatted, err := p.FormatSource(string(data))
+	if err != nil {
+		fmt.Printf("%sCannot format %s:\n%v%s\n", lib.Red, file, err, lib.Reset)
+		return false
+	}
+
+	switch {
+	case fmtCheck:
+		if formatted != string(data) {
+			fmt.Printf("%s%s is not formatted%s\n", lib.Yellow, file, lib.Reset)
+			return false
+		}
+	case fmtWrite:
+		if formatted == string(data) {
+			return true
+		}
+		if err := os.WriteFile(file, []byte(formatted), 0644); err != nil {
+			fmt.Printf("%sError writing %s: %v%s\n", lib.Red, file, err, lib.Reset)
+			return false
+		}
+		fmt.Printf("%s✓ Formatted %s%s\n", lib.Green, file, lib.Reset)
+	default:
+		fmt.Print(formatted)
+	}
+	return true
+}
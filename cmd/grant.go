@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"fmt"
+	"jpm/db"
+	"jpm/lib"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	grantRevoke bool
+	grantList   bool
+)
+
+var grantCmd = &cobra.Command{
+	Use:   "grant <package> [path]",
+	Short: "Allow a package's instructions to touch a path outside its install root",
+	Long: `Installation instructions may only touch paths inside the package's
+install root. Paths are resolved, including symlinks, before every step, and
+anything that ends up outside the root is refused.
+
+A package that really needs to write elsewhere, e.g. ADD_TO_PATH with an
+absolute directory, can be granted that path explicitly. The grant covers the
+path and everything below it, and applies to that package only.
+
+Examples:
+  jpm grant tool /opt/tool            # Allow tool to use /opt/tool
+  jpm grant tool /opt/tool --revoke   # Take the grant back
+  jpm grant tool --list               # Show grants for tool
+  jpm grant --list                    # Show all grants`,
+	Annotations: mutating,
+	Args:        cobra.RangeArgs(0, 2),
+	Run:         runGrant,
+}
+
+func init() {
+	rootCmd.AddCommand(grantCmd)
+	grantCmd.Flags().BoolVar(&grantRevoke, "revoke", false, "Remove the grant instead of adding it")
+	grantCmd.Flags().BoolVar(&grantList, "list", false, "List granted paths")
+}
+
+func runGrant(cmd *cobra.Command, args []string) {
+	ldb := db.NewLocalDB()
+	defer ldb.Close()
+
+	if grantList {
+		packageName := ""
+		if len(args) > 0 {
+			packageName = args[0]
+		}
+		listGrants(ldb, packageName)
+		return
+	}
+
+	if len(args) != 2 {
+		fmt.Printf("%sUsage: jpm grant <package> <path>%s\n", lib.Red, lib.Reset)
+		return
+	}
+
+	packageName := args[0]
+	path, err := filepath.Abs(args[1])
+	if err != nil {
+		fmt.Printf("%sError resolving path: %v%s\n", lib.Red, err, lib.Reset)
+		return
+	}
+
+	if grantRevoke {
+		removed, err := ldb.RemovePathGrant(packageName, path)
+		if err != nil {
+			fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+			return
+		}
+		if !removed {
+			fmt.Printf("%s%s has no grant for %s%s\n", lib.Yellow, packageName, path, lib.Reset)
+			return
+		}
+		fmt.Printf("%s✓ Revoked %s for %s%s\n", lib.Green, path, packageName, lib.Reset)
+		return
+	}
+
+	if err := ldb.AddPathGrant(packageName, path); err != nil {
+		fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+		return
+	}
+	fmt.Printf("%s✓ %s may now use %s%s\n", lib.Green, packageName, path, lib.Reset)
+}
+
+func listGrants(ldb db.LocalDB, packageName string) {
+	grants, err := ldb.GetPathGrants(packageName)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+		return
+	}
+
+	if len(grants) == 0 {
+		fmt.Println("No paths granted")
+		return
+	}
+
+	for _, g := range grants {
+		fmt.Printf("  %s%-20s%s %s\n", lib.Blue, g.PackageName, lib.Reset, g.Path)
+	}
+}
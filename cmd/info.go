@@ -6,6 +6,7 @@ import (
 	"jpm/lib"
 	"jpm/model"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -17,17 +18,30 @@ var infoCmd = &cobra.Command{
   • Installation details
   • File locations
   • Environment modifications
+  • Package scripts that ran during installation
   • Dependencies
   • Installation history
 
 Examples:
-  jpm info nodejs                # Show info for nodejs`,
+  jpm info nodejs                # Show info for nodejs
+  jpm info nodejs --scripts      # Include the full output of package scripts
+  jpm info nodejs --instructions # Show the instructions as run, macros expanded
+  jpm info nodejs --trace        # Show how each instruction ran, also for failed attempts`,
 	Args: cobra.ExactArgs(1),
 	Run:  showInfo,
 }
 
+var (
+	infoScripts      bool
+	infoInstructions bool
+	infoTrace        bool
+)
+
 func init() {
 	rootCmd.AddCommand(infoCmd)
+	infoCmd.Flags().BoolVar(&infoScripts, "scripts", false, "Show the captured output of package scripts")
+	infoCmd.Flags().BoolVar(&infoInstructions, "instructions", false, "Show the instructions as they ran, with USE macros expanded")
+	infoCmd.Flags().BoolVar(&infoTrace, "trace", false, "Show each instruction's arguments, outcome, duration and files")
 }
 
 func showInfo(cmd *cobra.Command, args []string) {
@@ -45,6 +59,10 @@ func showInfo(cmd *cobra.Command, args []string) {
 
 	if inst == nil {
 		fmt.Printf("%sPackage '%s' is not installed%s\n", lib.Yellow, packageName, lib.Reset)
+		if infoTrace {
+			showFailedAttempt(ldb, packageName)
+			return
+		}
 		fmt.Println("\nTip: Use 'jpm search " + packageName + "' to find it in the repository")
 		return
 	}
@@ -101,7 +119,11 @@ func showInfo(cmd *cobra.Command, args []string) {
 		fmt.Println("\n" + strings.Repeat("-", 50))
 		fmt.Println("Installed Files")
 		fmt.Println(strings.Repeat("-", 50))
-		fmt.Printf("Total: %d file(s)\n\n", len(files))
+		var totalSize int64
+		for _, f := range files {
+			totalSize += f.SizeBytes
+		}
+		fmt.Printf("Total: %d file(s), %s on disk\n\n", len(files), formatBytes(totalSize))
 
 		// Group by type
 		filesByType := make(map[string][]model.InstalledFile)
@@ -121,7 +143,11 @@ func showInfo(cmd *cobra.Command, args []string) {
 					if f.IsExecutable {
 						exec = " [executable]"
 					}
-					fmt.Printf("  • %s%s\n", f.FilePath, exec)
+					size := ""
+					if f.FileType != "directory" {
+						size = " " + formatBytes(f.SizeBytes)
+					}
+					fmt.Printf("  • %s  %s%s%s\n", f.FilePath, f.Mode.Perm(), size, exec)
 				}
 			}
 			if len(typeFiles) > 5 {
@@ -146,10 +172,64 @@ func showInfo(cmd *cobra.Command, args []string) {
 			if mod.VariableValue != "" {
 				fmt.Printf("Value:    %s\n", mod.VariableValue)
 			}
+			if mod.OriginalValue != "" {
+				fmt.Printf("Original: %s\n", mod.OriginalValue)
+			}
 			fmt.Println()
 		}
 	}
 
+	// Package scripts
+	scripts, err := ldb.GetScriptRuns(inst.ID)
+	if err == nil && len(scripts) > 0 {
+		fmt.Println(strings.Repeat("-", 50))
+		fmt.Println("Scripts")
+		fmt.Println(strings.Repeat("-", 50))
+
+		for _, run := range scripts {
+			fmt.Printf("  • %s %s\n", run.Script, strings.Join(run.Args, " "))
+			fmt.Printf("    exit %d in %s, %s\n", run.ExitCode, run.Duration.Round(time.Millisecond),
+				run.RanAt.Format("2006-01-02 15:04:05"))
+			if infoScripts {
+				printScriptOutput("stdout", run.Stdout)
+				printScriptOutput("stderr", run.Stderr)
+			}
+		}
+		if !infoScripts {
+			fmt.Println("\nUse --scripts to show their output")
+		}
+		fmt.Println()
+	}
+
+	// Instructions as installed
+	if infoInstructions {
+		fmt.Println(strings.Repeat("-", 50))
+		fmt.Println("Instructions")
+		fmt.Println(strings.Repeat("-", 50))
+		if inst.Instructions == "" {
+			fmt.Println("  (not recorded for this installation)")
+		}
+		for _, line := range strings.Split(strings.TrimRight(inst.Instructions, "\n"), "\n") {
+			if line != "" {
+				fmt.Printf("  %s\n", line)
+			}
+		}
+		fmt.Println()
+	}
+
+	// Instruction trace
+	if infoTrace {
+		fmt.Println(strings.Repeat("-", 50))
+		fmt.Println("Trace")
+		fmt.Println(strings.Repeat("-", 50))
+		trace, err := ldb.GetTrace(inst.ID)
+		if err != nil || len(trace) == 0 {
+			fmt.Println("  (not recorded for this installation)")
+		}
+		printTrace(trace, "  ")
+		fmt.Println()
+	}
+
 	// Dependencies
 	deps, err := ldb.GetDependencies(inst.ID)
 	if err == nil && len(deps) > 0 {
@@ -197,6 +277,10 @@ func showInfo(cmd *cobra.Command, args []string) {
 			if !h.Success && h.ErrorMessage != "" {
 				fmt.Printf("           Error: %s\n", h.ErrorMessage)
 			}
+			if !h.Success && infoTrace {
+				trace, _ := ldb.GetHistoryTrace(h.ID)
+				printTrace(trace, "           ")
+			}
 		}
 		fmt.Println()
 	}
@@ -226,3 +310,62 @@ func showInfo(cmd *cobra.Command, args []string) {
 		fmt.Println(inst.ErrorMessage)
 	}
 }
+
+func printScriptOutput(stream, output string) {
+	output = strings.TrimRight(output, "\n")
+	if output == "" {
+		return
+	}
+	fmt.Printf("    %s:\n", stream)
+	for _, line := range strings.Split(output, "\n") {
+		fmt.Printf("      %s\n", line)
+	}
+}
+
+// showFailedAttempt prints the trace of a package's latest failed history entry
+func showFailedAttempt(ldb db.LocalDB, packageName string) {
+	history, err := ldb.GetHistory(packageName, 0)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+		return
+	}
+	for _, h := range history {
+		if h.Success {
+			continue
+		}
+		fmt.Printf("\nLast failed %s of v%s on %s:\n", h.Action, h.Version, h.PerformedAt.Format("2006-01-02 15:04"))
+		fmt.Printf("  Error: %s\n", h.ErrorMessage)
+		trace, _ := ldb.GetHistoryTrace(h.ID)
+		printTrace(trace, "  ")
+		return
+	}
+	fmt.Println("No failed attempts recorded")
+}
+
+// printTrace lists the recorded steps of an installation
+func printTrace(trace []model.TraceStep, indent string) {
+	for _, step := range trace {
+		status, color := "✓", lib.Green
+		switch step.Status {
+		case model.TraceFailed:
+			status, color = "✗", lib.Red
+		case model.TraceSkipped:
+			status, color = "-", lib.Yellow
+		}
+
+		fmt.Printf("%s%s%s%s [%d] %s (%s)\n", indent, color, status, lib.Reset, step.Step, step.RawLine,
+			step.Duration.Round(time.Millisecond))
+		if step.Status == model.TraceSkipped {
+			continue
+		}
+		if len(step.Args) > 0 {
+			fmt.Printf("%s    args:  %s\n", indent, strings.Join(step.Args, " "))
+		}
+		for _, f := range step.Files {
+			fmt.Printf("%s    file:  %s\n", indent, f)
+		}
+		if step.Error != "" {
+			fmt.Printf("%s    error: %s\n", indent, step.Error)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"jpm/config"
 	"jpm/db"
 	"jpm/lib"
 
@@ -22,12 +23,19 @@ This command creates:
   • configuration storage
   • metadata cache
 
-The database file is created at: jpm.db
+The database file is created at: $JPM_HOME/db/jpm.db (default ~/.jpm),
+alongside the packages, cache and shims directories.
 
 Note: This command is safe to run multiple times. Existing data will not be lost.`,
+	Annotations: mutating,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Printf("%sInitializing local database...%s\n\n", lib.Blue, lib.Reset)
 
+		if err := config.EnsureHome(); err != nil {
+			fmt.Printf("%s✗ Error creating %s: %v%s\n", lib.Red, config.Home(), err, lib.Reset)
+			return
+		}
+
 		ldb := db.NewLocalDB()
 		defer ldb.Close()
 
@@ -40,7 +48,10 @@ Note: This command is safe to run multiple times. Existing data will not be lost
 		}
 
 		fmt.Printf("%s✓ Database schema initialized successfully%s\n", lib.Green, lib.Reset)
-		fmt.Println("\nDatabase location: jpm.db")
+		fmt.Printf("\nDatabase location: %s\n", config.DBPath())
+		fmt.Printf("Packages:          %s\n", config.PackagesDir())
+		fmt.Printf("Cache:             %s\n", config.CacheDir())
+		fmt.Printf("Shims:             %s\n", config.ShimsDir())
 
 		// Check if there are existing installations
 		count := ldb.GetCount()
@@ -1,10 +1,8 @@
 package cmd
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"io"
+	"jpm/config"
 	"jpm/db"
 	"jpm/lib"
 	"jpm/model"
@@ -12,6 +10,8 @@ import (
 	"jpm/version"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"time"
 
@@ -19,9 +19,12 @@ import (
 )
 
 var (
-	forceInstall bool
-	skipVerify   bool
-	workingDir   string
+	forceInstall     bool
+	skipVerify       bool
+	workingDir       string
+	installOverwrite bool
+	noScripts        bool
+	scriptTimeout    time.Duration
 )
 
 var installCmd = &cobra.Command{
@@ -42,9 +45,13 @@ Version Specifications:
 Flags:
   -f, --force                     # Force reinstall
   --skip-verify                   # Skip checksum verification
-  --work-dir string               # Working directory (default "bin")`,
-	Args: cobra.ExactArgs(1),
-	Run:  install,
+  --overwrite                     # Replace files owned by other packages
+  --no-scripts                    # Refuse to run package scripts (RUN_SCRIPT)
+  --script-timeout duration       # Time limit per package script (default 5m)
+  --work-dir string               # Working directory (default "$JPM_HOME/packages")`,
+	Args:        cobra.ExactArgs(1),
+	Annotations: mutating,
+	Run:         install,
 }
 
 func init() {
@@ -52,7 +59,10 @@ func init() {
 
 	installCmd.Flags().BoolVarP(&forceInstall, "force", "f", false, "Force reinstall even if already installed")
 	installCmd.Flags().BoolVar(&skipVerify, "skip-verify", false, "Skip checksum verification")
-	installCmd.Flags().StringVar(&workingDir, "work-dir", "bin", "Working directory for downloads and extractions")
+	installCmd.Flags().BoolVar(&installOverwrite, "overwrite", false, "Replace files already owned by other packages")
+	installCmd.Flags().BoolVar(&noScripts, "no-scripts", false, "Fail instead of running package scripts")
+	installCmd.Flags().DurationVar(&scriptTimeout, "script-timeout", 0, "Time limit for each package script (default $JPM_SCRIPT_TIMEOUT or 5m)")
+	installCmd.Flags().StringVar(&workingDir, "work-dir", "", "Working directory for downloads and extractions (default $JPM_HOME/packages)")
 }
 
 func install(cmd *cobra.Command, args []string) {
@@ -174,14 +184,14 @@ func install(cmd *cobra.Command, args []string) {
 	}
 
 	// Ensure working directory exists
-	if err := os.MkdirAll(workingDir, 0755); err != nil {
-		fmt.Printf("%sError creating working directory: %v%s\n", lib.Red, err, lib.Reset)
+	absWorkDir, err := resolveWorkDir()
+	if err != nil {
+		fmt.Printf("%sError resolving working directory: %v%s\n", lib.Red, err, lib.Reset)
 		return
 	}
 
-	absWorkDir, err := filepath.Abs(workingDir)
-	if err != nil {
-		fmt.Printf("%sError resolving working directory: %v%s\n", lib.Red, err, lib.Reset)
+	if err := os.MkdirAll(absWorkDir, 0755); err != nil {
+		fmt.Printf("%sError creating working directory: %v%s\n", lib.Red, err, lib.Reset)
 		return
 	}
 
@@ -191,13 +201,55 @@ func install(cmd *cobra.Command, args []string) {
 	ctx.Installation.ChecksumSHA256 = release.ChecksumSHA256
 	ctx.Installation.FileSizeBytes = release.FileSizeBytes
 	ctx.Installation.Status = "in_progress"
+	ctx.OwnersOf = ldb.GetFileOwners
+	ctx.Installed = ldb.GetByName
+	if ctx.AllowedPaths, err = ldb.GrantedPaths(packageName); err != nil {
+		fmt.Printf("%sWarning: Failed to read path grants: %v%s\n", lib.Yellow, err, lib.Reset)
+	}
+	ctx.AllowOverwrite = installOverwrite
+	ctx.ForbidScripts = noScripts
+	ctx.ScriptTimeout = scriptTimeout
+	ctx.BackupDir = filepath.Join(config.BackupsDir(), packageName, time.Now().Format("20060102-150405"))
+
+	// Parse installation instructions
+	fmt.Println("\nParsing installation instructions...")
+	p := newInstructionParser(&rdb)
+	instructions, hooks, diags := p.Diagnose(release.Instructions)
+	for _, warning := range diags.Warnings() {
+		fmt.Printf("%s%v%s\n", lib.Yellow, warning, lib.Reset)
+	}
+	if err := diags.Err(); err != nil {
+		fmt.Printf("%sInvalid installation instructions:\n%v%s\n", lib.Red, err, lib.Reset)
+		ctx.MarkFailed(err)
+		return
+	}
+
+	// Keep the instructions as they will run, macros expanded, for auditing.
+	// Removal must not depend on the registry, so expanded hooks are stored.
+	ctx.Installation.Instructions = parser.FormatText(instructions, hooks)
+	ctx.Installation.OnRemove = parser.RemoveSection(release.Instructions)
+	if slices.ContainsFunc(hooks, func(inc parser.Instruction) bool { return inc.Macro != "" }) {
+		ctx.Installation.OnRemove = parser.FormatText(hooks, nil)
+	}
+
+	fmt.Printf("Found %d installation steps\n", len(instructions))
+
+	// Journal the installation before touching the filesystem
+	journal := beginJournal(ldb, ctx, len(instructions))
+	ctx.OnUndo = journal.undo
 
 	// Download the package
 	fmt.Println("\nDownloading package...")
+	downloadTarget := filepath.Join(absWorkDir, filepath.Base(release.BinaryURL))
+	ctx.AddFile(downloadTarget, "", false)
+	ctx.RecordUndo(model.UndoCreated, downloadTarget, "", "")
+	journal.track(downloadTarget)
 	downloadedFile, err := downloadPackage(release.BinaryURL, absWorkDir)
 	if err != nil {
 		fmt.Printf("%sDownload failed: %v%s\n", lib.Red, err, lib.Reset)
 		ctx.MarkFailed(err)
+		cleanup(ctx)
+		journal.finish(err)
 		return
 	}
 
@@ -207,41 +259,44 @@ func install(cmd *cobra.Command, args []string) {
 		if err := verifyChecksum(downloadedFile, release.ChecksumSHA256); err != nil {
 			fmt.Printf("%sChecksum verification failed: %v%s\n", lib.Red, err, lib.Reset)
 			fmt.Println("Use --skip-verify to bypass verification (not recommended)")
-			cleanup(ctx, absWorkDir)
+			ctx.MarkFailed(err)
+			_ = ldb.AddHistory(packageName, release.Version, "install", "", false, err.Error())
+			cleanup(ctx)
+			journal.finish(err)
 			return
 		}
 		fmt.Printf("%s✓ Checksum verified%s\n", lib.Green, lib.Reset)
 	}
 
-	// Parse installation instructions
-	fmt.Println("\nParsing installation instructions...")
-	p := parser.NewParser()
-	instructions, err := p.Parse(release.Instructions)
-	if err != nil {
-		fmt.Printf("%sInvalid installation instructions: %v%s\n", lib.Red, err, lib.Reset)
-		ctx.MarkFailed(err)
-		cleanup(ctx, absWorkDir)
-		return
-	}
-
-	fmt.Printf("Found %d installation steps\n", len(instructions))
-
 	// Execute installation instructions
 	fmt.Println("\nExecuting installation steps...")
 	for i, instruction := range instructions {
+		if !instruction.AppliesHere() {
+			fmt.Printf("  [%d/%d] %s %s(skipped on %s/%s)%s\n", i+1, len(instructions), instruction.RawLine,
+				lib.Yellow, runtime.GOOS, runtime.GOARCH, lib.Reset)
+			instruction.Skip(ctx)
+			journal.step(i + 1)
+			continue
+		}
+
 		fmt.Printf("  [%d/%d] %s\n", i+1, len(instructions), instruction.RawLine)
+		journal.track(instruction.Targets(ctx, absWorkDir)...)
 
 		// Pass the context instead of just the installation
 		if err := instruction.RunWithContext(ctx, absWorkDir); err != nil {
 			fmt.Printf("%s✗ Step failed: %v%s\n", lib.Red, err, lib.Reset)
 			ctx.MarkFailed(err)
-			cleanup(ctx, absWorkDir)
+			journal.trackContext(ctx)
+			cleanup(ctx)
+			journal.finish(err)
 
-			// Record failed installation in history
-			_ = ldb.AddHistory(packageName, release.Version, "install", "", false, err.Error())
+			// Record failed installation in history, with the steps that ran
+			_ = ldb.AddHistoryTrace(packageName, release.Version, "install", "", false, err.Error(), ctx.Trace)
 			return
 		}
 
+		journal.trackContext(ctx)
+		journal.step(i + 1)
 		fmt.Printf("%s  ✓ Success%s\n", lib.Green, lib.Reset)
 	}
 
@@ -249,6 +304,12 @@ func install(cmd *cobra.Command, args []string) {
 	ctx.MarkCompleted()
 	ctx.Installation.UpdatedAt = time.Now()
 
+	// Record everything the instructions left on disk
+	manifest, err := lib.BuildManifest(ctx)
+	if err != nil {
+		fmt.Printf("%sWarning: Failed to scan installed files: %v%s\n", lib.Yellow, err, lib.Reset)
+	}
+
 	// Check if package already exists and update or insert
 	existing, _ := ldb.GetByName(packageName)
 	packageExists := existing != nil
@@ -256,6 +317,7 @@ func install(cmd *cobra.Command, args []string) {
 	// Save installation to database
 	fmt.Println("\nSaving installation record...")
 	if packageExists {
+		ctx.Installation.ID = existing.ID
 		if err := ldb.UpdateInstallation(ctx.Installation); err != nil {
 			fmt.Printf("%sWarning: Failed to update installation record: %v%s\n",
 				lib.Yellow, err, lib.Reset)
@@ -267,16 +329,48 @@ func install(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	// Save environment modifications
-	if len(ctx.EnvMods) > 0 && ctx.Installation.ID > 0 {
-		for _, mod := range ctx.EnvMods {
-			_ = ldb.AddEnvModification(ctx.Installation.ID, mod.ModificationType,
-				mod.VariableName, mod.VariableValue, mod.OriginalValue)
+	// Save the installed file manifest, taking over any files replaced from other packages
+	if ctx.Installation.ID > 0 {
+		reportTakenOver(ldb, packageName, manifest)
+		if err := ldb.DisownFiles(ctx.Installation.ID, manifest); err != nil {
+			fmt.Printf("%sWarning: Failed to update file ownership: %v%s\n", lib.Yellow, err, lib.Reset)
+		}
+		if err := ldb.ReplaceInstalledFiles(ctx.Installation.ID, manifest); err != nil {
+			fmt.Printf("%sWarning: Failed to save installed files: %v%s\n", lib.Yellow, err, lib.Reset)
+		} else {
+			fmt.Printf("Recorded %d installed file(s)\n", len(manifest))
+		}
+	}
+
+	// Save the output of package scripts
+	if ctx.Installation.ID > 0 {
+		if err := ldb.ReplaceScriptRuns(ctx.Installation.ID, ctx.Scripts); err != nil {
+			fmt.Printf("%sWarning: Failed to save script output: %v%s\n", lib.Yellow, err, lib.Reset)
 		}
 	}
 
+	// Keep the instruction trace for 'jpm info --trace'
+	if ctx.Installation.ID > 0 {
+		if err := ldb.ReplaceTrace(ctx.Installation.ID, ctx.Trace); err != nil {
+			fmt.Printf("%sWarning: Failed to save instruction trace: %v%s\n", lib.Yellow, err, lib.Reset)
+		}
+	}
+
+	// Keep the undo log for 'jpm remove'. Files this package replaced from its
+	// previous install are not worth restoring, so their backups are dropped.
+	// The environment modifications are the ones the undo log will revert,
+	// so a reinstall does not list them twice.
+	if ctx.Installation.ID > 0 {
+		records := saveUndoLog(ldb, ctx)
+		if err := ldb.ReplaceEnvModifications(ctx.Installation.ID, envModsFromUndo(records)); err != nil {
+			fmt.Printf("%sWarning: Failed to save environment modifications: %v%s\n", lib.Yellow, err, lib.Reset)
+		}
+	}
+	_ = os.Remove(ctx.BackupDir)
+
 	// Update metadata cache
 	_ = ldb.UpdateCache(packageName, release.Version, pkg.Description, pkg.HomepageURL, 24*time.Hour)
+	journal.finish(nil)
 
 	// Success message
 	fmt.Printf("\n%s✓ Successfully installed %s (v%s)%s\n",
@@ -293,6 +387,22 @@ func install(cmd *cobra.Command, args []string) {
 	}
 }
 
+// resolveWorkDir returns the absolute --work-dir, defaulting to the packages
+// directory under the jpm home
+func resolveWorkDir() (string, error) {
+	if workingDir == "" {
+		return config.PackagesDir(), nil
+	}
+	return filepath.Abs(workingDir)
+}
+
+// newInstructionParser returns a parser that expands USE macros from the registry
+func newInstructionParser(rdb *db.RemoteDB) *parser.Parser {
+	p := parser.NewParser()
+	p.Macros = rdb
+	return p
+}
+
 func downloadPackage(url, destDir string) (string, error) {
 	if err := lib.Download(url, destDir); err != nil {
 		return "", err
@@ -304,18 +414,11 @@ func downloadPackage(url, destDir string) (string, error) {
 }
 
 func verifyChecksum(filePath, expectedChecksum string) error {
-	file, err := os.Open(filePath)
+	actualChecksum, err := lib.HashFile(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
-	}
-	defer file.Close()
-
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return fmt.Errorf("failed to calculate checksum: %w", err)
+		return err
 	}
 
-	actualChecksum := hex.EncodeToString(hash.Sum(nil))
 	if actualChecksum != expectedChecksum {
 		return fmt.Errorf("checksum mismatch: expected %s, got %s", expectedChecksum, actualChecksum)
 	}
@@ -344,27 +447,164 @@ func getUpgradeDowngradeText(currentVersion, newVersionSpec string) string {
 	return "Reinstalling"
 }
 
-func cleanup(ctx *model.InstallationContext, workDir string) {
+// reportTakenOver warns about manifest files that were previously recorded
+// for another package, e.g. overwritten by an extraction or with --overwrite
+func reportTakenOver(ldb db.LocalDB, packageName string, manifest []model.InstalledFile) {
+	for _, f := range manifest {
+		if f.FileType == "directory" {
+			continue
+		}
+		owners, err := ldb.GetFileOwners(f.FilePath)
+		if err != nil {
+			continue
+		}
+		for _, owner := range owners {
+			if owner.PackageName != packageName && owner.File.FilePath == f.FilePath {
+				fmt.Printf("%sWarning: %s was owned by '%s' and now belongs to '%s'%s\n",
+					lib.Yellow, f.FilePath, owner.PackageName, packageName, lib.Reset)
+			}
+		}
+	}
+}
+
+func cleanup(ctx *model.InstallationContext) {
 	fmt.Println("\nAttempting cleanup...")
 
-	if ctx.Installation.SysPath != "" {
-		fmt.Printf("Removing from PATH: %s\n", ctx.Installation.SysPath)
-		if err := lib.RemoveFromPath(ctx.Installation.SysPath); err != nil {
-			fmt.Printf("Warning: Failed to remove from PATH: %v\n", err)
+	// Replay the undo log: created paths are deleted, overwritten or deleted
+	// files are restored from their backups and PATH entries are removed
+	if err := lib.ReplayUndo(ctx.Undo, false); err != nil {
+		fmt.Printf("Warning: Cleanup incomplete:\n%v\n", err)
+	}
+	_ = os.Remove(ctx.BackupDir)
+	_ = os.Remove(filepath.Dir(ctx.BackupDir))
+}
+
+// saveUndoLog stores the undo log of a successful install on top of the log
+// kept from the package's previous install, if any
+func saveUndoLog(ldb db.LocalDB, ctx *model.InstallationContext) []model.UndoRecord {
+	records, err := ldb.GetUndoLog(ctx.Installation.ID)
+	if err != nil {
+		fmt.Printf("%sWarning: Failed to read previous undo log: %v%s\n", lib.Yellow, err, lib.Reset)
+	}
+
+	var replaced []model.UndoRecord
+	for _, rec := range ctx.Undo {
+		if rec.Kind == model.UndoReplaced {
+			replaced = append(replaced, rec)
+			continue
 		}
+		records = append(records, rec)
 	}
+	lib.DiscardBackups(replaced)
+
+	if err := ldb.ReplaceUndoLog(ctx.Installation.ID, records); err != nil {
+		fmt.Printf("%sWarning: Failed to save undo log: %v%s\n", lib.Yellow, err, lib.Reset)
+	}
+	return records
+}
 
-	if ctx.Installation.Location != "" && ctx.Installation.Location != workDir {
-		fmt.Printf("Removing extracted files: %s\n", ctx.Installation.Location)
-		if err := lib.Delete(ctx.Installation.Location); err != nil {
-			fmt.Printf("Warning: Failed to remove files: %v\n", err)
+// envModsFromUndo lists the PATH entries and environment changes an undo
+// log reverts, each once
+func envModsFromUndo(records []model.UndoRecord) []model.EnvModification {
+	var mods []model.EnvModification
+	seen := make(map[string]bool)
+	for _, rec := range records {
+		var mod model.EnvModification
+		switch rec.Kind {
+		case model.UndoPathEntry:
+			mod = model.EnvModification{ModificationType: "path_addition", VariableName: "PATH", VariableValue: rec.Value}
+		case model.UndoEnv:
+			var err error
+			if mod, err = lib.DecodeEnv(rec.Value); err != nil {
+				continue
+			}
+		default:
+			continue
+		}
+		if !seen[envKey(mod)] {
+			seen[envKey(mod)] = true
+			mods = append(mods, mod)
 		}
 	}
+	return mods
+}
 
-	// Clean up downloaded files
-	for _, file := range ctx.Files {
-		if err := lib.Delete(file); err != nil {
-			fmt.Printf("Warning: Failed to delete %s: %v\n", file, err)
+// installJournal records install progress in the local database so an
+// installation interrupted by a crash can be undone by 'jpm doctor'. A
+// journal that could not be started turns every call into a no-op.
+type installJournal struct {
+	ldb     db.LocalDB
+	id      int
+	entries map[string]bool
+}
+
+func beginJournal(ldb db.LocalDB, ctx *model.InstallationContext, totalSteps int) *installJournal {
+	j := &model.InstallJournal{
+		PackageName: ctx.Installation.Name,
+		Version:     ctx.Installation.Version,
+		WorkDir:     ctx.Installation.WorkDir,
+		SourceURL:   ctx.Installation.InstalledFromURL,
+		TotalSteps:  totalSteps,
+	}
+	if err := ldb.BeginJournal(j); err != nil {
+		fmt.Printf("%sWarning: Failed to journal installation: %v%s\n", lib.Yellow, err, lib.Reset)
+		return &installJournal{}
+	}
+	return &installJournal{ldb: ldb, id: j.ID, entries: make(map[string]bool)}
+}
+
+// track records paths before they are written, so they are known even if
+// the process dies halfway through writing them
+func (j *installJournal) track(paths ...string) {
+	for _, path := range paths {
+		j.add("path", path, j.ldb.AddJournalPath)
+	}
+}
+
+// trackContext records everything the instructions have reported so far
+func (j *installJournal) trackContext(ctx *model.InstallationContext) {
+	for _, f := range ctx.Files {
+		j.add("path", f.FilePath, j.ldb.AddJournalPath)
+	}
+	for _, mod := range ctx.EnvMods {
+		if mod.ModificationType == "path_addition" {
+			j.add("path_entry", mod.VariableValue, j.ldb.AddJournalPathEntry)
+		} else {
+			j.add("env", lib.EncodeEnv(mod), j.ldb.AddJournalEnvEntry)
 		}
 	}
 }
+
+// undo records an undo record before the change it reverses is made
+func (j *installJournal) undo(rec model.UndoRecord) {
+	if j.id != 0 {
+		_ = j.ldb.AddJournalUndo(j.id, rec)
+	}
+}
+
+func (j *installJournal) add(kind, value string, record func(int, string) error) {
+	if j.id == 0 || value == "" || j.entries[kind+"\x00"+value] {
+		return
+	}
+	if err := record(j.id, value); err == nil {
+		j.entries[kind+"\x00"+value] = true
+	}
+}
+
+func (j *installJournal) step(n int) {
+	if j.id != 0 {
+		_ = j.ldb.UpdateJournalStep(j.id, n)
+	}
+}
+
+// finish closes the journal; a failed install has already been cleaned up
+func (j *installJournal) finish(err error) {
+	if j.id == 0 {
+		return
+	}
+	if err != nil {
+		_ = j.ldb.FinishJournal(j.id, "failed", err.Error())
+		return
+	}
+	_ = j.ldb.FinishJournal(j.id, "completed", "")
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"jpm/db"
+	"jpm/lib"
+	"jpm/model"
+	"jpm/parser"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var lintArtifact string
+
+var lintCmd = &cobra.Command{
+	Use:   "lint-instructions <file>",
+	Short: "Check release instructions for likely mistakes",
+	Long: `Parse instruction text or a JSON manifest and report every error and
+warning, plus steps that parse but probably do not do what was meant:
+
+  - files moved or copied into place and then deleted unused
+  - CHMOD on a path nothing extracts, downloads or moves there
+  - archives whose name does not fit the EXTRACT command or the release artifact
+  - a MOVE or RENAME immediately undone or moved again
+  - Windows- or Unix-only paths outside an OS guard
+
+Exits with a non-zero status if anything is reported.
+
+Examples:
+  jpm lint-instructions install.txt
+  jpm lint-instructions install.txt --artifact tool-1.2.0-linux-amd64.tar.gz`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if !lintInstructions(args[0]) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lintCmd)
+	lintCmd.Flags().StringVar(&lintArtifact, "artifact", "", "File name of the release download the instructions are for")
+}
+
+// lintInstructions prints every finding and returns true when there are none
+func lintInstructions(file string) bool {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Printf("%sError reading %s: %v%s\n", lib.Red, file, err, lib.Reset)
+		return false
+	}
+
+	macros := &registryMacros{}
+	defer macros.Close()
+
+	p := parser.NewParser()
+	p.Macros = macros
+	install, remove, diags := p.Diagnose(string(data))
+	if !diags.HasErrors() {
+		diags = append(diags, parser.Lint(install, parser.LintOptions{Artifact: lintArtifact})...)
+		diags = append(diags, parser.Lint(remove, parser.LintOptions{})...)
+	}
+
+	if len(diags) == 0 {
+		fmt.Printf("%s✓ %s: no problems found%s\n", lib.Green, file, lib.Reset)
+		return true
+	}
+	for _, d := range diags {
+		color := lib.Red
+		if d.Severity == parser.SeverityWarning {
+			color = lib.Yellow
+		}
+		fmt.Printf("%s%s: %v%s\n", color, file, d, lib.Reset)
+	}
+	return false
+}
+
+// registryMacros looks USE macros up in the registry, connecting only when
+// the first one is needed so instructions without USE work offline
+type registryMacros struct {
+	rdb *db.RemoteDB
+}
+
+func (m *registryMacros) GetMacro(name string) (*model.Macro, error) {
+	if m.rdb == nil {
+		rdb := db.NewRemoteDB()
+		m.rdb = &rdb
+	}
+	return m.rdb.GetMacro(name)
+}
+
+func (m *registryMacros) Close() {
+	if m.rdb != nil {
+		m.rdb.Close()
+	}
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"jpm/lib"
+	"jpm/parser"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	manifestTo     string
+	manifestOutput string
+)
+
+var manifestCmd = &cobra.Command{
+	Use:   "manifest",
+	Short: "Work with release instructions and JSON manifests",
+}
+
+var manifestConvertCmd = &cobra.Command{
+	Use:   "convert <file>",
+	Short: "Convert between instruction text and a JSON manifest",
+	Long: `Translate a release's installation steps between the line-based
+instruction text and the structured JSON manifest. Both compile to the same
+steps, so a registry can store either form.
+
+The input format is detected from the file: a manifest starts with '{'.
+By default it is converted to the other format. Comments in instruction
+text are not carried over.
+
+Examples:
+  jpm manifest convert install.txt                  # Print as JSON
+  jpm manifest convert manifest.json                # Print as instruction text
+  jpm manifest convert install.txt -o manifest.json
+  jpm manifest convert install.txt --to text        # Normalise the text`,
+	Args: cobra.ExactArgs(1),
+	Run:  convertManifest,
+}
+
+func init() {
+	rootCmd.AddCommand(manifestCmd)
+	manifestCmd.AddCommand(manifestConvertCmd)
+	manifestConvertCmd.Flags().StringVar(&manifestTo, "to", "", "Output format: json or text (default: the other format)")
+	manifestConvertCmd.Flags().StringVarP(&manifestOutput, "output", "o", "", "Write to a file instead of stdout")
+}
+
+func convertManifest(cmd *cobra.Command, args []string) {
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Printf("%sError reading %s: %v%s\n", lib.Red, args[0], err, lib.Reset)
+		return
+	}
+
+	// USE lines are converted as they are, so no registry is needed
+	p := parser.NewParser()
+	p.KeepMacros = true
+	install, remove, diags := p.Diagnose(string(data))
+	if err := diags.Err(); err != nil {
+		fmt.Printf("%sInvalid instructions in %s:\n%v%s\n", lib.Red, args[0], err, lib.Reset)
+		return
+	}
+
+	to := manifestTo
+	if to == "" {
+		to = "json"
+		if parser.IsManifest(string(data)) {
+			to = "text"
+		}
+	}
+
+	var out string
+	switch to {
+	case "json":
+		out, err = parser.NewManifest(install, remove).Encode()
+		if err != nil {
+			fmt.Printf("%sError encoding manifest: %v%s\n", lib.Red, err, lib.Reset)
+			return
+		}
+	case "text":
+		out = parser.FormatText(install, remove)
+	default:
+		fmt.Printf("%sUnknown format '%s' (use json or text)%s\n", lib.Red, to, lib.Reset)
+		return
+	}
+
+	if manifestOutput == "" {
+		fmt.Print(out)
+		return
+	}
+	if err := os.WriteFile(manifestOutput, []byte(out), 0644); err != nil {
+		fmt.Printf("%sError writing %s: %v%s\n", lib.Red, manifestOutput, err, lib.Reset)
+		return
+	}
+	fmt.Printf("%s✓ Wrote %s%s\n", lib.Green, manifestOutput, lib.Reset)
+}
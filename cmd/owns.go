@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"jpm/db"
+	"jpm/lib"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var ownsCmd = &cobra.Command{
+	Use:   "owns <path>",
+	Short: "Show which installed package owns a file",
+	Long: `Look up a file or directory in the installed-file manifests and report
+the package that installed it.
+
+Paths inside a directory recorded by a package are reported as belonging to
+that package.
+
+Examples:
+  jpm owns ~/.jpm/packages/nodejs/bin/node  # A file in the packages directory
+  jpm owns nodejs/bin/node                  # Relative to the current directory`,
+	Args: cobra.ExactArgs(1),
+	Run:  showOwner,
+}
+
+func init() {
+	rootCmd.AddCommand(ownsCmd)
+}
+
+func showOwner(cmd *cobra.Command, args []string) {
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		fmt.Printf("%sError resolving path: %v%s\n", lib.Red, err, lib.Reset)
+		return
+	}
+
+	ldb := db.NewLocalDB()
+	defer ldb.Close()
+
+	owner, err := ldb.FindFileOwner(path)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+		return
+	}
+
+	if owner == nil {
+		fmt.Printf("%s%s is not owned by any installed package%s\n", lib.Yellow, path, lib.Reset)
+		return
+	}
+
+	if owner.File.FilePath == path {
+		fmt.Printf("%s is owned by %s%s%s (v%s)\n", path, lib.Green, owner.PackageName, lib.Reset, owner.Version)
+		fmt.Printf("  Type: %s\n", owner.File.FileType)
+		fmt.Printf("  Mode: %s\n", owner.File.Mode.Perm())
+		if owner.File.FileType != "directory" {
+			fmt.Printf("  Size: %s\n", formatBytes(owner.File.SizeBytes))
+		}
+		return
+	}
+
+	fmt.Printf("%s is inside %s, owned by %s%s%s (v%s)\n",
+		path, owner.File.FilePath, lib.Green, owner.PackageName, lib.Reset, owner.Version)
+}
@@ -3,10 +3,18 @@ package cmd
 import (
 	"bufio"
 	"fmt"
+	"jpm/config"
 	"jpm/db"
 	"jpm/lib"
+	"jpm/model"
+	"jpm/parser"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -14,6 +22,8 @@ import (
 var (
 	removeForce     bool
 	removeAutoClean bool
+	removeSkipHooks bool
+	removePurge     bool
 )
 
 var removeCmd = &cobra.Command{
@@ -26,17 +36,28 @@ Examples:
   jpm remove nodejs --force            # Remove without confirmation
   jpm remove nodejs --auto-clean       # Also remove unused dependencies
 
+Steps from the release's ON_REMOVE section run first, while the package's
+files are still in place. If one of them fails, nothing is removed.
+
+Configuration files installed with CONFIG that you have edited are kept,
+unless --purge is given.
+
 Flags:
   -f, --force                          # Skip confirmation prompt
-  --auto-clean                         # Remove unused auto-installed dependencies`,
-	Args: cobra.ExactArgs(1),
-	Run:  removePackage,
+  --auto-clean                         # Remove unused auto-installed dependencies
+  --skip-hooks                         # Don't run the package's ON_REMOVE steps
+  --purge                              # Also delete edited configuration files`,
+	Args:        cobra.ExactArgs(1),
+	Annotations: mutating,
+	Run:         removePackage,
 }
 
 func init() {
 	rootCmd.AddCommand(removeCmd)
 	removeCmd.Flags().BoolVarP(&removeForce, "force", "f", false, "Skip confirmation prompt")
 	removeCmd.Flags().BoolVar(&removeAutoClean, "auto-clean", false, "Remove unused auto-installed dependencies")
+	removeCmd.Flags().BoolVar(&removeSkipHooks, "skip-hooks", false, "Don't run the package's ON_REMOVE steps")
+	removeCmd.Flags().BoolVar(&removePurge, "purge", false, "Also delete edited configuration files")
 }
 
 func removePackage(cmd *cobra.Command, args []string) {
@@ -94,10 +115,32 @@ func removePackage(cmd *cobra.Command, args []string) {
 		fmt.Printf("\n%d file(s) will be removed\n", len(files))
 	}
 
-	// Get environment modifications
-	envMods, err := ldb.GetEnvModifications(installation.ID)
-	if err == nil && len(envMods) > 0 {
-		fmt.Printf("%d environment modification(s) will be reverted\n", len(envMods))
+	// PATH and environment changes are reverted through the undo log. Installs
+	// recorded before it existed only have their environment modifications.
+	undoLog, undoErr := ldb.GetUndoLog(installation.ID)
+	envUndo := countEnvUndo(undoLog)
+	var envMods []model.EnvModification
+	if envUndo == 0 {
+		envMods, _ = ldb.GetEnvModifications(installation.ID)
+		envUndo = len(envMods)
+	}
+	if envUndo > 0 {
+		fmt.Printf("%d environment modification(s) will be reverted\n", envUndo)
+	}
+
+	// Parse the package's own removal steps up front
+	hooks, err := parser.NewParser().ParseRemove(installation.OnRemove)
+	if err != nil {
+		fmt.Printf("%sInvalid ON_REMOVE steps: %v%s\n", lib.Red, err, lib.Reset)
+		if !removeSkipHooks {
+			fmt.Println("Use --skip-hooks to remove the package without running them")
+			return
+		}
+	}
+	if removeSkipHooks {
+		hooks = nil
+	} else if len(hooks) > 0 {
+		fmt.Printf("%d removal step(s) from the package will run first\n", len(hooks))
 	}
 
 	// Confirmation
@@ -112,26 +155,34 @@ func removePackage(cmd *cobra.Command, args []string) {
 	// Start removal process
 	fmt.Printf("\n%sRemoving package...%s\n", lib.Blue, lib.Reset)
 
-	// Revert environment modifications
-	if len(envMods) > 0 {
-		fmt.Println("\nReverting environment modifications...")
-		for _, mod := range envMods {
-			if mod.ModificationType == "path_addition" {
-				if err := lib.RemoveFromPath(mod.VariableValue); err != nil {
-					fmt.Printf("%sWarning: Failed to remove PATH entry: %v%s\n", lib.Yellow, err, lib.Reset)
-				} else {
-					fmt.Printf("  ✓ Removed from PATH: %s\n", mod.VariableValue)
-				}
-			}
+	// Let the package undo its own changes while its files still exist
+	if len(hooks) > 0 {
+		fmt.Println("\nRunning removal steps...")
+		if err := runRemoveHooks(ldb, installation, files, hooks); err != nil {
+			fmt.Printf("%s✗ %v%s\n", lib.Red, err, lib.Reset)
+			fmt.Println("Removal aborted. Use --skip-hooks to remove the package without running them")
+			_ = ldb.AddHistory(packageName, installation.Version, "remove", "", false, err.Error())
+			return
 		}
 	}
 
 	// Remove files
+	kept := make(map[string]bool)
 	if len(files) > 0 {
 		fmt.Println("\nRemoving installed files...")
 		failedFiles := 0
+		// Walk the manifest deepest-first so directories are empty by the time we reach them
+		sort.Slice(files, func(i, j int) bool { return files[i].FilePath > files[j].FilePath })
 		for _, file := range files {
-			if err := lib.Delete(file.FilePath); err != nil {
+			if file.FileType == "user_config" {
+				_ = os.Remove(file.FilePath + ".jpmnew")
+				if !removePurge && lib.ConfigModified(file) {
+					fmt.Printf("  ! Keeping modified config: %s\n", file.FilePath)
+					kept[file.FilePath] = true
+					continue
+				}
+			}
+			if err := removeManifestEntry(file); err != nil {
 				failedFiles++
 				if removeForce {
 					// Only warn in force mode
@@ -147,13 +198,31 @@ func removePackage(cmd *cobra.Command, args []string) {
 	// Remove installation location
 	if installation.Location != "" {
 		fmt.Println("\nRemoving installation directory...")
-		if err := lib.Delete(installation.Location); err != nil {
+		if keepsConfig(installation.Location, kept) {
+			fmt.Printf("  ! Keeping %s, it holds modified configuration\n", installation.Location)
+		} else if err := lib.Delete(installation.Location); err != nil {
 			fmt.Printf("%sWarning: Failed to remove directory: %v%s\n", lib.Yellow, err, lib.Reset)
 		} else {
 			fmt.Printf("  ✓ Removed: %s\n", installation.Location)
 		}
 	}
 
+	// Replay the undo log to restore whatever the install overwrote or
+	// deleted and to revert its PATH and environment changes
+	if undoErr != nil {
+		fmt.Printf("%sWarning: Failed to read undo log: %v%s\n", lib.Yellow, undoErr, lib.Reset)
+	} else if len(undoLog) > 0 {
+		undoLog = slices.DeleteFunc(undoLog, func(rec model.UndoRecord) bool { return kept[rec.Path] })
+		fmt.Println("\nReplaying undo log...")
+		if err := lib.ReplayUndo(undoLog, true); err != nil {
+			fmt.Printf("%sWarning: Some changes could not be undone:\n%v%s\n", lib.Yellow, err, lib.Reset)
+		}
+	}
+	if len(envMods) > 0 {
+		fmt.Println("\nReverting environment modifications...")
+		revertEnvMods(envMods)
+	}
+
 	// Remove from database
 	if err := ldb.DeleteInstallation(packageName); err != nil {
 		fmt.Printf("%sError removing from database: %v%s\n", lib.Red, err, lib.Reset)
@@ -170,6 +239,124 @@ func removePackage(cmd *cobra.Command, args []string) {
 	}
 }
 
+// keepsConfig reports whether dir holds one of the kept configuration files
+func keepsConfig(dir string, kept map[string]bool) bool {
+	for path := range kept {
+		if inside, err := lib.WithinRoot(dir, path); err == nil && inside {
+			return true
+		}
+	}
+	return false
+}
+
+// countEnvUndo counts the PATH and environment changes in an undo log
+func countEnvUndo(records []model.UndoRecord) int {
+	n := 0
+	for _, rec := range records {
+		if rec.Kind == model.UndoPathEntry || rec.Kind == model.UndoEnv {
+			n++
+		}
+	}
+	return n
+}
+
+// revertEnvMods reverts the environment modifications of an installation
+// recorded without undo records
+func revertEnvMods(envMods []model.EnvModification) {
+	// Newest first, so a variable set by several installs gets its original value back
+	for i := len(envMods) - 1; i >= 0; i-- {
+		mod := envMods[i]
+		if mod.ModificationType == "path_addition" {
+			if err := lib.RemoveFromPath(mod.VariableValue); err != nil {
+				fmt.Printf("%sWarning: Failed to remove PATH entry: %v%s\n", lib.Yellow, err, lib.Reset)
+			} else {
+				fmt.Printf("  ✓ Removed from PATH: %s\n", mod.VariableValue)
+			}
+			continue
+		}
+		if err := lib.RevertEnv(mod); err != nil {
+			fmt.Printf("%sWarning: Failed to revert %s: %v%s\n", lib.Yellow, mod.VariableName, err, lib.Reset)
+		} else {
+			fmt.Printf("  ✓ Reverted %s\n", mod.VariableName)
+		}
+	}
+}
+
+// runRemoveHooks executes the ON_REMOVE steps recorded for an installation
+// under the same path and ownership checks as install. The steps may reach
+// every file the installation recorded. Files they overwrite or delete are
+// backed up, and if a step fails its predecessors are undone.
+func runRemoveHooks(ldb db.LocalDB, inst *model.Installation, files []model.InstalledFile, hooks []parser.Instruction) error {
+	workDir := inst.WorkDir
+	if workDir == "" {
+		abs, err := resolveWorkDir()
+		if err != nil {
+			return err
+		}
+		workDir = abs
+	}
+
+	ctx := model.NewInstallationContext(inst.Name, inst.Version, workDir)
+	ctx.Installation.Location = inst.Location
+	ctx.Installation.SysPath = inst.SysPath
+	ctx.Files = files
+	ctx.OwnersOf = ldb.GetFileOwners
+	ctx.Installed = ldb.GetByName
+	grants, err := ldb.GrantedPaths(inst.Name)
+	if err != nil {
+		fmt.Printf("%sWarning: Failed to read path grants: %v%s\n", lib.Yellow, err, lib.Reset)
+	}
+	ctx.AllowedPaths = grants
+	ctx.BackupDir = filepath.Join(config.BackupsDir(), inst.Name, time.Now().Format("20060102-150405"))
+	defer func() {
+		_ = os.Remove(ctx.BackupDir)
+		_ = os.Remove(filepath.Dir(ctx.BackupDir))
+	}()
+
+	for i, hook := range hooks {
+		if !hook.AppliesHere() {
+			fmt.Printf("  [%d/%d] %s %s(skipped on %s/%s)%s\n", i+1, len(hooks), hook.RawLine,
+				lib.Yellow, runtime.GOOS, runtime.GOARCH, lib.Reset)
+			continue
+		}
+
+		fmt.Printf("  [%d/%d] %s\n", i+1, len(hooks), hook.RawLine)
+		if err := hook.RunWithContext(ctx, workDir); err != nil {
+			if undoErr := lib.ReplayUndo(ctx.Undo, false); undoErr != nil {
+				fmt.Printf("%sWarning: Some changes could not be undone:\n%v%s\n", lib.Yellow, undoErr, lib.Reset)
+			}
+			return fmt.Errorf("removal step %d failed: %w", i+1, err)
+		}
+		fmt.Printf("%s  ✓ Success%s\n", lib.Green, lib.Reset)
+	}
+	return nil
+}
+
+// removeManifestEntry deletes a single recorded file. Directories are only
+// removed once empty, so anything the user added inside them survives.
+func removeManifestEntry(file model.InstalledFile) error {
+	info, err := os.Lstat(file.FilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		entries, err := os.ReadDir(file.FilePath)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			fmt.Printf("  ! Keeping non-empty directory: %s\n", file.FilePath)
+			return nil
+		}
+	}
+
+	return os.Remove(file.FilePath)
+}
+
 func confirmAction() bool {
 	reader := bufio.NewReader(os.Stdin)
 	response, err := reader.ReadString('\n')
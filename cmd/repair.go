@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"fmt"
+	"jpm/config"
+	"jpm/db"
+	"jpm/lib"
+	"jpm/model"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var repairCmd = &cobra.Command{
+	Use:   "repair <package-name>",
+	Short: "Restore missing or modified files of an installed package",
+	Long: `Repair a damaged installation without changing its version.
+
+The release recorded at install time is downloaded again from its original
+URL, checked against the recorded SHA-256 and installed into a temporary
+staging directory with the instructions stored at install time. Only files
+that 'jpm verify' reports as missing or modified are copied back, command
+links made by LINK_BIN are recreated and missing PATH entries are restored.
+Extra files are left untouched. Package scripts are not run again, so files
+only a script produces cannot be restored.
+
+Examples:
+  jpm repair nodejs                # Repair nodejs in place
+  jpm repair nodejs --skip-verify  # Skip the download checksum check`,
+	Args:        cobra.ExactArgs(1),
+	Annotations: mutating,
+	Run:         repairPackage,
+}
+
+func init() {
+	rootCmd.AddCommand(repairCmd)
+	repairCmd.Flags().BoolVar(&skipVerify, "skip-verify", false, "Skip checksum verification of the download")
+}
+
+func repairPackage(cmd *cobra.Command, args []string) {
+	packageName := args[0]
+
+	ldb := db.NewLocalDB()
+	defer ldb.Close()
+
+	inst, err := ldb.GetByName(packageName)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+		return
+	}
+	if inst == nil {
+		fmt.Printf("%sPackage '%s' is not installed%s\n", lib.Yellow, packageName, lib.Reset)
+		return
+	}
+
+	fmt.Printf("%sChecking %s (v%s)...%s\n", lib.Blue, inst.Name, inst.Version, lib.Reset)
+
+	files, err := ldb.GetInstalledFiles(inst.ID)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+		return
+	}
+	if len(files) == 0 {
+		fmt.Printf("%sNo file manifest recorded for '%s'; reinstall with --force instead%s\n",
+			lib.Yellow, packageName, lib.Reset)
+		return
+	}
+
+	damaged, err := findDamagedFiles(files)
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+		return
+	}
+
+	envMods, _ := ldb.GetEnvModifications(inst.ID)
+	var missingPaths []string
+	for _, mod := range envMods {
+		if mod.ModificationType != "path_addition" {
+			continue
+		}
+		if present, err := lib.HasPathEntry(mod.VariableValue); err == nil && !present {
+			missingPaths = append(missingPaths, mod.VariableValue)
+		}
+	}
+
+	if len(damaged) == 0 && len(missingPaths) == 0 {
+		fmt.Printf("%s✓ Nothing to repair%s\n", lib.Green, lib.Reset)
+		return
+	}
+
+	fmt.Printf("Found %d damaged file(s) and %d missing PATH entry(s)\n", len(damaged), len(missingPaths))
+
+	if len(damaged) > 0 {
+		grants, _ := ldb.GrantedPaths(packageName)
+		if err := restoreFromRelease(inst, damaged, grants, ldb.GetByName); err != nil {
+			fmt.Printf("%s✗ Repair failed: %v%s\n", lib.Red, err, lib.Reset)
+			_ = ldb.AddHistory(packageName, inst.Version, "repair", "", false, err.Error())
+			return
+		}
+	}
+
+	for _, entry := range missingPaths {
+		if _, err := lib.EnsurePathEntry(entry); err != nil {
+			fmt.Printf("%sWarning: Failed to restore PATH entry %s: %v%s\n", lib.Yellow, entry, err, lib.Reset)
+		} else {
+			fmt.Printf("  ✓ Restored PATH entry: %s\n", entry)
+		}
+	}
+
+	// Check the result against the manifest again
+	remaining, err := findDamagedFiles(files)
+	if err == nil && len(remaining) > 0 {
+		msg := fmt.Sprintf("%d file(s) could not be restored", len(remaining))
+		fmt.Printf("\n%s✗ %s%s\n", lib.Red, msg, lib.Reset)
+		for _, d := range remaining {
+			fmt.Printf("  %-9s %s\n", d.Kind, d.Path)
+		}
+		_ = ldb.AddHistory(packageName, inst.Version, "repair", "", false, msg)
+		return
+	}
+
+	_ = ldb.AddHistory(packageName, inst.Version, "repair", "", true, "")
+	fmt.Printf("\n%s✓ Successfully repaired %s (v%s)%s\n", lib.Green, packageName, inst.Version, lib.Reset)
+}
+
+// findDamagedFiles returns the manifest entries that are missing or modified
+func findDamagedFiles(files []model.InstalledFile) ([]lib.FileDrift, error) {
+	drift, err := lib.VerifyManifest(files)
+	if err != nil {
+		return nil, err
+	}
+
+	var damaged []lib.FileDrift
+	for _, d := range drift {
+		if d.Kind == lib.DriftMissing || d.Kind == lib.DriftModified {
+			damaged = append(damaged, d)
+		}
+	}
+	return damaged, nil
+}
+
+// restoreFromRelease rebuilds the recorded release in a staging directory and
+// copies the damaged files back into the install tree. installed looks up
+// other packages for templates.
+func restoreFromRelease(inst *model.Installation, damaged []lib.FileDrift, grants []string,
+	installed func(string) (*model.Installation, error)) error {
+	if inst.InstalledFromURL == "" {
+		return fmt.Errorf("no download URL recorded for '%s'", inst.Name)
+	}
+
+	workDir := inst.WorkDir
+	if workDir == "" {
+		abs, err := resolveWorkDir()
+		if err != nil {
+			return err
+		}
+		workDir = abs
+	}
+
+	rdb := db.NewRemoteDB()
+	defer rdb.Close()
+
+	if err := os.MkdirAll(config.CacheDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	staging, err := os.MkdirTemp(config.CacheDir(), "repair-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	fmt.Println("\nDownloading package...")
+	downloadedFile, err := downloadPackage(inst.InstalledFromURL, staging)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+
+	if !skipVerify && inst.ChecksumSHA256 != "" {
+		fmt.Println("\nVerifying checksum...")
+		if err := verifyChecksum(downloadedFile, inst.ChecksumSHA256); err != nil {
+			return err
+		}
+		fmt.Printf("%s✓ Checksum verified%s\n", lib.Green, lib.Reset)
+	}
+
+	// Rebuild what was installed, even if the release or its macros have
+	// changed in the registry since
+	source := inst.Instructions
+	if source == "" {
+		release, err := rdb.GetRelease(inst.Name, inst.Version)
+		if err != nil {
+			return fmt.Errorf("failed to fetch release %s: %w", inst.Version, err)
+		}
+		source = release.Instructions
+	}
+	instructions, err := newInstructionParser(&rdb).Parse(source)
+	if err != nil {
+		return fmt.Errorf("invalid installation instructions: %w", err)
+	}
+
+	fmt.Println("\nRebuilding package in staging area...")
+	ctx := model.NewInstallationContext(inst.Name, inst.Version, staging)
+	ctx.Staging = true
+	ctx.TargetWorkDir = workDir
+	ctx.AllowedPaths = grants
+	ctx.Installed = installed
+	for i, instruction := range instructions {
+		fmt.Printf("  [%d/%d] %s\n", i+1, len(instructions), instruction.RawLine)
+		if err := instruction.RunWithContext(ctx, staging); err != nil {
+			return fmt.Errorf("step %d failed: %w", i+1, err)
+		}
+	}
+
+	fmt.Println("\nRestoring files...")
+	for _, d := range damaged {
+		// Command links live in the shared shims directory
+		if target, ok := ctx.Links[d.Path]; ok {
+			if _, err := lib.LinkBin(target, d.Path); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", d.Path, err)
+			}
+			fmt.Printf("  ✓ Restored (%s): %s\n", d.Kind, d.Path)
+			continue
+		}
+
+		rel, err := filepath.Rel(workDir, d.Path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("%s is outside the work directory %s", d.Path, workDir)
+		}
+
+		if err := restoreEntry(filepath.Join(staging, rel), d.Path); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", d.Path, err)
+		}
+		fmt.Printf("  ✓ Restored (%s): %s\n", d.Kind, d.Path)
+	}
+
+	return nil
+}
+
+// restoreEntry replaces target with the staged copy of the same entry
+func restoreEntry(staged, target string) error {
+	info, err := os.Lstat(staged)
+	if err != nil {
+		return fmt.Errorf("not produced by the release: %w", err)
+	}
+
+	// A directory only needs its mode restored; its contents are separate entries
+	if info.IsDir() {
+		if existing, err := os.Lstat(target); err == nil && !existing.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chmod(target, info.Mode().Perm())
+	}
+
+	if existing, err := os.Lstat(target); err == nil && existing.IsDir() {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(staged)
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(target)
+		return os.Symlink(link, target)
+	}
+
+	// Remove first so read-only targets can be replaced
+	_ = os.Remove(target)
+	return lib.Copy(staged, target)
+}
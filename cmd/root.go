@@ -5,12 +5,28 @@ Copyright © 2025 Jasn Rathore <jasn.p.rathore@gmail.com>
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"jpm/config"
+	"jpm/lib"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	homeDir  string
+	lockWait time.Duration
+	heldLock *lib.Lock
+)
+
+// mutatingAnnotation marks commands that change the database, the install
+// tree or the user's shell profile and therefore must hold the jpm lock
+const mutatingAnnotation = "jpm/mutating"
 
+var mutating = map[string]string{mutatingAnnotation: "true"}
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -25,6 +41,101 @@ to quickly create a Cobra application.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRun:  acquireLock,
+	PersistentPostRun: releaseLock,
+}
+
+// migrateLegacyDB moves a jpm.db left in the current directory by a jpm
+// older than JPM_HOME to the database path, so its packages stay known.
+// It does nothing once the new database exists, and must only run with the
+// jpm lock held.
+func migrateLegacyDB() {
+	dbPath := config.DBPath()
+	legacy, err := filepath.Abs(config.LegacyDBPath)
+	if err != nil || legacy == dbPath {
+		return
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		return
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		return
+	}
+
+	if err := moveDB(legacy, dbPath); err != nil {
+		fmt.Printf("%sWarning: found a database from an older jpm at %s but could not move it to %s: %v%s\n",
+			lib.Yellow, legacy, dbPath, err, lib.Reset)
+		fmt.Println("Move it there yourself, or packages installed before are not listed")
+		return
+	}
+	fmt.Printf("%sMoved the local database from %s to %s%s\n", lib.Yellow, legacy, dbPath, lib.Reset)
+}
+
+// moveDB moves a database file along with its write-ahead log, which holds
+// changes not yet in the file itself, and the log's shared-memory index.
+// The file goes last, so an interrupted move is retried on the next run.
+func moveDB(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	for _, suffix := range []string{"-wal", "-shm", ""} {
+		if _, err := os.Stat(src + suffix); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(src+suffix, dst+suffix); err == nil {
+			continue
+		}
+		// Renaming fails across filesystems
+		if err := lib.Copy(src+suffix, dst+suffix); err != nil {
+			_ = os.Remove(dst + suffix)
+			return err
+		}
+		if err := os.Remove(src + suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// acquireLock takes the cross-process lock for mutating commands so that
+// concurrent jpm runs cannot interleave writes
+func acquireLock(cmd *cobra.Command, args []string) {
+	if cmd.Annotations[mutatingAnnotation] != "true" {
+		return
+	}
+
+	lockPath := filepath.Join(config.Home(), "jpm.lock")
+	lock, err := lib.AcquireLock(lockPath, lockWait, func(holder *lib.LockedError) {
+		fmt.Printf("%s%v; waiting up to %s...%s\n", lib.Yellow, holder, lockWait, lib.Reset)
+	})
+	if err != nil {
+		fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+		var locked *lib.LockedError
+		if errors.As(err, &locked) {
+			fmt.Println("Use --wait <duration> to wait for it, e.g. --wait 5m")
+		}
+		os.Exit(1)
+	}
+	heldLock = lock
+
+	// Only a command that changes state may take over an old database
+	migrateLegacyDB()
+
+	// With the lock held, an install journal still in progress belongs to a
+	// process that died
+	if cmd != doctorCmd && cmd != initdbCmd {
+		warnInterruptedInstalls()
+	}
+}
+
+func releaseLock(cmd *cobra.Command, args []string) {
+	if heldLock == nil {
+		return
+	}
+	if err := heldLock.Release(); err != nil {
+		fmt.Printf("%sWarning: %v%s\n", lib.Yellow, err, lib.Reset)
+	}
+	heldLock = nil
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -42,6 +153,13 @@ func init() {
 	// will be global for your application.
 
 	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.jpm.yaml)")
+	rootCmd.PersistentFlags().StringVar(&homeDir, "home", "", "jpm root directory (default $JPM_HOME or ~/.jpm)")
+	rootCmd.PersistentFlags().DurationVar(&lockWait, "wait", 0, "How long to wait for another running jpm process (e.g. 30s, 5m)")
+	cobra.OnInitialize(func() {
+		if homeDir != "" {
+			config.SetHome(homeDir)
+		}
+	})
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
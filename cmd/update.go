@@ -28,7 +28,8 @@ Examples:
 Flags:
   --all                          # Update all packages
   --dry-run                      # Show updates without installing`,
-	Run: updatePackages,
+	Annotations: mutating,
+	Run:         updatePackages,
 }
 
 func init() {
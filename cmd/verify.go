@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"fmt"
+	"jpm/db"
+	"jpm/lib"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [package-name...]",
+	Short: "Check installed files against their recorded manifest",
+	Long: `Verify that every file recorded for an installed package still exists
+with the SHA-256, mode and size captured at install time.
+
+Reports modified, missing and extra files. Exits with a non-zero status if
+any package has drifted from its manifest or has no manifest to check.
+
+Examples:
+  jpm verify                     # Verify all installed packages
+  jpm verify nodejs              # Verify a single package
+  jpm verify nodejs go           # Verify several packages`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !verifyPackages(args) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
+
+// verifyPackages prints a drift report and returns true when everything matches
+func verifyPackages(names []string) bool {
+	ldb := db.NewLocalDB()
+	defer ldb.Close()
+
+	if len(names) == 0 {
+		installations, err := ldb.GetAll()
+		if err != nil {
+			fmt.Printf("%sError: %v%s\n", lib.Red, err, lib.Reset)
+			return false
+		}
+		if len(installations) == 0 {
+			fmt.Println("No packages installed")
+			return true
+		}
+		for _, inst := range installations {
+			names = append(names, inst.Name)
+		}
+	}
+
+	clean := true
+	for _, name := range names {
+		if !verifyPackage(ldb, name) {
+			clean = false
+		}
+	}
+
+	fmt.Println(strings.Repeat("=", 50))
+	if clean {
+		fmt.Printf("%s✓ All packages verified%s\n", lib.Green, lib.Reset)
+	} else {
+		fmt.Printf("%s✗ Verification found problems%s\n", lib.Red, lib.Reset)
+	}
+	return clean
+}
+
+func verifyPackage(ldb db.LocalDB, name string) bool {
+	inst, err := ldb.GetByName(name)
+	if err != nil {
+		fmt.Printf("%s✗ %s: %v%s\n\n", lib.Red, name, err, lib.Reset)
+		return false
+	}
+	if inst == nil {
+		fmt.Printf("%s✗ %s: not installed%s\n\n", lib.Red, name, lib.Reset)
+		return false
+	}
+
+	files, err := ldb.GetInstalledFiles(inst.ID)
+	if err != nil {
+		fmt.Printf("%s✗ %s: %v%s\n\n", lib.Red, name, err, lib.Reset)
+		return false
+	}
+	if len(files) == 0 {
+		fmt.Printf("%s✗ %s (v%s): no file manifest recorded%s\n", lib.Red, name, inst.Version, lib.Reset)
+		fmt.Printf("  Reinstall with 'jpm install %s --force' to record one\n\n", name)
+		return false
+	}
+
+	drift, err := lib.VerifyManifest(files)
+	if err != nil {
+		fmt.Printf("%s✗ %s: %v%s\n\n", lib.Red, name, err, lib.Reset)
+		return false
+	}
+
+	// Files dropped into a shared directory by another package are not drift
+	var problems []lib.FileDrift
+	for _, d := range drift {
+		if d.Kind == lib.DriftExtra {
+			owner, err := ldb.FindFileOwner(d.Path)
+			if err == nil && owner != nil && owner.PackageName != name {
+				continue
+			}
+		}
+		problems = append(problems, d)
+	}
+
+	unhashed := 0
+	for _, f := range files {
+		if f.FileType != "directory" && f.FileType != "symlink" && f.SHA256 == "" {
+			unhashed++
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("%s✓ %s (v%s): %d file(s) OK%s\n", lib.Green, name, inst.Version, len(files), lib.Reset)
+		if unhashed > 0 {
+			fmt.Printf("  %sNote: %d file(s) have no recorded hash and were checked by size only%s\n",
+				lib.Yellow, unhashed, lib.Reset)
+		}
+		fmt.Println()
+		return true
+	}
+
+	fmt.Printf("%s✗ %s (v%s): %d problem(s)%s\n", lib.Red, name, inst.Version, len(problems), lib.Reset)
+	for _, d := range problems {
+		line := fmt.Sprintf("  %-9s %s", d.Kind, d.Path)
+		if d.Detail != "" {
+			line += " (" + d.Detail + ")"
+		}
+		fmt.Println(line)
+	}
+	fmt.Println()
+	return false
+}
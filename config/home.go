@@ -0,0 +1,95 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HomeEnvVar names the environment variable (and embedded config key) that
+// selects the jpm root directory
+const HomeEnvVar = "JPM_HOME"
+
+var homeOverride string
+
+// SetHome overrides the jpm root for this process, e.g. from the --home flag
+func SetHome(dir string) {
+	homeOverride = dir
+}
+
+// Home returns the jpm root directory. It is resolved from, in order, the
+// --home flag, the JPM_HOME environment variable, the JPM_HOME key of the
+// embedded config and finally ~/.jpm.
+func Home() string {
+	dir := homeOverride
+	if dir == "" {
+		dir = os.Getenv(HomeEnvVar)
+	}
+	if dir == "" {
+		dir = GetEnvVar(HomeEnvVar)
+	}
+	if dir == "" {
+		userHome, err := os.UserHomeDir()
+		if err != nil {
+			userHome = "."
+		}
+		dir = filepath.Join(userHome, ".jpm")
+	}
+
+	dir = expandUser(dir)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return dir
+}
+
+// LegacyDBPath is where jpm kept the local database before JPM_HOME,
+// relative to the directory it was run from
+const LegacyDBPath = "jpm.db"
+
+// DBPath is the local database file, <home>/db/jpm.db
+func DBPath() string {
+	return filepath.Join(Home(), "db", "jpm.db")
+}
+
+// PackagesDir is where packages are downloaded and installed, <home>/packages
+func PackagesDir() string {
+	return filepath.Join(Home(), "packages")
+}
+
+// CacheDir holds downloads and scratch space that can be deleted at any time, <home>/cache
+func CacheDir() string {
+	return filepath.Join(Home(), "cache")
+}
+
+// BackupsDir keeps copies of files replaced during installs so they can be
+// restored on failure or removal, <home>/backups
+func BackupsDir() string {
+	return filepath.Join(Home(), "backups")
+}
+
+// ShimsDir is the jpm-managed directory of package executables, <home>/shims
+func ShimsDir() string {
+	return filepath.Join(Home(), "shims")
+}
+
+// EnsureHome creates the jpm root and all of its subdirectories
+func EnsureHome() error {
+	for _, dir := range []string{filepath.Dir(DBPath()), PackagesDir(), CacheDir(), ShimsDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expandUser(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, `~\`) {
+		return path
+	}
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(userHome, path[1:])
+}
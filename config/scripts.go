@@ -0,0 +1,42 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// ScriptsEnvVar names the environment variable (and embedded config key)
+// holding the user's policy for package scripts. Set it to "false", "no",
+// "off", "0" or "deny" to forbid RUN_SCRIPT entirely.
+const ScriptsEnvVar = "JPM_ALLOW_SCRIPTS"
+
+// ScriptTimeoutEnvVar names the environment variable (and embedded config
+// key) holding the default timeout for package scripts, e.g. "90s"
+const ScriptTimeoutEnvVar = "JPM_SCRIPT_TIMEOUT"
+
+// ScriptsAllowed reports whether package scripts may run
+func ScriptsAllowed() bool {
+	switch strings.ToLower(strings.TrimSpace(lookup(ScriptsEnvVar))) {
+	case "false", "no", "off", "0", "deny":
+		return false
+	}
+	return true
+}
+
+// ScriptTimeout returns the configured script timeout, or 0 when unset or invalid
+func ScriptTimeout() time.Duration {
+	d, err := time.ParseDuration(strings.TrimSpace(lookup(ScriptTimeoutEnvVar)))
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// lookup reads a setting from the environment, falling back to the embedded config
+func lookup(key string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return GetEnvVar(key)
+}
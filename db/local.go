@@ -2,8 +2,12 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"jpm/config"
 	"jpm/model"
+	"os"
+	"path/filepath"
 	"time"
 
 	_ "github.com/tursodatabase/turso-go"
@@ -13,8 +17,11 @@ type LocalDB struct {
 	Connection *sql.DB
 }
 
+// NewLocalDB opens the local database under the jpm home directory
 func NewLocalDB() LocalDB {
-	conn, _ := sql.Open("turso", "jpm.db")
+	dbPath := config.DBPath()
+	_ = os.MkdirAll(filepath.Dir(dbPath), 0755)
+	conn, _ := sql.Open("turso", dbPath)
 	return LocalDB{
 		Connection: conn,
 	}
@@ -29,13 +36,16 @@ func (ldb *LocalDB) InitSchema() error {
 			version VARCHAR(20) NOT NULL,
 			location VARCHAR(255),
 			sys_path VARCHAR(255),
+			work_dir VARCHAR(255) DEFAULT '',
 			installed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			installed_from_url VARCHAR(255),
 			checksum_sha256 VARCHAR(64)  DEFAULT '',
 			file_size_bytes INTEGER,
 			installation_status VARCHAR(20) DEFAULT 'completed',
-			error_message TEXT DEFAULT ''
+			error_message TEXT DEFAULT '',
+			on_remove TEXT DEFAULT '',
+			instructions TEXT DEFAULT ''
 		);
 
 		CREATE INDEX IF NOT EXISTS idx_installed_name ON installed(name);
@@ -49,6 +59,9 @@ func (ldb *LocalDB) InitSchema() error {
 			file_path VARCHAR(500) NOT NULL,
 			file_type VARCHAR(20),
 			is_executable BOOLEAN DEFAULT FALSE,
+			file_mode INTEGER DEFAULT 0,
+			size_bytes INTEGER DEFAULT 0,
+			sha256 VARCHAR(64) DEFAULT '',
 			FOREIGN KEY (installed_id) REFERENCES installed(id) ON DELETE CASCADE,
 			UNIQUE(installed_id, file_path)
 		);
@@ -69,6 +82,45 @@ func (ldb *LocalDB) InitSchema() error {
 
 		CREATE INDEX IF NOT EXISTS idx_env_mods_package ON environment_modifications(installed_id);
 
+		-- Output of package scripts run during installation
+		CREATE TABLE IF NOT EXISTS installed_scripts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			installed_id INTEGER NOT NULL,
+			script VARCHAR(500) NOT NULL,
+			args TEXT DEFAULT '',
+			exit_code INTEGER DEFAULT 0,
+			stdout TEXT DEFAULT '',
+			stderr TEXT DEFAULT '',
+			duration_ms INTEGER DEFAULT 0,
+			ran_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (installed_id) REFERENCES installed(id) ON DELETE CASCADE
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_installed_scripts_package ON installed_scripts(installed_id);
+
+		-- How to reverse each change an installation made, replayed newest first
+		CREATE TABLE IF NOT EXISTS installed_undo (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			installed_id INTEGER NOT NULL,
+			seq INTEGER NOT NULL,
+			kind VARCHAR(20) NOT NULL,
+			path VARCHAR(500) DEFAULT '',
+			backup VARCHAR(500) DEFAULT '',
+			value TEXT DEFAULT '',
+			FOREIGN KEY (installed_id) REFERENCES installed(id) ON DELETE CASCADE
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_installed_undo_package ON installed_undo(installed_id);
+
+		-- Paths outside the install root a package's instructions may touch
+		CREATE TABLE IF NOT EXISTS path_grants (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			package_name VARCHAR(100) NOT NULL,
+			path VARCHAR(500) NOT NULL,
+			granted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(package_name, path)
+		);
+
 		-- Installation history
 		CREATE TABLE IF NOT EXISTS installation_history (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -85,6 +137,52 @@ func (ldb *LocalDB) InitSchema() error {
 		CREATE INDEX IF NOT EXISTS idx_history_package ON installation_history(package_name);
 		CREATE INDEX IF NOT EXISTS idx_history_performed_at ON installation_history(performed_at DESC);
 
+		-- Instructions as they ran, for an installation or a failed history entry
+		CREATE TABLE IF NOT EXISTS instruction_trace (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			installed_id INTEGER DEFAULT 0,
+			history_id INTEGER DEFAULT 0,
+			step INTEGER NOT NULL,
+			raw_line TEXT DEFAULT '',
+			args TEXT DEFAULT '',
+			status VARCHAR(10) NOT NULL,
+			error_message TEXT DEFAULT '',
+			files TEXT DEFAULT '',
+			duration_ms INTEGER DEFAULT 0,
+			ran_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_trace_installed ON instruction_trace(installed_id);
+		CREATE INDEX IF NOT EXISTS idx_trace_history ON instruction_trace(history_id);
+
+		-- Journal of running installations, used to recover from interrupted installs
+		CREATE TABLE IF NOT EXISTS install_journal (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			package_name VARCHAR(100) NOT NULL,
+			version VARCHAR(20) NOT NULL,
+			work_dir VARCHAR(255),
+			source_url VARCHAR(255),
+			status VARCHAR(20) DEFAULT 'in_progress',
+			current_step INTEGER DEFAULT 0,
+			total_steps INTEGER DEFAULT 0,
+			started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			error_message TEXT DEFAULT ''
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_journal_status ON install_journal(status);
+
+		CREATE TABLE IF NOT EXISTS install_journal_entries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			journal_id INTEGER NOT NULL,
+			entry_kind VARCHAR(20) NOT NULL,
+			entry_value TEXT NOT NULL,
+			FOREIGN KEY (journal_id) REFERENCES install_journal(id) ON DELETE CASCADE,
+			UNIQUE(journal_id, entry_kind, entry_value)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_journal_entries ON install_journal_entries(journal_id);
+
 		-- Dependencies tracking
 		CREATE TABLE IF NOT EXISTS installed_dependencies (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -118,19 +216,75 @@ func (ldb *LocalDB) InitSchema() error {
 		CREATE INDEX IF NOT EXISTS idx_metadata_expires ON metadata_cache(expires_at);
 	`
 
-	_, err := ldb.Connection.Exec(schema)
-	return err
+	if _, err := ldb.Connection.Exec(schema); err != nil {
+		return err
+	}
+
+	return ldb.migrateSchema()
+}
+
+// migrateSchema adds columns introduced after a table was first created,
+// since CREATE TABLE IF NOT EXISTS leaves existing tables untouched
+func (ldb *LocalDB) migrateSchema() error {
+	columns := []struct {
+		table, name, definition string
+	}{
+		{"installed", "work_dir", "VARCHAR(255) DEFAULT ''"},
+		{"installed", "on_remove", "TEXT DEFAULT ''"},
+		{"installed", "instructions", "TEXT DEFAULT ''"},
+		{"installed_files", "file_mode", "INTEGER DEFAULT 0"},
+		{"installed_files", "size_bytes", "INTEGER DEFAULT 0"},
+		{"installed_files", "sha256", "VARCHAR(64) DEFAULT ''"},
+	}
+
+	for _, col := range columns {
+		exists, err := ldb.hasColumn(col.table, col.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = ldb.Connection.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.name, col.definition))
+		if err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", col.table, col.name, err)
+		}
+	}
+	return nil
+}
+
+func (ldb *LocalDB) hasColumn(table, column string) (bool, error) {
+	rows, err := ldb.Connection.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
 }
 
 // Package operations
 func (ldb *LocalDB) InsertInstallation(ins *model.Installation) error {
 	result, err := ldb.Connection.Exec(`
 		INSERT INTO installed (
-			name, version, location, sys_path, installed_from_url, 
-			checksum_sha256, file_size_bytes, installation_status
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		ins.Name, ins.Version, ins.Location, ins.SysPath,
-		ins.InstalledFromURL, ins.ChecksumSHA256, ins.FileSizeBytes, ins.Status,
+			name, version, location, sys_path, work_dir, installed_from_url, 
+			checksum_sha256, file_size_bytes, installation_status, on_remove, instructions
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ins.Name, ins.Version, ins.Location, ins.SysPath, ins.WorkDir,
+		ins.InstalledFromURL, ins.ChecksumSHA256, ins.FileSizeBytes, ins.Status, ins.OnRemove, ins.Instructions,
 	)
 	if err != nil {
 		return err
@@ -155,13 +309,13 @@ func (ldb *LocalDB) UpdateInstallation(ins *model.Installation) error {
 
 	_, err = ldb.Connection.Exec(`
 		UPDATE installed 
-		SET version = ?, location = ?, sys_path = ?, updated_at = ?,
+		SET version = ?, location = ?, sys_path = ?, work_dir = ?, updated_at = ?,
 		    installed_from_url = ?, checksum_sha256 = ?, file_size_bytes = ?,
-		    installation_status = ?
+		    installation_status = ?, on_remove = ?, instructions = ?
 		WHERE name = ?`,
-		ins.Version, ins.Location, ins.SysPath, time.Now(),
+		ins.Version, ins.Location, ins.SysPath, ins.WorkDir, time.Now(),
 		ins.InstalledFromURL, ins.ChecksumSHA256, ins.FileSizeBytes,
-		ins.Status, ins.Name,
+		ins.Status, ins.OnRemove, ins.Instructions, ins.Name,
 	)
 	if err != nil {
 		return err
@@ -181,6 +335,25 @@ func (ldb *LocalDB) DeleteInstallation(name string) error {
 		return err
 	}
 
+	// Drop the manifest explicitly; foreign key cascades are not enabled on the connection
+	if existing != nil {
+		if err := ldb.DeleteInstalledFiles(existing.ID); err != nil {
+			return err
+		}
+		if err := ldb.DeleteScriptRuns(existing.ID); err != nil {
+			return err
+		}
+		if err := ldb.DeleteUndoLog(existing.ID); err != nil {
+			return err
+		}
+		if err := ldb.DeleteTrace(existing.ID); err != nil {
+			return err
+		}
+		if err := ldb.ReplaceEnvModifications(existing.ID, nil); err != nil {
+			return err
+		}
+	}
+
 	_, err = ldb.Connection.Exec("DELETE FROM installed WHERE name = ?", name)
 	if err != nil {
 		return err
@@ -195,8 +368,8 @@ func (ldb *LocalDB) DeleteInstallation(name string) error {
 
 func (ldb *LocalDB) GetByName(name string) (*model.Installation, error) {
 	stmt, err := ldb.Connection.Prepare(`
-		SELECT id, name, version, location, sys_path, installed_at, updated_at,
-		       installed_from_url, checksum_sha256, file_size_bytes, installation_status, error_message
+		SELECT id, name, version, location, sys_path, work_dir, installed_at, updated_at,
+		       installed_from_url, checksum_sha256, file_size_bytes, installation_status, error_message, on_remove, instructions
 		FROM installed 
 		WHERE name = ? 
 		LIMIT 1
@@ -208,9 +381,9 @@ func (ldb *LocalDB) GetByName(name string) (*model.Installation, error) {
 
 	var ins model.Installation
 	err = stmt.QueryRow(name).Scan(
-		&ins.ID, &ins.Name, &ins.Version, &ins.Location, &ins.SysPath,
+		&ins.ID, &ins.Name, &ins.Version, &ins.Location, &ins.SysPath, &ins.WorkDir,
 		&ins.InstalledAt, &ins.UpdatedAt, &ins.InstalledFromURL,
-		&ins.ChecksumSHA256, &ins.FileSizeBytes, &ins.Status, &ins.ErrorMessage,
+		&ins.ChecksumSHA256, &ins.FileSizeBytes, &ins.Status, &ins.ErrorMessage, &ins.OnRemove, &ins.Instructions,
 	)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -223,8 +396,8 @@ func (ldb *LocalDB) GetByName(name string) (*model.Installation, error) {
 
 func (ldb *LocalDB) GetAll() ([]model.Installation, error) {
 	rows, err := ldb.Connection.Query(`
-		SELECT id, name, version, location, sys_path, installed_at, updated_at,
-		       installed_from_url, checksum_sha256, file_size_bytes, installation_status, error_message
+		SELECT id, name, version, location, sys_path, work_dir, installed_at, updated_at,
+		       installed_from_url, checksum_sha256, file_size_bytes, installation_status, error_message, on_remove, instructions
 		FROM installed 
 		WHERE installation_status = 'completed'
 		ORDER BY name
@@ -238,9 +411,9 @@ func (ldb *LocalDB) GetAll() ([]model.Installation, error) {
 	for rows.Next() {
 		var ins model.Installation
 		err := rows.Scan(
-			&ins.ID, &ins.Name, &ins.Version, &ins.Location, &ins.SysPath,
+			&ins.ID, &ins.Name, &ins.Version, &ins.Location, &ins.SysPath, &ins.WorkDir,
 			&ins.InstalledAt, &ins.UpdatedAt, &ins.InstalledFromURL,
-			&ins.ChecksumSHA256, &ins.FileSizeBytes, &ins.Status, &ins.ErrorMessage,
+			&ins.ChecksumSHA256, &ins.FileSizeBytes, &ins.Status, &ins.ErrorMessage, &ins.OnRemove, &ins.Instructions,
 		)
 		if err != nil {
 			return nil, err
@@ -260,18 +433,36 @@ func (ldb *LocalDB) GetCount() int {
 }
 
 // File tracking
-func (ldb *LocalDB) AddInstalledFile(installedID int, filePath, fileType string, isExecutable bool) error {
+func (ldb *LocalDB) AddInstalledFile(installedID int, f *model.InstalledFile) error {
 	_, err := ldb.Connection.Exec(`
-		INSERT INTO installed_files (installed_id, file_path, file_type, is_executable)
-		VALUES (?, ?, ?, ?)`,
-		installedID, filePath, fileType, isExecutable,
+		INSERT INTO installed_files (installed_id, file_path, file_type, is_executable, file_mode, size_bytes, sha256)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		installedID, f.FilePath, f.FileType, f.IsExecutable, int64(f.Mode), f.SizeBytes, f.SHA256,
 	)
 	return err
 }
 
+// ReplaceInstalledFiles swaps the recorded manifest of an installation for a new one
+func (ldb *LocalDB) ReplaceInstalledFiles(installedID int, files []model.InstalledFile) error {
+	if err := ldb.DeleteInstalledFiles(installedID); err != nil {
+		return err
+	}
+	for i := range files {
+		if err := ldb.AddInstalledFile(installedID, &files[i]); err != nil {
+			return fmt.Errorf("failed to record %s: %w", files[i].FilePath, err)
+		}
+	}
+	return nil
+}
+
+func (ldb *LocalDB) DeleteInstalledFiles(installedID int) error {
+	_, err := ldb.Connection.Exec("DELETE FROM installed_files WHERE installed_id = ?", installedID)
+	return err
+}
+
 func (ldb *LocalDB) GetInstalledFiles(installedID int) ([]model.InstalledFile, error) {
 	rows, err := ldb.Connection.Query(`
-		SELECT id, file_path, file_type, is_executable
+		SELECT id, file_path, file_type, is_executable, file_mode, size_bytes, sha256
 		FROM installed_files
 		WHERE installed_id = ?
 		ORDER BY file_path`,
@@ -285,16 +476,112 @@ func (ldb *LocalDB) GetInstalledFiles(installedID int) ([]model.InstalledFile, e
 	var files []model.InstalledFile
 	for rows.Next() {
 		var f model.InstalledFile
-		err := rows.Scan(&f.ID, &f.FilePath, &f.FileType, &f.IsExecutable)
+		var mode int64
+		err := rows.Scan(&f.ID, &f.FilePath, &f.FileType, &f.IsExecutable, &mode, &f.SizeBytes, &f.SHA256)
 		if err != nil {
 			return nil, err
 		}
 		f.InstalledID = installedID
+		f.Mode = os.FileMode(mode)
 		files = append(files, f)
 	}
 	return files, nil
 }
 
+// GetFileOwners returns the recorded entries at path and every non-directory
+// entry below it, together with the package that owns each one
+func (ldb *LocalDB) GetFileOwners(path string) ([]model.FileOwner, error) {
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+
+	rows, err := ldb.Connection.Query(`
+		SELECT i.name, i.version, f.id, f.installed_id, f.file_path, f.file_type,
+		       f.is_executable, f.file_mode, f.size_bytes, f.sha256
+		FROM installed_files f
+		JOIN installed i ON i.id = f.installed_id
+		WHERE f.file_path = ?
+		   OR (substr(f.file_path, 1, ?) = ? AND f.file_type != 'directory')
+		ORDER BY f.file_path`,
+		path, len(prefix), prefix,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var owners []model.FileOwner
+	for rows.Next() {
+		owner, err := scanFileOwner(rows)
+		if err != nil {
+			return nil, err
+		}
+		owners = append(owners, *owner)
+	}
+	return owners, nil
+}
+
+// FindFileOwner reports which package installed path: either an exact
+// manifest entry or, failing that, the deepest recorded directory containing it
+func (ldb *LocalDB) FindFileOwner(path string) (*model.FileOwner, error) {
+	path = filepath.Clean(path)
+
+	row := ldb.Connection.QueryRow(`
+		SELECT i.name, i.version, f.id, f.installed_id, f.file_path, f.file_type,
+		       f.is_executable, f.file_mode, f.size_bytes, f.sha256
+		FROM installed_files f
+		JOIN installed i ON i.id = f.installed_id
+		WHERE f.file_path = ?
+		   OR (f.file_type = 'directory' AND substr(?, 1, length(f.file_path) + 1) = f.file_path || ?)
+		ORDER BY length(f.file_path) DESC
+		LIMIT 1`,
+		path, path, string(filepath.Separator),
+	)
+
+	owner, err := scanFileOwner(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+// DisownFiles drops other packages' claims on files that installedID has now replaced
+func (ldb *LocalDB) DisownFiles(installedID int, files []model.InstalledFile) error {
+	for _, f := range files {
+		if f.FileType == "directory" {
+			continue
+		}
+		_, err := ldb.Connection.Exec(`
+			DELETE FROM installed_files
+			WHERE file_path = ? AND installed_id != ?`,
+			f.FilePath, installedID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanFileOwner(row rowScanner) (*model.FileOwner, error) {
+	var owner model.FileOwner
+	var mode int64
+	err := row.Scan(&owner.PackageName, &owner.Version, &owner.File.ID, &owner.File.InstalledID,
+		&owner.File.FilePath, &owner.File.FileType, &owner.File.IsExecutable, &mode, &owner.File.SizeBytes,
+		&owner.File.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	owner.File.Mode = os.FileMode(mode)
+	return &owner, nil
+}
+
 // Environment modifications
 func (ldb *LocalDB) AddEnvModification(installedID int, modType, varName, varValue, originalValue string) error {
 	_, err := ldb.Connection.Exec(`
@@ -311,7 +598,7 @@ func (ldb *LocalDB) GetEnvModifications(installedID int) ([]model.EnvModificatio
 		SELECT id, modification_type, variable_name, variable_value, original_value, created_at
 		FROM environment_modifications
 		WHERE installed_id = ?
-		ORDER BY created_at`,
+		ORDER BY created_at, id`,
 		installedID,
 	)
 	if err != nil {
@@ -333,6 +620,291 @@ func (ldb *LocalDB) GetEnvModifications(installedID int) ([]model.EnvModificatio
 	return mods, nil
 }
 
+// ReplaceEnvModifications swaps the recorded environment modifications of
+// an installation, e.g. after a reinstall
+func (ldb *LocalDB) ReplaceEnvModifications(installedID int, mods []model.EnvModification) error {
+	if _, err := ldb.Connection.Exec("DELETE FROM environment_modifications WHERE installed_id = ?", installedID); err != nil {
+		return err
+	}
+	for _, mod := range mods {
+		err := ldb.AddEnvModification(installedID, mod.ModificationType,
+			mod.VariableName, mod.VariableValue, mod.OriginalValue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Script runs
+func (ldb *LocalDB) AddScriptRun(installedID int, run *model.ScriptRun) error {
+	args, err := json.Marshal(run.Args)
+	if err != nil {
+		return err
+	}
+
+	_, err = ldb.Connection.Exec(`
+		INSERT INTO installed_scripts
+		(installed_id, script, args, exit_code, stdout, stderr, duration_ms, ran_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		installedID, run.Script, string(args), run.ExitCode, run.Stdout, run.Stderr,
+		run.Duration.Milliseconds(), run.RanAt,
+	)
+	return err
+}
+
+// ReplaceScriptRuns swaps the recorded script output of an installation,
+// e.g. after a reinstall
+func (ldb *LocalDB) ReplaceScriptRuns(installedID int, runs []model.ScriptRun) error {
+	if err := ldb.DeleteScriptRuns(installedID); err != nil {
+		return err
+	}
+	for i := range runs {
+		if err := ldb.AddScriptRun(installedID, &runs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ldb *LocalDB) DeleteScriptRuns(installedID int) error {
+	_, err := ldb.Connection.Exec("DELETE FROM installed_scripts WHERE installed_id = ?", installedID)
+	return err
+}
+
+func (ldb *LocalDB) GetScriptRuns(installedID int) ([]model.ScriptRun, error) {
+	rows, err := ldb.Connection.Query(`
+		SELECT id, script, args, exit_code, stdout, stderr, duration_ms, ran_at
+		FROM installed_scripts
+		WHERE installed_id = ?
+		ORDER BY id`,
+		installedID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []model.ScriptRun
+	for rows.Next() {
+		var r model.ScriptRun
+		var args string
+		var durationMs int64
+		err := rows.Scan(&r.ID, &r.Script, &args, &r.ExitCode, &r.Stdout, &r.Stderr, &durationMs, &r.RanAt)
+		if err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal([]byte(args), &r.Args)
+		r.InstalledID = installedID
+		r.Duration = time.Duration(durationMs) * time.Millisecond
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
+
+// Instruction trace
+func (ldb *LocalDB) addTraceStep(installedID, historyID int, step *model.TraceStep) error {
+	args, err := json.Marshal(step.Args)
+	if err != nil {
+		return err
+	}
+	files, err := json.Marshal(step.Files)
+	if err != nil {
+		return err
+	}
+
+	_, err = ldb.Connection.Exec(`
+		INSERT INTO instruction_trace
+		(installed_id, history_id, step, raw_line, args, status, error_message, files, duration_ms, ran_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		installedID, historyID, step.Step, step.RawLine, string(args), step.Status, step.Error,
+		string(files), step.Duration.Milliseconds(), step.RanAt,
+	)
+	return err
+}
+
+// ReplaceTrace swaps the recorded instruction trace of an installation,
+// e.g. after a reinstall
+func (ldb *LocalDB) ReplaceTrace(installedID int, trace []model.TraceStep) error {
+	if err := ldb.DeleteTrace(installedID); err != nil {
+		return err
+	}
+	for i := range trace {
+		if err := ldb.addTraceStep(installedID, 0, &trace[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ldb *LocalDB) DeleteTrace(installedID int) error {
+	_, err := ldb.Connection.Exec("DELETE FROM instruction_trace WHERE installed_id = ?", installedID)
+	return err
+}
+
+// GetTrace returns the instructions an installation ran, in order
+func (ldb *LocalDB) GetTrace(installedID int) ([]model.TraceStep, error) {
+	return ldb.queryTrace("installed_id", installedID)
+}
+
+// GetHistoryTrace returns the instructions recorded with a history entry
+func (ldb *LocalDB) GetHistoryTrace(historyID int) ([]model.TraceStep, error) {
+	return ldb.queryTrace("history_id", historyID)
+}
+
+func (ldb *LocalDB) queryTrace(column string, id int) ([]model.TraceStep, error) {
+	rows, err := ldb.Connection.Query(fmt.Sprintf(`
+		SELECT id, step, raw_line, args, status, error_message, files, duration_ms, ran_at
+		FROM instruction_trace
+		WHERE %s = ?
+		ORDER BY id`, column),
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trace []model.TraceStep
+	for rows.Next() {
+		var s model.TraceStep
+		var args, files string
+		var durationMs int64
+		err := rows.Scan(&s.ID, &s.Step, &s.RawLine, &args, &s.Status, &s.Error, &files, &durationMs, &s.RanAt)
+		if err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal([]byte(args), &s.Args)
+		_ = json.Unmarshal([]byte(files), &s.Files)
+		s.Duration = time.Duration(durationMs) * time.Millisecond
+		trace = append(trace, s)
+	}
+	return trace, nil
+}
+
+// Path grants
+func (ldb *LocalDB) AddPathGrant(packageName, path string) error {
+	grants, err := ldb.GetPathGrants(packageName)
+	if err != nil {
+		return err
+	}
+	for _, g := range grants {
+		if g.Path == path {
+			return nil
+		}
+	}
+
+	_, err = ldb.Connection.Exec(`
+		INSERT INTO path_grants (package_name, path, granted_at)
+		VALUES (?, ?, ?)`,
+		packageName, path, time.Now(),
+	)
+	return err
+}
+
+// RemovePathGrant revokes a grant and reports whether one existed
+func (ldb *LocalDB) RemovePathGrant(packageName, path string) (bool, error) {
+	result, err := ldb.Connection.Exec(
+		"DELETE FROM path_grants WHERE package_name = ? AND path = ?",
+		packageName, path,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetPathGrants returns the grants for one package, or for every package
+// when packageName is empty
+func (ldb *LocalDB) GetPathGrants(packageName string) ([]model.PathGrant, error) {
+	query := "SELECT id, package_name, path, granted_at FROM path_grants"
+	var args []any
+	if packageName != "" {
+		query += " WHERE package_name = ?"
+		args = append(args, packageName)
+	}
+	query += " ORDER BY package_name, path"
+
+	rows, err := ldb.Connection.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []model.PathGrant
+	for rows.Next() {
+		var g model.PathGrant
+		if err := rows.Scan(&g.ID, &g.PackageName, &g.Path, &g.GrantedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, nil
+}
+
+// GrantedPaths returns just the paths granted to a package
+func (ldb *LocalDB) GrantedPaths(packageName string) ([]string, error) {
+	grants, err := ldb.GetPathGrants(packageName)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(grants))
+	for i, g := range grants {
+		paths[i] = g.Path
+	}
+	return paths, nil
+}
+
+// Undo log
+func (ldb *LocalDB) ReplaceUndoLog(installedID int, records []model.UndoRecord) error {
+	if err := ldb.DeleteUndoLog(installedID); err != nil {
+		return err
+	}
+	for i, rec := range records {
+		_, err := ldb.Connection.Exec(`
+			INSERT INTO installed_undo (installed_id, seq, kind, path, backup, value)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			installedID, i+1, rec.Kind, rec.Path, rec.Backup, rec.Value,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ldb *LocalDB) DeleteUndoLog(installedID int) error {
+	_, err := ldb.Connection.Exec("DELETE FROM installed_undo WHERE installed_id = ?", installedID)
+	return err
+}
+
+// GetUndoLog returns an installation's undo records in the order they were made
+func (ldb *LocalDB) GetUndoLog(installedID int) ([]model.UndoRecord, error) {
+	rows, err := ldb.Connection.Query(`
+		SELECT id, seq, kind, path, backup, value
+		FROM installed_undo
+		WHERE installed_id = ?
+		ORDER BY seq`,
+		installedID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []model.UndoRecord
+	for rows.Next() {
+		var r model.UndoRecord
+		if err := rows.Scan(&r.ID, &r.Seq, &r.Kind, &r.Path, &r.Backup, &r.Value); err != nil {
+			return nil, err
+		}
+		r.InstalledID = installedID
+		records = append(records, r)
+	}
+	return records, nil
+}
+
 // History
 func (ldb *LocalDB) AddHistory(packageName, version, action, prevVersion string, success bool, errorMsg string) error {
 	_, err := ldb.Connection.Exec(`
@@ -344,10 +916,35 @@ func (ldb *LocalDB) AddHistory(packageName, version, action, prevVersion string,
 	return err
 }
 
+// AddHistoryTrace records a history entry together with the instructions
+// that ran, e.g. for a failed install that left no installation behind
+func (ldb *LocalDB) AddHistoryTrace(packageName, version, action, prevVersion string, success bool, errorMsg string, trace []model.TraceStep) error {
+	result, err := ldb.Connection.Exec(`
+		INSERT INTO installation_history 
+		(package_name, version, action, previous_version, success, error_message)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		packageName, version, action, prevVersion, success, errorMsg,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for i := range trace {
+		if err := ldb.addTraceStep(0, int(id), &trace[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ldb *LocalDB) GetHistory(packageName string, limit int) ([]model.HistoryEntry, error) {
 	query := `
-		SELECT id, package_name, version, action, previous_version, 
-		       performed_at, success, error_message, user_comment
+		SELECT id, package_name, version, action, COALESCE(previous_version, ''),
+		       performed_at, success, COALESCE(error_message, ''), COALESCE(user_comment, '')
 		FROM installation_history`
 
 	if packageName != "" {
@@ -385,6 +982,160 @@ func (ldb *LocalDB) GetHistory(packageName string, limit int) ([]model.HistoryEn
 	return entries, nil
 }
 
+// Install journal
+func (ldb *LocalDB) BeginJournal(j *model.InstallJournal) error {
+	result, err := ldb.Connection.Exec(`
+		INSERT INTO install_journal (package_name, version, work_dir, source_url, status, total_steps, started_at, updated_at)
+		VALUES (?, ?, ?, ?, 'in_progress', ?, ?, ?)`,
+		j.PackageName, j.Version, j.WorkDir, j.SourceURL, j.TotalSteps, time.Now(), time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	j.ID = int(id)
+	j.Status = "in_progress"
+	return nil
+}
+
+// AddJournalPath records a path the installation created or is about to create
+func (ldb *LocalDB) AddJournalPath(journalID int, path string) error {
+	return ldb.addJournalEntry(journalID, "path", path)
+}
+
+// AddJournalPathEntry records a PATH entry the installation wrote
+func (ldb *LocalDB) AddJournalPathEntry(journalID int, entry string) error {
+	return ldb.addJournalEntry(journalID, "path_entry", entry)
+}
+
+// AddJournalEnvEntry records an environment variable change the installation made
+func (ldb *LocalDB) AddJournalEnvEntry(journalID int, entry string) error {
+	return ldb.addJournalEntry(journalID, "env", entry)
+}
+
+// AddJournalUndo records an undo record of the installation
+func (ldb *LocalDB) AddJournalUndo(journalID int, rec model.UndoRecord) error {
+	data, err := json.Marshal(journalUndo{Kind: rec.Kind, Path: rec.Path, Backup: rec.Backup, Value: rec.Value})
+	if err != nil {
+		return err
+	}
+	return ldb.addJournalEntry(journalID, "undo", string(data))
+}
+
+// journalUndo is the stored form of an undo record in a journal
+type journalUndo struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path,omitempty"`
+	Backup string `json:"backup,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+func (ldb *LocalDB) addJournalEntry(journalID int, kind, value string) error {
+	_, err := ldb.Connection.Exec(`
+		INSERT INTO install_journal_entries (journal_id, entry_kind, entry_value)
+		VALUES (?, ?, ?)`,
+		journalID, kind, value,
+	)
+	return err
+}
+
+func (ldb *LocalDB) UpdateJournalStep(journalID, step int) error {
+	_, err := ldb.Connection.Exec(`
+		UPDATE install_journal SET current_step = ?, updated_at = ? WHERE id = ?`,
+		step, time.Now(), journalID,
+	)
+	return err
+}
+
+// FinishJournal closes a journal with its final status
+func (ldb *LocalDB) FinishJournal(journalID int, status, errorMsg string) error {
+	_, err := ldb.Connection.Exec(`
+		UPDATE install_journal SET status = ?, error_message = ?, updated_at = ? WHERE id = ?`,
+		status, errorMsg, time.Now(), journalID,
+	)
+	return err
+}
+
+// GetInterruptedJournals returns installations still marked in progress.
+// While the jpm lock is held, these can only belong to processes that died.
+func (ldb *LocalDB) GetInterruptedJournals() ([]model.InstallJournal, error) {
+	rows, err := ldb.Connection.Query(`
+		SELECT id, package_name, version, work_dir, source_url, status,
+		       current_step, total_steps, started_at, updated_at, error_message
+		FROM install_journal
+		WHERE status = 'in_progress'
+		ORDER BY started_at`)
+	if err != nil {
+		return nil, err
+	}
+
+	var journals []model.InstallJournal
+	for rows.Next() {
+		var j model.InstallJournal
+		err := rows.Scan(&j.ID, &j.PackageName, &j.Version, &j.WorkDir, &j.SourceURL, &j.Status,
+			&j.CurrentStep, &j.TotalSteps, &j.StartedAt, &j.UpdatedAt, &j.ErrorMessage)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		journals = append(journals, j)
+	}
+	rows.Close()
+
+	for i := range journals {
+		if err := ldb.loadJournalEntries(&journals[i]); err != nil {
+			return nil, err
+		}
+	}
+	return journals, nil
+}
+
+func (ldb *LocalDB) loadJournalEntries(j *model.InstallJournal) error {
+	rows, err := ldb.Connection.Query(`
+		SELECT entry_kind, entry_value
+		FROM install_journal_entries
+		WHERE journal_id = ?
+		ORDER BY id`,
+		j.ID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, value string
+		if err := rows.Scan(&kind, &value); err != nil {
+			return err
+		}
+		switch kind {
+		case "path":
+			j.Paths = append(j.Paths, value)
+		case "path_entry":
+			j.PathEntries = append(j.PathEntries, value)
+		case "env":
+			j.EnvEntries = append(j.EnvEntries, value)
+		case "undo":
+			var u journalUndo
+			if err := json.Unmarshal([]byte(value), &u); err != nil {
+				return fmt.Errorf("invalid undo entry in journal %d: %w", j.ID, err)
+			}
+			j.Undo = append(j.Undo, model.UndoRecord{
+				Seq:    len(j.Undo) + 1,
+				Kind:   u.Kind,
+				Path:   u.Path,
+				Backup: u.Backup,
+				Value:  u.Value,
+			})
+		}
+	}
+	return nil
+}
+
 // Dependencies
 func (ldb *LocalDB) AddDependency(parentID int, depName, depVersion string, isAuto bool) error {
 	_, err := ldb.Connection.Exec(`
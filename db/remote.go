@@ -303,6 +303,25 @@ func (rdb *RemoteDB) GetPlatformCompatibility(releaseID int) ([]model.PlatformCo
 	return platforms, nil
 }
 
+// GetMacro fetches a named instruction macro for USE
+func (rdb *RemoteDB) GetMacro(name string) (*model.Macro, error) {
+	var m model.Macro
+	err := rdb.Connection.QueryRow(`
+		SELECT name, description, params, body
+		FROM instruction_macros
+		WHERE name = ?`,
+		name,
+	).Scan(&m.Name, &m.Description, &m.Params, &m.Body)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("macro '%s' not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
 // GetPackageTags returns tags for a package
 func (rdb *RemoteDB) GetPackageTags(packageID int) ([]string, error) {
 	rows, err := rdb.Connection.Query(`
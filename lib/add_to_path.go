@@ -2,6 +2,7 @@ package lib
 
 import (
 	"fmt"
+	"jpm/config"
 	"os"
 	"os/exec"
 	"os/user"
@@ -10,37 +11,82 @@ import (
 	"strings"
 )
 
-func getSelfPath() (string, error) {
-	exePath, err := os.Executable()
-	if err != nil {
-		return "", err
+// resolvePathEntry makes relative directories relative to the packages directory
+func resolvePathEntry(dir string) string {
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
 	}
-	dir := filepath.Dir(exePath)
-	return filepath.Join(dir, "bin"), nil
+	return filepath.Join(config.PackagesDir(), dir)
 }
 
+// AddToPath appends dir to the user's PATH and returns the entry it wrote,
+// which is what RemoveFromPath expects back
 func AddToPath(dir string) (string, error) {
-	pmPath, err := getSelfPath()
-	if err != nil {
+	fullPath := resolvePathEntry(dir)
+	if err := appendPathEntry(fullPath); err != nil {
 		return "", err
 	}
-	fullPath := filepath.Join(pmPath, dir)
+	return fullPath, nil
+}
+
+// HasPathEntry reports whether entry, as returned by AddToPath, is still
+// present in the user's PATH configuration
+func HasPathEntry(entry string) (bool, error) {
+	switch runtime.GOOS {
+	case "windows":
+		currentPath, err := getUserPath()
+		if err != nil {
+			return false, err
+		}
+		for _, p := range strings.Split(currentPath, ";") {
+			if strings.EqualFold(strings.TrimSpace(p), entry) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "linux", "darwin":
+		rcFile, err := getRCFile()
+		if err != nil {
+			return false, err
+		}
+		fileBytes, err := os.ReadFile(rcFile)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return strings.Contains(string(fileBytes), pathExportLine(entry)), nil
+
+	default:
+		return false, fmt.Errorf("unsupported OS: %s", runtime.GOOS)
+	}
+}
+
+// EnsurePathEntry re-adds an entry previously returned by AddToPath if it is
+// missing, and reports whether anything changed
+func EnsurePathEntry(entry string) (bool, error) {
+	present, err := HasPathEntry(entry)
+	if err != nil || present {
+		return false, err
+	}
+	return true, appendPathEntry(entry)
+}
 
+func appendPathEntry(entry string) error {
 	switch runtime.GOOS {
 	case "windows":
-		// Get user-only PATH (not merged with system PATH)
-		getCmd := exec.Command("powershell", `[Environment]::GetEnvironmentVariable('Path', 'User')`)
-		out, err := getCmd.Output()
+		currentPath, err := getUserPath()
 		if err != nil {
-			return "", err
+			return err
 		}
-		currentPath := strings.TrimSpace(string(out))
 
 		// Split and check for duplicates (case-insensitive)
 		paths := strings.Split(currentPath, ";")
 		for _, p := range paths {
-			if strings.EqualFold(strings.TrimSpace(p), dir) {
-				return dir, nil // Already exists
+			if strings.EqualFold(strings.TrimSpace(p), entry) {
+				return nil // Already exists
 			}
 		}
 
@@ -49,45 +95,64 @@ func AddToPath(dir string) (string, error) {
 		if currentPath != "" {
 			newPath += ";"
 		}
-		newPath += dir
+		newPath += entry
 
 		// Escape double quotes for PowerShell command
 		psCmd := fmt.Sprintf(`[Environment]::SetEnvironmentVariable('Path', "%s", 'User')`, strings.ReplaceAll(newPath, `"`, `\"`))
 		cmd := exec.Command("powershell", psCmd)
-		return dir, cmd.Run()
+		return cmd.Run()
 
 	case "linux", "darwin":
-		usr, err := user.Current()
+		rcFile, err := getRCFile()
 		if err != nil {
-			return fullPath, err
-		}
-
-		rcFile := filepath.Join(usr.HomeDir, ".bashrc")
-		if _, err := os.Stat(filepath.Join(usr.HomeDir, ".zshrc")); err == nil {
-			rcFile = filepath.Join(usr.HomeDir, ".zshrc")
+			return err
 		}
 
-		line := fmt.Sprintf("\nexport PATH=\"$PATH:%s\"\n", fullPath)
+		line := "\n" + pathExportLine(entry) + "\n"
 		f, err := os.OpenFile(rcFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 		if err != nil {
-			return fullPath, err
+			return err
 		}
 		defer f.Close()
 
 		_, err = f.WriteString(line)
-		return fullPath, err
+		return err
 
 	default:
-		return "", fmt.Errorf("unsupported OS: %s", runtime.GOOS)
+		return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
 	}
 }
 
-func RemoveFromPath(dir string) error {
-	pmPath, err := getSelfPath()
+// getUserPath returns the user-only PATH (not merged with system PATH) on Windows
+func getUserPath() (string, error) {
+	getCmd := exec.Command("powershell", `[Environment]::GetEnvironmentVariable('Path', 'User')`)
+	out, err := getCmd.Output()
 	if err != nil {
-		return err
+		return "", err
 	}
-	fullPath := filepath.Join(pmPath, dir)
+	return strings.TrimSpace(string(out)), nil
+}
+
+// getRCFile picks the shell profile jpm writes PATH changes to
+func getRCFile() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	rcFile := filepath.Join(usr.HomeDir, ".bashrc")
+	if _, err := os.Stat(filepath.Join(usr.HomeDir, ".zshrc")); err == nil {
+		rcFile = filepath.Join(usr.HomeDir, ".zshrc")
+	}
+	return rcFile, nil
+}
+
+func pathExportLine(entry string) string {
+	return fmt.Sprintf("export PATH=\"$PATH:%s\"", entry)
+}
+
+func RemoveFromPath(dir string) error {
+	fullPath := resolvePathEntry(dir)
 
 	switch runtime.GOOS {
 	case "windows":
@@ -101,14 +166,10 @@ func RemoveFromPath(dir string) error {
 		return cmd.Run()
 
 	case "linux", "darwin":
-		usr, err := user.Current()
+		rcFile, err := getRCFile()
 		if err != nil {
 			return err
 		}
-		rcFile := filepath.Join(usr.HomeDir, ".bashrc")
-		if _, err := os.Stat(filepath.Join(usr.HomeDir, ".zshrc")); err == nil {
-			rcFile = filepath.Join(usr.HomeDir, ".zshrc")
-		}
 
 		fileBytes, err := os.ReadFile(rcFile)
 		if err != nil {
@@ -43,6 +43,10 @@ func Download(rawURL string, dir string) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download of %s failed: %s", rawURL, resp.Status)
+	}
+
 	// Try to get filename from URL
 	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
@@ -0,0 +1,247 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"jpm/model"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Environment variable modification types, as stored in EnvModification
+const (
+	EnvSet     = "env_variable" // the variable is set to the value
+	EnvAppend  = "env_append"   // the value is added to the end of a list-style variable
+	EnvPrepend = "env_prepend"  // the value is added to the front of a list-style variable
+)
+
+// SetEnv persists a change to a user environment variable the same way
+// AddToPath changes PATH. The returned modification holds the value the
+// variable had before and is what RevertEnv expects back. It reports false
+// when the variable already had the value or list entry; nothing was
+// changed then, and the modification must not be reverted.
+func SetEnv(modType, name, value string) (model.EnvModification, bool, error) {
+	mod := model.EnvModification{
+		ModificationType: modType,
+		VariableName:     name,
+		VariableValue:    value,
+	}
+
+	switch runtime.GOOS {
+	case "windows":
+		current, err := getUserEnv(name)
+		if err != nil {
+			return mod, false, err
+		}
+		mod.OriginalValue = current
+
+		newValue := value
+		switch {
+		case modType == EnvSet && current == value:
+			return mod, false, nil
+		case current == "" || modType == EnvSet:
+		case slices.ContainsFunc(strings.Split(current, ";"), func(e string) bool { return strings.EqualFold(e, value) }):
+			return mod, false, nil
+		case modType == EnvAppend:
+			newValue = current + ";" + value
+		default:
+			newValue = value + ";" + current
+		}
+		return mod, true, setUserEnv(name, newValue)
+
+	case "linux", "darwin":
+		mod.OriginalValue = os.Getenv(name)
+
+		rcFile, err := getRCFile()
+		if err != nil {
+			return mod, false, err
+		}
+		line := envExportLine(mod)
+		fileBytes, err := os.ReadFile(rcFile)
+		if err != nil && !os.IsNotExist(err) {
+			return mod, false, err
+		}
+		if hasLine(string(fileBytes), line) {
+			return mod, false, nil
+		}
+		return mod, true, appendLine(rcFile, line)
+
+	default:
+		return mod, false, fmt.Errorf("unsupported OS: %s", runtime.GOOS)
+	}
+}
+
+// RevertEnv undoes a change made by SetEnv. On Linux and macOS the line
+// SetEnv wrote is removed from the shell profile, so any earlier definition
+// applies again; a variable that was set gets its original value written
+// back when the profile no longer defines it. On Windows a variable that
+// was set gets its original value back, unless it has been changed since,
+// and a list entry is removed.
+func RevertEnv(mod model.EnvModification) error {
+	name := mod.VariableName
+
+	switch runtime.GOOS {
+	case "windows":
+		current, err := getUserEnv(name)
+		if err != nil {
+			return err
+		}
+		if mod.ModificationType == EnvSet {
+			if current != mod.VariableValue {
+				return nil
+			}
+			return setUserEnv(name, mod.OriginalValue)
+		}
+
+		var kept []string
+		for _, entry := range strings.Split(current, ";") {
+			if entry != "" && !strings.EqualFold(entry, mod.VariableValue) {
+				kept = append(kept, entry)
+			}
+		}
+		return setUserEnv(name, strings.Join(kept, ";"))
+
+	case "linux", "darwin":
+		rcFile, err := getRCFile()
+		if err != nil {
+			return err
+		}
+
+		fileBytes, err := os.ReadFile(rcFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line := envExportLine(mod)
+		var newLines []string
+		for _, l := range strings.Split(string(fileBytes), "\n") {
+			if strings.TrimSpace(l) != line {
+				newLines = append(newLines, l)
+			}
+		}
+		text := strings.Join(newLines, "\n")
+		if err := os.WriteFile(rcFile, []byte(text), 0644); err != nil {
+			return err
+		}
+
+		if mod.ModificationType != EnvSet || mod.OriginalValue == "" || definesVar(text, name) {
+			return nil
+		}
+		original := mod
+		original.VariableValue = mod.OriginalValue
+		return appendLine(rcFile, envExportLine(original))
+
+	default:
+		return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
+	}
+}
+
+// envEntry is the stored form of an EnvModification
+type envEntry struct {
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Original string `json:"original,omitempty"`
+}
+
+// EncodeEnv turns a modification into a single string for undo records and
+// install journals
+func EncodeEnv(mod model.EnvModification) string {
+	data, _ := json.Marshal(envEntry{
+		Type:     mod.ModificationType,
+		Name:     mod.VariableName,
+		Value:    mod.VariableValue,
+		Original: mod.OriginalValue,
+	})
+	return string(data)
+}
+
+// DecodeEnv reads a modification written by EncodeEnv
+func DecodeEnv(s string) (model.EnvModification, error) {
+	var e envEntry
+	if err := json.Unmarshal([]byte(s), &e); err != nil {
+		return model.EnvModification{}, fmt.Errorf("invalid environment entry: %w", err)
+	}
+	return model.EnvModification{
+		ModificationType: e.Type,
+		VariableName:     e.Name,
+		VariableValue:    e.Value,
+		OriginalValue:    e.Original,
+	}, nil
+}
+
+var shellQuote = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+
+// envExportLine is the shell profile line for a modification. List entries
+// only get a separator when the variable already has a value.
+func envExportLine(mod model.EnvModification) string {
+	name, value := mod.VariableName, shellQuote.Replace(mod.VariableValue)
+	switch mod.ModificationType {
+	case EnvAppend:
+		return fmt.Sprintf(`export %s="${%s:+$%s:}%s"`, name, name, name, value)
+	case EnvPrepend:
+		return fmt.Sprintf(`export %s="%s${%s:+:$%s}"`, name, value, name, name)
+	default:
+		return fmt.Sprintf(`export %s="%s"`, name, value)
+	}
+}
+
+// definesVar reports whether a shell profile exports name
+func definesVar(text, name string) bool {
+	for _, l := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(l), "export "+name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// appendLine adds line to the end of the file at path, creating it if needed
+func appendLine(path, line string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString("\n" + line + "\n")
+	return err
+}
+
+func hasLine(text, line string) bool {
+	for _, l := range strings.Split(text, "\n") {
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
+
+// getUserEnv returns a user-scope environment variable on Windows
+func getUserEnv(name string) (string, error) {
+	out, err := exec.Command("powershell", fmt.Sprintf(`[Environment]::GetEnvironmentVariable(%s, 'User')`, psQuote(name))).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// setUserEnv sets a user-scope environment variable on Windows; an empty
+// value deletes it
+func setUserEnv(name, value string) error {
+	psValue := "$null"
+	if value != "" {
+		psValue = psQuote(value)
+	}
+	return exec.Command("powershell", fmt.Sprintf(`[Environment]::SetEnvironmentVariable(%s, %s, 'User')`, psQuote(name), psValue)).Run()
+}
+
+// psQuote makes s a single-quoted PowerShell string
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
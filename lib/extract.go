@@ -11,47 +11,53 @@ import (
 	"strings"
 )
 
-// ExtractZip extracts a zip archive to the destination directory
-func ExtractZip(src, dest string) (string, error) {
+// ExtractZip extracts a zip archive to the destination directory and
+// returns the top-level paths it created under dest
+func ExtractZip(src, dest string) ([]string, error) {
 	r, err := zip.OpenReader(src)
 	if err != nil {
-		return "", fmt.Errorf("failed to open zip: %w", err)
+		return nil, fmt.Errorf("failed to open zip: %w", err)
 	}
 	defer r.Close()
 
 	// Ensure destination exists
 	if err := os.MkdirAll(dest, 0755); err != nil {
-		return "", fmt.Errorf("failed to create destination: %w", err)
+		return nil, fmt.Errorf("failed to create destination: %w", err)
 	}
 
+	roots := newRootSet(dest)
 	for _, f := range r.File {
 		fpath := filepath.Join(dest, f.Name)
 
 		// Security check: prevent ZipSlip
 		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return "", fmt.Errorf("illegal file path in zip: %s", f.Name)
+			return nil, fmt.Errorf("illegal file path in zip: %s", f.Name)
 		}
+		if err := checkNoEscape(dest, fpath); err != nil {
+			return nil, fmt.Errorf("illegal file path in zip: %s: %w", f.Name, err)
+		}
+		roots.add(fpath)
 
 		if f.FileInfo().IsDir() {
 			if err := os.MkdirAll(fpath, f.Mode()); err != nil {
-				return "", err
+				return nil, err
 			}
 			continue
 		}
 
 		// Create parent directories
 		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
-			return "", err
+			return nil, err
 		}
 
 		// Extract file
 		if err := extractZipFile(f, fpath); err != nil {
-			return "", fmt.Errorf("failed to extract %s: %w", f.Name, err)
+			return nil, fmt.Errorf("failed to extract %s: %w", f.Name, err)
 		}
 	}
 
 	fmt.Printf("✓ Extracted: %s → %s\n", src, dest)
-	return dest, nil
+	return roots.paths, nil
 }
 
 func extractZipFile(f *zip.File, fpath string) error {
@@ -71,68 +77,76 @@ func extractZipFile(f *zip.File, fpath string) error {
 	return err
 }
 
-// ExtractTar extracts a tar archive to the destination directory
-func ExtractTar(src, dest string) (string, error) {
+// ExtractTar extracts a tar archive to the destination directory and
+// returns the top-level paths it created under dest
+func ExtractTar(src, dest string) ([]string, error) {
 	file, err := os.Open(src)
 	if err != nil {
-		return "", fmt.Errorf("failed to open tar: %w", err)
+		return nil, fmt.Errorf("failed to open tar: %w", err)
 	}
 	defer file.Close()
 
 	return extractTarReader(tar.NewReader(file), dest, src)
 }
 
-// ExtractTarGz extracts a tar.gz archive to the destination directory
-func ExtractTarGz(src, dest string) (string, error) {
+// ExtractTarGz extracts a tar.gz archive to the destination directory and
+// returns the top-level paths it created under dest
+func ExtractTarGz(src, dest string) ([]string, error) {
 	file, err := os.Open(src)
 	if err != nil {
-		return "", fmt.Errorf("failed to open tar.gz: %w", err)
+		return nil, fmt.Errorf("failed to open tar.gz: %w", err)
 	}
 	defer file.Close()
 
 	gzr, err := gzip.NewReader(file)
 	if err != nil {
-		return "", fmt.Errorf("failed to create gzip reader: %w", err)
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
 	}
 	defer gzr.Close()
 
 	return extractTarReader(tar.NewReader(gzr), dest, src)
 }
 
-func extractTarReader(tr *tar.Reader, dest, src string) (string, error) {
+func extractTarReader(tr *tar.Reader, dest, src string) ([]string, error) {
 	// Ensure destination exists
 	if err := os.MkdirAll(dest, 0755); err != nil {
-		return "", fmt.Errorf("failed to create destination: %w", err)
+		return nil, fmt.Errorf("failed to create destination: %w", err)
 	}
 
+	roots := newRootSet(dest)
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return "", fmt.Errorf("tar read error: %w", err)
+			return nil, fmt.Errorf("tar read error: %w", err)
 		}
 
 		target := filepath.Join(dest, header.Name)
 
 		// Security check: prevent path traversal
 		if !strings.HasPrefix(target, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return "", fmt.Errorf("illegal file path in tar: %s", header.Name)
+			return nil, fmt.Errorf("illegal file path in tar: %s", header.Name)
+		}
+		// Entries must not be written through a symlink placed by an earlier entry
+		if err := checkNoEscape(dest, target); err != nil {
+			return nil, fmt.Errorf("illegal file path in tar: %s: %w", header.Name, err)
 		}
+		roots.add(target)
 
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
-				return "", err
+				return nil, err
 			}
 		case tar.TypeReg:
 			if err := extractTarFile(tr, target, header); err != nil {
-				return "", fmt.Errorf("failed to extract %s: %w", header.Name, err)
+				return nil, fmt.Errorf("failed to extract %s: %w", header.Name, err)
 			}
 		case tar.TypeSymlink:
 			if err := os.Symlink(header.Linkname, target); err != nil {
-				return "", fmt.Errorf("failed to create symlink %s: %w", header.Name, err)
+				return nil, fmt.Errorf("failed to create symlink %s: %w", header.Name, err)
 			}
 		default:
 			fmt.Printf("Warning: skipping unsupported type %c for %s\n", header.Typeflag, header.Name)
@@ -140,7 +154,7 @@ func extractTarReader(tr *tar.Reader, dest, src string) (string, error) {
 	}
 
 	fmt.Printf("✓ Extracted: %s → %s\n", src, dest)
-	return dest, nil
+	return roots.paths, nil
 }
 
 func extractTarFile(tr *tar.Reader, target string, header *tar.Header) error {
@@ -158,3 +172,116 @@ func extractTarFile(tr *tar.Reader, target string, header *tar.Header) error {
 	_, err = io.Copy(outFile, tr)
 	return err
 }
+
+// checkNoEscape fails when the parent of target resolves, through symlinks,
+// to a directory outside dest
+func checkNoEscape(dest, target string) error {
+	inside, err := WithinRoot(dest, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if !inside {
+		return fmt.Errorf("resolves outside %s", dest)
+	}
+	return nil
+}
+
+// rootSet collects the distinct top-level entries an archive writes under dest
+type rootSet struct {
+	dest  string
+	seen  map[string]bool
+	paths []string
+}
+
+func newRootSet(dest string) *rootSet {
+	return &rootSet{dest: filepath.Clean(dest), seen: make(map[string]bool)}
+}
+
+func (rs *rootSet) add(target string) {
+	rel, err := filepath.Rel(rs.dest, target)
+	if err != nil || rel == "." {
+		return
+	}
+	top := filepath.Join(rs.dest, strings.Split(filepath.ToSlash(rel), "/")[0])
+	if !rs.seen[top] {
+		rs.seen[top] = true
+		rs.paths = append(rs.paths, top)
+	}
+}
+
+// ArchiveRoots lists the top-level paths an archive would create under
+// dest, without extracting it. format is "zip", "tar" or "tar.gz", as
+// returned by DetectArchiveType.
+func ArchiveRoots(src, dest, format string) ([]string, error) {
+	roots := newRootSet(dest)
+	err := walkArchive(src, format, func(name string, isDir bool) {
+		roots.add(filepath.Join(dest, name))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return roots.paths, nil
+}
+
+// ArchiveFiles lists the paths of the files and symlinks an archive would
+// write under dest, without extracting it
+func ArchiveFiles(src, dest, format string) ([]string, error) {
+	var files []string
+	err := walkArchive(src, format, func(name string, isDir bool) {
+		if !isDir {
+			files = append(files, filepath.Join(dest, name))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// walkArchive calls fn with the name of every entry in the archive
+func walkArchive(src, format string, fn func(name string, isDir bool)) error {
+	switch format {
+	case "zip":
+		r, err := zip.OpenReader(src)
+		if err != nil {
+			return fmt.Errorf("failed to open zip: %w", err)
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			fn(f.Name, f.FileInfo().IsDir())
+		}
+
+	case "tar", "tar.gz":
+		file, err := os.Open(src)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", format, err)
+		}
+		defer file.Close()
+
+		var reader io.Reader = file
+		if format == "tar.gz" {
+			gzr, err := gzip.NewReader(file)
+			if err != nil {
+				return fmt.Errorf("failed to create gzip reader: %w", err)
+			}
+			defer gzr.Close()
+			reader = gzr
+		}
+
+		tr := tar.NewReader(reader)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("tar read error: %w", err)
+			}
+			fn(header.Name, header.Typeflag == tar.TypeDir)
+		}
+
+	default:
+		return fmt.Errorf("unsupported archive format: %s", format)
+	}
+	return nil
+}
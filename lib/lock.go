@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LockedError is returned when another live jpm process holds the lock
+type LockedError struct {
+	PID   int
+	Since time.Time
+}
+
+func (e *LockedError) Error() string {
+	if e.Since.IsZero() {
+		return fmt.Sprintf("another jpm process (pid %d) is running", e.PID)
+	}
+	return fmt.Sprintf("another jpm process (pid %d) is running since %s",
+		e.PID, e.Since.Format("2006-01-02 15:04:05"))
+}
+
+// Lock is an advisory, cross-process lock backed by a file holding the owner's pid
+type Lock struct {
+	path string
+}
+
+// AcquireLock takes the lock at path, waiting up to wait for another process
+// to release it. Locks left behind by processes that no longer exist are
+// removed automatically. onWait, if set, is called once when we start waiting.
+func AcquireLock(path string, wait time.Duration, onWait func(holder *LockedError)) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	notified := false
+
+	for {
+		err := tryLock(path)
+		if err == nil {
+			return &Lock{path: path}, nil
+		}
+
+		var locked *LockedError
+		if !errors.As(err, &locked) {
+			return nil, err
+		}
+
+		if !processAlive(locked.PID) {
+			fmt.Printf("Removing stale lock left by pid %d\n", locked.PID)
+			if err := removeIfHeldBy(path, locked.PID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, locked
+		}
+		if !notified && onWait != nil {
+			onWait(locked)
+			notified = true
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// Release drops the lock if this process still holds it
+func (l *Lock) Release() error {
+	return removeIfHeldBy(l.path, os.Getpid())
+}
+
+// tryLock writes the pid to a temporary file and links it into place, so
+// the lock file never exists without its owner's pid in it
+func tryLock(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create lock file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = fmt.Fprintf(tmp, "%d\n%s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+
+	err = os.Link(tmp.Name(), path)
+	if err == nil {
+		return nil
+	}
+	if !os.IsExist(err) {
+		return fmt.Errorf("failed to create lock file: %w", err)
+	}
+
+	pid, since, err := readLock(path)
+	if os.IsNotExist(err) {
+		return tryLock(path) // released between our attempts
+	}
+	if err != nil {
+		// Not written by jpm; leave it to the user rather than guess
+		return fmt.Errorf("%w; remove it if no jpm process is running", err)
+	}
+	return &LockedError{PID: pid, Since: since}
+}
+
+func readLock(path string) (int, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	pid, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid lock file %s", path)
+	}
+
+	var since time.Time
+	if len(lines) > 1 {
+		since, _ = time.Parse(time.RFC3339, strings.TrimSpace(lines[1]))
+	}
+	return pid, since, nil
+}
+
+// removeIfHeldBy deletes the lock file only if it still names pid, so we
+// never remove a lock another process has just taken. A lock file that
+// cannot be read is never removed.
+func removeIfHeldBy(path string, pid int) error {
+	current, _, err := readLock(path)
+	if err != nil || current != pid {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove lock file: %w", err)
+	}
+	return nil
+}
+
+// processAlive reports whether a process with the given pid exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	if runtime.GOOS == "windows" {
+		// FindProcess opens a handle on Windows and fails if the process is gone
+		return true
+	}
+
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jpm.lock")
+
+	lock, err := AcquireLock(path, 0, nil)
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	_, err = AcquireLock(path, 0, nil)
+	var locked *LockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("second acquire: got %v, want LockedError", err)
+	}
+	if locked.PID != os.Getpid() {
+		t.Errorf("holder pid: got %d, want %d", locked.PID, os.Getpid())
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("lock file still present after release")
+	}
+}
+
+func TestAcquireLockStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jpm.lock")
+
+	// A pid far above any real process id stands in for a crashed holder
+	if err := os.WriteFile(path, []byte("2147483646\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := AcquireLock(path, 0, nil)
+	if err != nil {
+		t.Fatalf("acquire over stale lock: %v", err)
+	}
+	defer lock.Release()
+
+	pid, _, err := readLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != os.Getpid() {
+		t.Errorf("lock owner: got %d, want %d", pid, os.Getpid())
+	}
+}
+
+func TestAcquireLockUnreadable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jpm.lock")
+	if err := os.WriteFile(path, []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AcquireLock(path, 0, nil); err == nil {
+		t.Fatal("acquired a lock held through an unreadable file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "garbage\n" {
+		t.Errorf("unreadable lock file was changed: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"io/fs"
+	"jpm/model"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ScanTree walks root (which may be a single file) and describes every file,
+// directory and symlink beneath it, including root itself
+func ScanTree(root string) ([]model.InstalledFile, error) {
+	var entries []model.InstalledFile
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		entry := model.InstalledFile{
+			FilePath:     path,
+			FileType:     ClassifyFile(path, info.Mode()),
+			IsExecutable: info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0,
+			Mode:         info.Mode(),
+		}
+		if info.Mode().IsRegular() {
+			entry.SizeBytes = info.Size()
+			if entry.SHA256, err = HashFile(path); err != nil {
+				return err
+			}
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// ClassifyFile guesses the manifest file type from a path and its mode
+func ClassifyFile(path string, mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	}
+
+	lower := strings.ToLower(filepath.Base(path))
+	ext := filepath.Ext(lower)
+
+	switch ext {
+	case ".exe", ".bat", ".cmd", ".ps1":
+		return "binary"
+	case ".so", ".dll", ".dylib", ".a", ".lib", ".jar":
+		return "library"
+	case ".conf", ".cfg", ".ini", ".toml", ".yaml", ".yml", ".json", ".env":
+		return "config"
+	case ".md", ".txt", ".html", ".pdf", ".rst":
+		return "documentation"
+	}
+
+	if strings.Contains(lower, ".so.") {
+		return "library"
+	}
+	if strings.HasPrefix(lower, "readme") || strings.HasPrefix(lower, "license") ||
+		strings.HasPrefix(lower, "changelog") {
+		return "documentation"
+	}
+	if mode.Perm()&0111 != 0 {
+		return "binary"
+	}
+
+	return "file"
+}
+
+// BuildManifest scans every path tracked by the installation context that
+// still exists once all instructions have run, so files moved or deleted by
+// later steps are left out. Type hints recorded with AddFile take precedence
+// over ClassifyFile for the tracked path itself.
+func BuildManifest(ctx *model.InstallationContext) ([]model.InstalledFile, error) {
+	roots := make([]model.InstalledFile, 0, len(ctx.Files)+1)
+	roots = append(roots, ctx.Files...)
+	if loc := ctx.Installation.Location; loc != "" && loc != ctx.WorkDir {
+		roots = append(roots, model.InstalledFile{FilePath: loc})
+	}
+
+	byPath := make(map[string]*model.InstalledFile)
+	var paths []string
+
+	for _, root := range roots {
+		if filepath.Clean(root.FilePath) == filepath.Clean(ctx.WorkDir) {
+			continue // never claim the shared working directory itself
+		}
+		if _, err := os.Lstat(root.FilePath); os.IsNotExist(err) {
+			continue
+		}
+
+		entries, err := ScanTree(root.FilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range entries {
+			entry := entries[i]
+			if existing, ok := byPath[entry.FilePath]; ok {
+				entry = *existing
+			} else {
+				paths = append(paths, entry.FilePath)
+			}
+			if entry.FilePath == root.FilePath && root.FileType != "" && entry.FileType != "directory" {
+				entry.FileType = root.FileType
+			}
+			if entry.FilePath == root.FilePath && root.SHA256 != "" {
+				entry.SHA256 = root.SHA256 // a config keeps the hash of its packaged content
+			}
+			byPath[entry.FilePath] = &entry
+		}
+	}
+
+	sort.Strings(paths)
+	manifest := make([]model.InstalledFile, 0, len(paths))
+	for _, p := range paths {
+		manifest = append(manifest, *byPath[p])
+	}
+	return manifest, nil
+}
@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ResolvePath returns the absolute, symlink-free form of path. Components
+// that do not exist yet are appended to the resolved form of the deepest
+// existing parent, so paths about to be created can be checked too.
+func ResolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	existing, rest := abs, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, rest), nil
+}
+
+// WithinRoot reports whether path, with symlinks resolved, is root itself
+// or lies inside it
+func WithinRoot(root, path string) (bool, error) {
+	resolvedRoot, err := ResolvePath(root)
+	if err != nil {
+		return false, err
+	}
+	resolved, err := ResolvePath(path)
+	if err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// DefaultScriptTimeout bounds a package script when no timeout is configured
+const DefaultScriptTimeout = 5 * time.Minute
+
+// maxScriptOutput caps how much of each output stream is kept for the record
+const maxScriptOutput = 64 * 1024
+
+// scriptEnvAllowList names the variables passed through from jpm's own
+// environment; everything else a script sees comes from ScriptOptions.Env
+var scriptEnvAllowList = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "LANG", "LC_ALL", "TERM",
+	"TMPDIR", "TEMP", "TMP",
+	"USERPROFILE", "SYSTEMROOT", "SYSTEMDRIVE", "COMSPEC", "PATHEXT", "WINDIR",
+}
+
+// ScriptOptions describes a package script run
+type ScriptOptions struct {
+	Script  string
+	Args    []string
+	Dir     string
+	Env     map[string]string // added on top of the allow-listed environment
+	Timeout time.Duration
+}
+
+// ScriptResult is the outcome of a script run
+type ScriptResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Duration time.Duration
+	TimedOut bool
+}
+
+// RunScript executes a package script with a minimal environment and a
+// timeout. Output is shown as it is produced and also captured in the result.
+// A non-zero exit or a timeout is returned as an error together with the result.
+func RunScript(opts ScriptOptions) (*ScriptResult, error) {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultScriptTimeout
+	}
+
+	name, args := scriptCommand(opts.Script, opts.Args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = opts.Dir
+	cmd.Env = scriptEnv(opts.Env)
+	// Don't hang on children that keep the output pipes open after a kill
+	cmd.WaitDelay = 5 * time.Second
+
+	stdout := &limitedBuffer{max: maxScriptOutput}
+	stderr := &limitedBuffer{max: maxScriptOutput}
+	cmd.Stdout = io.MultiWriter(os.Stdout, stdout)
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+
+	start := time.Now()
+	err := cmd.Run()
+	result := &ScriptResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		result.TimedOut = true
+		result.ExitCode = -1
+		return result, fmt.Errorf("script %s timed out after %s", filepath.Base(opts.Script), timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+		return result, fmt.Errorf("script %s exited with code %d", filepath.Base(opts.Script), result.ExitCode)
+	}
+	if err != nil {
+		result.ExitCode = -1
+		return result, fmt.Errorf("failed to run script %s: %w", filepath.Base(opts.Script), err)
+	}
+	return result, nil
+}
+
+// scriptCommand picks the interpreter for a script from its extension
+func scriptCommand(script string, args []string) (string, []string) {
+	ext := strings.ToLower(filepath.Ext(script))
+
+	switch runtime.GOOS {
+	case "windows":
+		switch ext {
+		case ".ps1":
+			return "powershell", append([]string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", script}, args...)
+		case ".bat", ".cmd":
+			return "cmd", append([]string{"/C", script}, args...)
+		}
+	default:
+		if ext == ".sh" {
+			return "sh", append([]string{script}, args...)
+		}
+	}
+	return script, args
+}
+
+func scriptEnv(extra map[string]string) []string {
+	var env []string
+	for _, key := range scriptEnvAllowList {
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	for key, value := range extra {
+		env = append(env, key+"="+value)
+	}
+	return env
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the rest
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+			b.truncated = true
+		} else {
+			b.buf.Write(p)
+		}
+	} else if len(p) > 0 {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]\n"
+	}
+	return b.buf.String()
+}
@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"fmt"
+	"jpm/config"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ShimPath returns the path LinkBin creates for a command name. On Windows
+// it is a .cmd script named after the command without its extension.
+func ShimPath(name string) string {
+	if runtime.GOOS == "windows" {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".cmd"
+	}
+	return filepath.Join(config.ShimsDir(), name)
+}
+
+// LinkBin makes target runnable from the shims directory at shim, a path
+// returned by ShimPath, replacing whatever is there. The shims directory is
+// added to PATH the first time; it reports whether PATH changed. Windows
+// gets a script that runs target, as symlinks need extra privileges there.
+func LinkBin(target, shim string) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(shim), 0755); err != nil {
+		return false, err
+	}
+	if err := os.RemoveAll(shim); err != nil {
+		return false, err
+	}
+
+	if runtime.GOOS == "windows" {
+		script := fmt.Sprintf("@echo off\r\n\"%s\" %%*\r\n", target)
+		if err := os.WriteFile(shim, []byte(script), 0755); err != nil {
+			return false, err
+		}
+	} else if err := os.Symlink(target, shim); err != nil {
+		return false, err
+	}
+
+	return EnsurePathEntry(config.ShimsDir())
+}
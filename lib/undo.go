@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"jpm/model"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Snapshot copies src to dst exactly: directories, regular files and
+// symlinks keep their type and permissions. Used for undo backups.
+func Snapshot(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		default:
+			return snapshotFile(path, target, info.Mode().Perm())
+		}
+	})
+}
+
+func snapshotFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return os.Chmod(dst, perm)
+}
+
+// undoFuncs reverse undo records of kinds registered with RegisterUndo
+var undoFuncs = map[string]func(rec model.UndoRecord) error{}
+
+// RegisterUndo makes ReplayUndo reverse records of kind with undo. It lets
+// instruction handlers outside this package record changes the built-in
+// kinds cannot describe. Like handlers, it is meant to be called from init
+// functions.
+func RegisterUndo(kind string, undo func(rec model.UndoRecord) error) {
+	undoFuncs[kind] = undo
+}
+
+// ReplayUndo reverses the changes described by records, newest first.
+// With keepUserFiles, created directories that are not empty are left in
+// place instead of being deleted with their contents.
+func ReplayUndo(records []model.UndoRecord, keepUserFiles bool) error {
+	var errs []error
+	for i := len(records) - 1; i >= 0; i-- {
+		if err := undoRecord(records[i], keepUserFiles); err != nil {
+			errs = append(errs, fmt.Errorf("undo %s %s: %w", records[i].Kind, records[i].Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func undoRecord(rec model.UndoRecord, keepUserFiles bool) error {
+	switch rec.Kind {
+	case model.UndoCreated:
+		info, err := os.Lstat(rec.Path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if keepUserFiles && info.IsDir() {
+			if entries, err := os.ReadDir(rec.Path); err == nil && len(entries) > 0 {
+				fmt.Printf("  ! Keeping non-empty directory: %s\n", rec.Path)
+				return nil
+			}
+		}
+		return Delete(rec.Path)
+
+	case model.UndoBackup, model.UndoReplaced:
+		if _, err := os.Lstat(rec.Backup); err != nil {
+			return fmt.Errorf("backup missing: %w", err)
+		}
+		if err := os.RemoveAll(rec.Path); err != nil {
+			return err
+		}
+		if err := Snapshot(rec.Backup, rec.Path); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Restored: %s\n", rec.Path)
+		discardBackup(rec.Backup)
+		return nil
+
+	case model.UndoMoved:
+		if _, err := os.Lstat(rec.Path); err != nil {
+			return nil // nothing left to move back
+		}
+		if _, err := os.Lstat(rec.Value); err == nil {
+			return nil // the original location is occupied again
+		}
+		if err := os.MkdirAll(filepath.Dir(rec.Value), 0755); err != nil {
+			return err
+		}
+		return Move(rec.Path, rec.Value)
+
+	case model.UndoMode:
+		mode, err := strconv.ParseUint(rec.Value, 8, 32)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(rec.Path); os.IsNotExist(err) {
+			return nil
+		}
+		return os.Chmod(rec.Path, os.FileMode(mode))
+
+	case model.UndoPathEntry:
+		return RemoveFromPath(rec.Value)
+
+	case model.UndoEnv:
+		mod, err := DecodeEnv(rec.Value)
+		if err != nil {
+			return err
+		}
+		return RevertEnv(mod)
+	}
+	if undo, ok := undoFuncs[rec.Kind]; ok {
+		return undo(rec)
+	}
+	return fmt.Errorf("unknown undo record kind %q", rec.Kind)
+}
+
+// DiscardBackups deletes the backup copies held by records, e.g. once a
+// reinstall has succeeded and the replaced files are no longer needed
+func DiscardBackups(records []model.UndoRecord) {
+	for _, rec := range records {
+		if rec.Backup != "" {
+			discardBackup(rec.Backup)
+		}
+	}
+}
+
+// discardBackup removes a backup and its per-install directory once empty
+func discardBackup(backup string) {
+	_ = os.RemoveAll(backup)
+	_ = os.Remove(filepath.Dir(backup))
+}
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"jpm/model"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Drift kinds reported by VerifyManifest
+const (
+	DriftMissing  = "missing"
+	DriftModified = "modified"
+	DriftExtra    = "extra"
+)
+
+// FileDrift describes one difference between a recorded manifest and the disk
+type FileDrift struct {
+	Path   string
+	Kind   string
+	Detail string
+}
+
+// HashFile returns the hex-encoded SHA-256 of a file's contents
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to calculate checksum: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// VerifyManifest compares recorded files against the disk and reports files
+// that are missing, no longer match their recorded type, mode, size or hash,
+// or were added inside a recorded directory. Configuration files declared
+// with CONFIG are only checked for their type.
+func VerifyManifest(files []model.InstalledFile) ([]FileDrift, error) {
+	var drift []FileDrift
+	recorded := make(map[string]string, len(files))
+	for _, f := range files {
+		recorded[filepath.Clean(f.FilePath)] = f.FileType
+	}
+
+	for _, f := range files {
+		info, err := os.Lstat(f.FilePath)
+		if os.IsNotExist(err) {
+			drift = append(drift, FileDrift{Path: f.FilePath, Kind: DriftMissing})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if detail := compareEntry(f, info); detail != "" {
+			drift = append(drift, FileDrift{Path: f.FilePath, Kind: DriftModified, Detail: detail})
+			continue
+		}
+
+		if info.IsDir() {
+			extras, err := findExtras(f.FilePath, recorded)
+			if err != nil {
+				return nil, err
+			}
+			drift = append(drift, extras...)
+		}
+	}
+
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Path < drift[j].Path })
+	return drift, nil
+}
+
+// ConfigModified reports whether a configuration file declared with CONFIG
+// was edited since jpm installed it
+func ConfigModified(f model.InstalledFile) bool {
+	if f.FileType != "user_config" || f.SHA256 == "" {
+		return false
+	}
+	sum, err := HashFile(f.FilePath)
+	return err == nil && sum != f.SHA256
+}
+
+func compareEntry(f model.InstalledFile, info os.FileInfo) string {
+	if f.Mode != 0 && f.Mode.Type() != info.Mode().Type() {
+		return fmt.Sprintf("type changed from %s to %s", describeType(f.Mode), describeType(info.Mode()))
+	}
+	if f.FileType == "user_config" {
+		return "" // users are expected to edit configuration
+	}
+	if f.Mode != 0 && f.Mode.Perm() != info.Mode().Perm() {
+		return fmt.Sprintf("mode changed from %s to %s", f.Mode.Perm(), info.Mode().Perm())
+	}
+	if !info.Mode().IsRegular() {
+		return ""
+	}
+	if info.Size() != f.SizeBytes {
+		return fmt.Sprintf("size changed from %d to %d bytes", f.SizeBytes, info.Size())
+	}
+	if f.SHA256 == "" {
+		return "" // recorded before hashes were stored
+	}
+
+	sum, err := HashFile(f.FilePath)
+	if err != nil {
+		return err.Error()
+	}
+	if sum != f.SHA256 {
+		return "content hash mismatch"
+	}
+	return ""
+}
+
+// findExtras lists entries inside a recorded directory that are not in the
+// manifest. Unrecorded subdirectories are reported once, recorded ones are
+// left to their own check.
+func findExtras(dir string, recorded map[string]string) ([]FileDrift, error) {
+	var extras []FileDrift
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		if _, ok := recorded[path]; ok {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if base, ok := strings.CutSuffix(path, ".jpmnew"); ok && recorded[base] == "user_config" {
+			return nil // a new config version left next to the user's
+		}
+		extras = append(extras, FileDrift{Path: path, Kind: DriftExtra})
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return extras, err
+}
+
+func describeType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsRegular():
+		return "file"
+	default:
+		return mode.Type().String()
+	}
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyManifest(t *testing.T) {
+	root := t.TempDir()
+	pkgDir := filepath.Join(root, "tool")
+	if err := os.MkdirAll(filepath.Join(pkgDir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(pkgDir, "bin", "tool")
+	readme := filepath.Join(pkgDir, "README.md")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\necho tool\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(readme, []byte("docs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := ScanTree(pkgDir)
+	if err != nil {
+		t.Fatalf("ScanTree: %v", err)
+	}
+	if len(manifest) != 4 {
+		t.Fatalf("got %d manifest entries, want 4", len(manifest))
+	}
+
+	drift, err := VerifyManifest(manifest)
+	if err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+	if len(drift) != 0 {
+		t.Fatalf("expected clean tree, got %+v", drift)
+	}
+
+	// Tamper with the binary (same size), remove the readme, add a stray file
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\necho evil\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(readme); err != nil {
+		t.Fatal(err)
+	}
+	extra := filepath.Join(pkgDir, "bin", "backdoor")
+	if err := os.WriteFile(extra, []byte("x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err = VerifyManifest(manifest)
+	if err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+
+	want := map[string]string{
+		binary: DriftModified,
+		readme: DriftMissing,
+		extra:  DriftExtra,
+	}
+	if len(drift) != len(want) {
+		t.Fatalf("got %d drift entries, want %d: %+v", len(drift), len(want), drift)
+	}
+	for _, d := range drift {
+		if want[d.Path] != d.Kind {
+			t.Errorf("%s: got %s, want %s", d.Path, d.Kind, want[d.Path])
+		}
+	}
+}
+
+func TestVerifyManifestConfig(t *testing.T) {
+	pkgDir := t.TempDir()
+	settings := filepath.Join(pkgDir, "settings.json")
+	userConf := filepath.Join(pkgDir, "app.conf")
+	if err := os.WriteFile(settings, []byte(`{"safe":true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(userConf, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := ScanTree(pkgDir)
+	if err != nil {
+		t.Fatalf("ScanTree: %v", err)
+	}
+	for i := range manifest {
+		if manifest[i].FilePath == userConf {
+			manifest[i].FileType = "user_config" // as recorded by CONFIG
+		}
+	}
+
+	// An extracted settings.json is classified as config but is still the
+	// package's own file, unlike one declared with CONFIG
+	if err := os.WriteFile(settings, []byte(`{"safe":0xx}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(userConf, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err := VerifyManifest(manifest)
+	if err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+	if len(drift) != 1 || drift[0].Path != settings || drift[0].Kind != DriftModified {
+		t.Fatalf("got %+v, want only %s modified", drift, settings)
+	}
+
+	for _, f := range manifest {
+		if f.FilePath == settings && ConfigModified(f) {
+			t.Errorf("extracted config treated as a user edit")
+		}
+	}
+}
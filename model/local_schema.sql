@@ -5,13 +5,16 @@ CREATE TABLE installed (
     version VARCHAR(20) NOT NULL,
     location VARCHAR(255),
     sys_path VARCHAR(255),
+    work_dir VARCHAR(255) DEFAULT '', -- where the instructions ran, used by 'jpm repair'
     installed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     installed_from_url VARCHAR(255), -- track where it was downloaded from
     checksum_sha256 VARCHAR(64) DEFAULT '', -- verify integrity
     file_size_bytes INTEGER,
     installation_status VARCHAR(20) DEFAULT 'completed', -- 'pending', 'in_progress', 'completed', 'failed'
-    error_message TEXT DEFAULT '' -- store error if installation failed
+    error_message TEXT DEFAULT '', -- store error if installation failed
+    on_remove TEXT DEFAULT '', -- ON_REMOVE steps from the release, run before removal
+    instructions TEXT DEFAULT '' -- instructions as installed, with macros resolved at install time
 );
 
 CREATE INDEX idx_installed_name ON installed(name);
@@ -23,8 +26,11 @@ CREATE TABLE installed_files (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     installed_id INTEGER NOT NULL,
     file_path VARCHAR(500) NOT NULL,
-    file_type VARCHAR(20), -- 'binary', 'library', 'config', 'documentation'
+    file_type VARCHAR(20), -- 'binary', 'library', 'config', 'user_config', 'documentation'
     is_executable BOOLEAN DEFAULT FALSE,
+    file_mode INTEGER DEFAULT 0, -- permission bits as installed
+    size_bytes INTEGER DEFAULT 0,
+    sha256 VARCHAR(64) DEFAULT '', -- checked by 'jpm verify'
     FOREIGN KEY (installed_id) REFERENCES installed(id) ON DELETE CASCADE,
     UNIQUE(installed_id, file_path)
 );
@@ -45,6 +51,45 @@ CREATE TABLE environment_modifications (
 
 CREATE INDEX idx_env_mods_package ON environment_modifications(installed_id);
 
+-- Installed scripts table: output of package scripts run during installation
+CREATE TABLE installed_scripts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    installed_id INTEGER NOT NULL,
+    script VARCHAR(500) NOT NULL,
+    args TEXT DEFAULT '',
+    exit_code INTEGER DEFAULT 0,
+    stdout TEXT DEFAULT '', -- truncated
+    stderr TEXT DEFAULT '', -- truncated
+    duration_ms INTEGER DEFAULT 0,
+    ran_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (installed_id) REFERENCES installed(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_installed_scripts_package ON installed_scripts(installed_id);
+
+-- Undo log: how to reverse each change an installation made, replayed newest first
+CREATE TABLE installed_undo (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    installed_id INTEGER NOT NULL,
+    seq INTEGER NOT NULL,
+    kind VARCHAR(20) NOT NULL, -- 'created', 'backup', 'replaced', 'moved', 'mode', 'path_entry', 'env', 'handler:<COMMAND>'
+    path VARCHAR(500) DEFAULT '',
+    backup VARCHAR(500) DEFAULT '', -- copy of the original file
+    value TEXT DEFAULT '',
+    FOREIGN KEY (installed_id) REFERENCES installed(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_installed_undo_package ON installed_undo(installed_id);
+
+-- Path grants: paths outside the install root a package's instructions may touch
+CREATE TABLE path_grants (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    package_name VARCHAR(100) NOT NULL,
+    path VARCHAR(500) NOT NULL,
+    granted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(package_name, path)
+);
+
 -- Installation history: keep audit trail
 CREATE TABLE installation_history (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -61,6 +106,53 @@ CREATE TABLE installation_history (
 CREATE INDEX idx_history_package ON installation_history(package_name);
 CREATE INDEX idx_history_performed_at ON installation_history(performed_at DESC);
 
+-- Instruction trace: each step as it ran, for an installation or a failed history entry
+CREATE TABLE instruction_trace (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    installed_id INTEGER DEFAULT 0, -- 0 when the trace belongs to a history entry
+    history_id INTEGER DEFAULT 0,
+    step INTEGER NOT NULL,
+    raw_line TEXT DEFAULT '',
+    args TEXT DEFAULT '', -- arguments after variable expansion
+    status VARCHAR(10) NOT NULL, -- 'success', 'failed', 'skipped'
+    error_message TEXT DEFAULT '',
+    files TEXT DEFAULT '', -- paths the step touched
+    duration_ms INTEGER DEFAULT 0,
+    ran_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_trace_installed ON instruction_trace(installed_id);
+CREATE INDEX idx_trace_history ON instruction_trace(history_id);
+
+-- Install journal: written before an install touches the filesystem, so
+-- 'jpm doctor' can undo installations that were interrupted
+CREATE TABLE install_journal (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    package_name VARCHAR(100) NOT NULL,
+    version VARCHAR(20) NOT NULL,
+    work_dir VARCHAR(255),
+    source_url VARCHAR(255),
+    status VARCHAR(20) DEFAULT 'in_progress', -- 'in_progress', 'completed', 'failed', 'rolled_back'
+    current_step INTEGER DEFAULT 0,
+    total_steps INTEGER DEFAULT 0,
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    error_message TEXT DEFAULT ''
+);
+
+CREATE INDEX idx_journal_status ON install_journal(status);
+
+CREATE TABLE install_journal_entries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    journal_id INTEGER NOT NULL,
+    entry_kind VARCHAR(20) NOT NULL, -- 'path', 'path_entry', 'env', 'undo'
+    entry_value TEXT NOT NULL,
+    FOREIGN KEY (journal_id) REFERENCES install_journal(id) ON DELETE CASCADE,
+    UNIQUE(journal_id, entry_kind, entry_value)
+);
+
+CREATE INDEX idx_journal_entries ON install_journal_entries(journal_id);
+
 -- Package dependencies (local tracking): what's installed with what
 CREATE TABLE installed_dependencies (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
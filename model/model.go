@@ -2,6 +2,9 @@ package model
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -12,6 +15,7 @@ type Installation struct {
 	Version          string
 	Location         string
 	SysPath          string
+	WorkDir          string // working directory the instructions ran in
 	InstalledAt      time.Time
 	UpdatedAt        time.Time
 	InstalledFromURL string
@@ -19,6 +23,8 @@ type Installation struct {
 	FileSizeBytes    int64
 	Status           string // 'pending', 'in_progress', 'completed', 'failed'
 	ErrorMessage     string
+	OnRemove         string // ON_REMOVE section of the release instructions, run before removal
+	Instructions     string // the instructions as run, with USE macros expanded
 }
 
 // InstalledFile represents a file installed by a package
@@ -26,15 +32,25 @@ type InstalledFile struct {
 	ID           int
 	InstalledID  int
 	FilePath     string
-	FileType     string // 'binary', 'library', 'config', 'documentation'
+	FileType     string // 'binary', 'library', 'config', 'user_config', 'documentation', 'directory', 'symlink', 'file'
 	IsExecutable bool
+	Mode         os.FileMode
+	SizeBytes    int64
+	SHA256       string // empty for directories and symlinks
+}
+
+// FileOwner links an installed file to the package that placed it
+type FileOwner struct {
+	PackageName string
+	Version     string
+	File        InstalledFile
 }
 
 // EnvModification represents an environment modification
 type EnvModification struct {
 	ID               int
 	InstalledID      int
-	ModificationType string // 'path_addition', 'env_variable'
+	ModificationType string // 'path_addition', 'env_variable', 'env_append', 'env_prepend'
 	VariableName     string
 	VariableValue    string
 	OriginalValue    string
@@ -46,7 +62,7 @@ type HistoryEntry struct {
 	ID              int
 	PackageName     string
 	Version         string
-	Action          string // 'install', 'update', 'remove', 'rollback'
+	Action          string // 'install', 'update', 'remove', 'rollback', 'repair'
 	PreviousVersion string
 	PerformedAt     time.Time
 	Success         bool
@@ -54,6 +70,91 @@ type HistoryEntry struct {
 	UserComment     string
 }
 
+// InstallJournal tracks an installation while it runs, so one interrupted by
+// a crash can be found and undone on a later run
+type InstallJournal struct {
+	ID           int
+	PackageName  string
+	Version      string
+	WorkDir      string
+	SourceURL    string
+	Status       string // 'in_progress', 'completed', 'failed', 'rolled_back'
+	CurrentStep  int
+	TotalSteps   int
+	StartedAt    time.Time
+	UpdatedAt    time.Time
+	ErrorMessage string
+	Paths        []string     // files and directories the installation created or was about to create
+	PathEntries  []string     // PATH entries written by the installation
+	EnvEntries   []string     // environment variable changes made by the installation, see lib.EncodeEnv
+	Undo         []UndoRecord // undo records of the installation, oldest first
+}
+
+// ScriptRun records one execution of a package script
+type ScriptRun struct {
+	ID          int
+	InstalledID int
+	Script      string
+	Args        []string
+	ExitCode    int
+	Stdout      string
+	Stderr      string
+	Duration    time.Duration
+	RanAt       time.Time
+}
+
+// Trace step outcomes
+const (
+	TraceSuccess = "success"
+	TraceFailed  = "failed"
+	TraceSkipped = "skipped" // guarded for another platform
+)
+
+// TraceStep records one instruction as it ran
+type TraceStep struct {
+	ID       int
+	Step     int
+	RawLine  string
+	Args     []string // arguments with ${VAR} references expanded
+	Status   string
+	Error    string
+	Files    []string // paths the step added to the installation's files
+	Duration time.Duration
+	RanAt    time.Time
+}
+
+// PathGrant allows one package's instructions to touch a path outside its
+// install root
+type PathGrant struct {
+	ID          int
+	PackageName string
+	Path        string
+	GrantedAt   time.Time
+}
+
+// Undo record kinds
+const (
+	UndoCreated   = "created"    // path did not exist before; delete it
+	UndoBackup    = "backup"     // path was overwritten or deleted; restore it from Backup
+	UndoReplaced  = "replaced"   // like backup, for the package's own files during a reinstall; only undone if the install fails
+	UndoMoved     = "moved"      // path was moved from Value; move it back
+	UndoMode      = "mode"       // path's permissions changed; Value holds the old mode in octal
+	UndoPathEntry = "path_entry" // Value was added to PATH; remove it
+	UndoEnv       = "env"        // an environment variable was changed as Value describes, see lib.EncodeEnv; revert it
+)
+
+// UndoRecord describes how to reverse one change made by an instruction.
+// Records are replayed newest first.
+type UndoRecord struct {
+	ID          int
+	InstalledID int
+	Seq         int
+	Kind        string
+	Path        string
+	Backup      string
+	Value       string
+}
+
 // Dependency represents a package dependency
 type Dependency struct {
 	ID                int
@@ -101,6 +202,15 @@ type Release struct {
 	ReleasedAt     time.Time
 }
 
+// Macro is a named instruction snippet from the registry, used in
+// instructions as USE <name> key=value...
+type Macro struct {
+	Name        string
+	Description string
+	Params      string // space-separated parameter names, each optionally name=default
+	Body        string // instruction text; ${name} stands for a parameter's value
+}
+
 // PackageSummary is a lightweight package representation
 type PackageSummary struct {
 	ID            int
@@ -182,8 +292,49 @@ type InstallationContext struct {
 	Installation  *Installation
 	WorkDir       string
 	ExtractedPath string
-	Files         []string
+	Files         []InstalledFile // paths created by the instructions; scanned into the manifest on completion
 	EnvMods       []EnvModification
+	Scripts       []ScriptRun
+	Undo          []UndoRecord
+	Trace         []TraceStep
+
+	// BackupDir receives copies of files an instruction overwrites or
+	// deletes. When empty, no backups are made.
+	BackupDir string
+
+	// OnUndo, if set, receives each undo record as it is made, before the
+	// change it reverses, so an interrupted install can still be undone
+	OnUndo func(rec UndoRecord)
+
+	// OwnersOf reports other packages' recorded files at or below a path.
+	// When nil, ownership conflicts are not checked.
+	OwnersOf       func(path string) ([]FileOwner, error)
+	AllowOverwrite bool
+
+	// Installed looks up another installed package for TEMPLATE; nil
+	// when other packages cannot be looked up
+	Installed func(name string) (*Installation, error)
+
+	// Staging runs instructions into a scratch copy of the work directory
+	// without touching shared state such as the user's PATH. TargetWorkDir
+	// is the work directory the staged files are restored into, so rendered
+	// files refer to it rather than to the scratch copy.
+	Staging       bool
+	TargetWorkDir string
+
+	// Links collects the LINK_BIN shims a staged run would create, mapping
+	// each shim path to its target under TargetWorkDir, for the caller to
+	// restore
+	Links map[string]string
+
+	// ForbidScripts makes RUN_SCRIPT fail instead of executing anything.
+	// ScriptTimeout bounds each script; zero means the library default.
+	ForbidScripts bool
+	ScriptTimeout time.Duration
+
+	// AllowedPaths lists paths outside the work directory that the user
+	// granted this package; every other path must stay inside WorkDir
+	AllowedPaths []string
 }
 
 func NewInstallationContext(name, version, workDir string) *InstallationContext {
@@ -191,16 +342,134 @@ func NewInstallationContext(name, version, workDir string) *InstallationContext
 		Installation: &Installation{
 			Name:    name,
 			Version: version,
+			WorkDir: workDir,
 			Status:  "pending",
 		},
 		WorkDir: workDir,
-		Files:   make([]string, 0),
+		Files:   make([]InstalledFile, 0),
 		EnvMods: make([]EnvModification, 0),
 	}
 }
 
+// AddFile tracks a path created or changed by an instruction. A path already
+// tracked keeps a 'user_config' type, which only AddConfig sets.
 func (ctx *InstallationContext) AddFile(path, fileType string, isExec bool) {
-	ctx.Files = append(ctx.Files, path)
+	for i := range ctx.Files {
+		if ctx.Files[i].FilePath == path {
+			if ctx.Files[i].FileType != "user_config" || fileType == "user_config" {
+				ctx.Files[i].FileType = fileType
+			}
+			ctx.Files[i].IsExecutable = ctx.Files[i].IsExecutable || isExec
+			return
+		}
+	}
+	ctx.Files = append(ctx.Files, InstalledFile{
+		FilePath:     path,
+		FileType:     fileType,
+		IsExecutable: isExec,
+	})
+}
+
+// AddConfig tracks a configuration file declared with CONFIG. Such files
+// get the 'user_config' type, which alone exempts them from verification
+// and lets removal keep them once edited. sha256 is the content the package
+// shipped; it is recorded even when the user's version is kept, so later
+// installs and removal can tell whether the file was edited.
+func (ctx *InstallationContext) AddConfig(path, sha256 string) {
+	ctx.AddFile(path, "user_config", false)
+	for i := range ctx.Files {
+		if ctx.Files[i].FilePath == path {
+			ctx.Files[i].SHA256 = sha256
+		}
+	}
+}
+
+// CheckConflict fails if path, or anything below it, belongs to another
+// installed package, unless the context allows overwriting
+func (ctx *InstallationContext) CheckConflict(path string) error {
+	if ctx.OwnersOf == nil || ctx.AllowOverwrite {
+		return nil
+	}
+
+	owners, err := ctx.OwnersOf(path)
+	if err != nil {
+		return fmt.Errorf("failed to check ownership of %s: %w", path, err)
+	}
+
+	for _, owner := range owners {
+		if owner.PackageName == ctx.Installation.Name {
+			continue
+		}
+		return fmt.Errorf("%s is owned by package '%s' (use --overwrite to replace it)",
+			owner.File.FilePath, owner.PackageName)
+	}
+	return nil
+}
+
+// RecordUndo appends an undo record for a change about to be made
+func (ctx *InstallationContext) RecordUndo(kind, path, backup, value string) {
+	rec := UndoRecord{
+		Seq:    len(ctx.Undo) + 1,
+		Kind:   kind,
+		Path:   path,
+		Backup: backup,
+		Value:  value,
+	}
+	ctx.Undo = append(ctx.Undo, rec)
+	if ctx.OnUndo != nil {
+		ctx.OnUndo(rec)
+	}
+}
+
+// CreatedHere reports whether path is, or lies inside, a path this
+// installation created. Undoing the creation already covers it.
+func (ctx *InstallationContext) CreatedHere(path string) bool {
+	for _, rec := range ctx.Undo {
+		if rec.Kind != UndoCreated {
+			continue
+		}
+		rel, err := filepath.Rel(rec.Path, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordedFile returns the manifest entry for path recorded by this same
+// package's previous install, or nil
+func (ctx *InstallationContext) RecordedFile(path string) *InstalledFile {
+	if ctx.OwnersOf == nil {
+		return nil
+	}
+	owners, err := ctx.OwnersOf(path)
+	if err != nil {
+		return nil
+	}
+	for _, owner := range owners {
+		if owner.PackageName == ctx.Installation.Name && filepath.Clean(owner.File.FilePath) == filepath.Clean(path) {
+			return &owner.File
+		}
+	}
+	return nil
+}
+
+// OwnedBySelf reports whether path holds files recorded for this same
+// package, i.e. it is being replaced by a reinstall
+func (ctx *InstallationContext) OwnedBySelf(path string) bool {
+	if ctx.OwnersOf == nil {
+		return false
+	}
+	owners, err := ctx.OwnersOf(path)
+	if err != nil {
+		return false
+	}
+	for _, owner := range owners {
+		if owner.PackageName == ctx.Installation.Name {
+			return true
+		}
+	}
+	return false
 }
 
 func (ctx *InstallationContext) AddEnvMod(modType, varName, varValue, original string) {
@@ -72,6 +72,17 @@ CREATE TABLE package_tags (
 CREATE INDEX idx_tags_package ON package_tags(package_id);
 CREATE INDEX idx_tags_tag ON package_tags(tag);
 
+-- Named instruction snippets that release instructions pull in with USE
+CREATE TABLE instruction_macros (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(100) UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    params TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
 -- View for easy latest version queries, corrected for SQLite INSTR usage
 CREATE VIEW latest_releases AS
 SELECT 
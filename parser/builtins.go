@@ -0,0 +1,565 @@
+package parser
+
+import (
+	"fmt"
+	"jpm/config"
+	"jpm/lib"
+	"jpm/model"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// handlers maps each command to its implementation; Register adds to it
+var handlers = map[Token]Handler{
+	DOWNLOAD: FuncHandler{
+		Args: []Param{
+			{Name: "url"},
+			{Name: "dest", Kind: ParamPath, Optional: true, Creates: true},
+			{Name: "sha256", Prefix: "sha256="},
+		},
+		Check: checkDownload,
+		Exec:  runDownload,
+	},
+	EXTRACT:        extractHandler("zip"),
+	EXTRACT_TAR:    extractHandler("tar"),
+	EXTRACT_TAR_GZ: extractHandler("tar.gz"),
+	MOVE:           FuncHandler{Args: moveParams(ParamPathNotRoot), Exec: runMove},
+	COPY:           FuncHandler{Args: moveParams(ParamPath), Exec: runCopy},
+	RENAME:         FuncHandler{Args: moveParams(ParamPathNotRoot), Exec: runMove},
+	DELETE:         FuncHandler{Args: []Param{{Name: "path", Kind: ParamPathNotRoot}}, Exec: runDelete},
+	CHMOD:          FuncHandler{Args: []Param{{Name: "path", Kind: ParamPath}}, Exec: runChmod},
+	ADD_TO_PATH:    FuncHandler{Args: []Param{{Name: "path", Kind: ParamPathOrAbs}}, Exec: runAddToPath},
+	SET_LOCATION:   FuncHandler{Args: []Param{{Name: "path", Kind: ParamPathNotRoot}}, Exec: runSetLocation},
+	RUN_SCRIPT: FuncHandler{
+		Args: []Param{
+			{Name: "script", Kind: ParamPath},
+			{Name: "args", Optional: true, Variadic: true},
+		},
+		Exec: runScript,
+	},
+	SET_ENV:     envHandler(lib.EnvSet),
+	APPEND_ENV:  envHandler(lib.EnvAppend),
+	PREPEND_ENV: envHandler(lib.EnvPrepend),
+	LINK_BIN: FuncHandler{
+		Args: []Param{
+			{Name: "path", Kind: ParamPath},
+			{Name: "name", Optional: true},
+		},
+		Check: checkLinkBin,
+		Exec:  runLinkBin,
+	},
+	CONFIG:   FuncHandler{Args: moveParams(ParamPath), Exec: runConfig},
+	TEMPLATE: FuncHandler{Args: moveParams(ParamPath), Exec: runTemplate},
+	USE: FuncHandler{
+		Args:  []Param{{Name: "name"}, {Name: "args", Optional: true, Variadic: true}},
+		Check: checkUse,
+		Exec:  runUse,
+	},
+}
+
+func moveParams(source ParamKind) []Param {
+	return []Param{
+		{Name: "source", Kind: source},
+		{Name: "dest", Kind: ParamPathNotRoot, Creates: true},
+	}
+}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+func checkDownload(args []string) error {
+	rawURL, _, sum := downloadArgs(args)
+	if !strings.HasPrefix(rawURL, "https://") && !strings.HasPrefix(rawURL, "http://") {
+		return &argError{index: 0, err: fmt.Errorf("DOWNLOAD url must start with http:// or https://")}
+	}
+	if !sha256Pattern.MatchString(sum) {
+		return fmt.Errorf("DOWNLOAD requires a checksum argument sha256=<64 hex digits>")
+	}
+	return nil
+}
+
+// downloadArgs splits DOWNLOAD arguments into url, optional destination and checksum
+func downloadArgs(args []string) (rawURL, dest, sum string) {
+	if len(args) == 0 {
+		return "", "", ""
+	}
+	for _, arg := range args[1:] {
+		if value, ok := strings.CutPrefix(arg, "sha256="); ok {
+			sum = value
+		} else {
+			dest = arg
+		}
+	}
+	return args[0], dest, sum
+}
+
+func (inc *Instruction) downloadArgs() (rawURL, dest, sum string) {
+	return downloadArgs(inc.Args)
+}
+
+// extractHandler unpacks an archive of the given lib.DetectArchiveType format
+func extractHandler(format string) Handler {
+	return FuncHandler{
+		Args: []Param{
+			{Name: "source", Kind: ParamPathNotRoot},
+			{Name: "dest", Kind: ParamPath, Optional: true, Creates: true},
+		},
+		Exec: func(ctx *model.InstallationContext, workDir string, args []string) error {
+			return runExtract(ctx, workDir, args, format)
+		},
+	}
+}
+
+func runExtract(ctx *model.InstallationContext, workDir string, args []string, format string) error {
+	source := filepath.Join(workDir, args[0])
+	dest := workDir
+	if len(args) > 1 {
+		dest = filepath.Join(workDir, args[1])
+	}
+
+	if err := checkExtractConflicts(ctx, source, dest, format); err != nil {
+		return err
+	}
+	if err := recordExtract(ctx, workDir, source, dest, format); err != nil {
+		return err
+	}
+
+	var roots []string
+	var err error
+	switch format {
+	case "zip":
+		roots, err = lib.ExtractZip(source, dest)
+	case "tar":
+		roots, err = lib.ExtractTar(source, dest)
+	default:
+		roots, err = lib.ExtractTarGz(source, dest)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %w", source, err)
+	}
+
+	// Track extracted location
+	if ctx.ExtractedPath == "" {
+		ctx.ExtractedPath = dest
+	}
+	trackExtracted(ctx, workDir, dest, roots)
+
+	// Track the archive file
+	ctx.AddFile(source, "archive", false)
+
+	// Optionally delete the archive after extraction
+	if err := lib.Delete(source); err != nil {
+		fmt.Printf("Warning: failed to delete archive %s: %v\n", source, err)
+	}
+	return nil
+}
+
+// checkExtractConflicts refuses to extract over files another package owns
+func checkExtractConflicts(ctx *model.InstallationContext, source, dest, format string) error {
+	if ctx.OwnersOf == nil || ctx.AllowOverwrite {
+		return nil
+	}
+	files, err := lib.ArchiveFiles(source, dest, format)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", source, err)
+	}
+	for _, file := range files {
+		if err := ctx.CheckConflict(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackExtracted records what an extraction added to the install tree: the
+// destination itself when it is a dedicated directory, otherwise each
+// top-level entry the archive wrote into the shared working directory
+func trackExtracted(ctx *model.InstallationContext, workDir, dest string, roots []string) {
+	if filepath.Clean(dest) != filepath.Clean(workDir) {
+		ctx.AddFile(dest, "", false)
+		return
+	}
+	for _, root := range roots {
+		ctx.AddFile(root, "", false)
+	}
+}
+
+func runAddToPath(ctx *model.InstallationContext, workDir string, args []string) error {
+	pathToAdd := args[0]
+	if !filepath.IsAbs(pathToAdd) {
+		pathToAdd = filepath.Join(workDir, pathToAdd)
+	}
+
+	if ctx.Staging {
+		fmt.Printf("Skipping PATH change while staging: %s\n", pathToAdd)
+		return nil
+	}
+
+	sysPath, err := lib.AddToPath(pathToAdd)
+	if err != nil {
+		return fmt.Errorf("failed to add to PATH: %w", err)
+	}
+
+	fmt.Printf("Added to PATH: %s\n", pathToAdd)
+	ctx.Installation.SysPath = sysPath
+	ctx.RecordUndo(model.UndoPathEntry, "", "", sysPath)
+
+	// Track environment modification
+	ctx.AddEnvMod("path_addition", "PATH", sysPath, "")
+
+	return nil
+}
+
+// envHandler changes a user environment variable persistently; modType is
+// one of lib.EnvSet, lib.EnvAppend and lib.EnvPrepend
+func envHandler(modType string) Handler {
+	return FuncHandler{
+		Args:  []Param{{Name: "name"}, {Name: "value"}},
+		Check: checkEnv,
+		Exec: func(ctx *model.InstallationContext, workDir string, args []string) error {
+			return runEnv(ctx, args, modType)
+		},
+	}
+}
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func checkEnv(args []string) error {
+	if !envName.MatchString(args[0]) {
+		return &argError{index: 0, err: fmt.Errorf("invalid environment variable name '%s'", args[0])}
+	}
+	if strings.EqualFold(args[0], "PATH") {
+		return &argError{index: 0, err: fmt.Errorf("use ADD_TO_PATH to change PATH")}
+	}
+	return nil
+}
+
+func runEnv(ctx *model.InstallationContext, args []string, modType string) error {
+	name, value := args[0], args[1]
+
+	if ctx.Staging {
+		fmt.Printf("Skipping environment change while staging: %s\n", name)
+		return nil
+	}
+
+	mod, changed, err := lib.SetEnv(modType, name, value)
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %w", name, err)
+	}
+	if !changed {
+		// Reverting would remove a value the user had before
+		fmt.Printf("%s already has %s\n", name, value)
+		return nil
+	}
+
+	fmt.Printf("Set %s: %s\n", name, value)
+	ctx.RecordUndo(model.UndoEnv, "", "", lib.EncodeEnv(mod))
+
+	// Track environment modification
+	ctx.AddEnvMod(mod.ModificationType, mod.VariableName, mod.VariableValue, mod.OriginalValue)
+
+	return nil
+}
+
+func checkLinkBin(args []string) error {
+	if len(args) < 2 {
+		return nil
+	}
+	if name := args[1]; name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\:`) {
+		return &argError{index: 1, err: fmt.Errorf("LINK_BIN name must be a plain file name, got '%s'", name)}
+	}
+	return nil
+}
+
+// runLinkBin makes an executable of the package available as a command in
+// the shared shims directory. A command of the same name from another
+// package is a conflict.
+func runLinkBin(ctx *model.InstallationContext, workDir string, args []string) error {
+	target := filepath.Join(workDir, args[0])
+	name := filepath.Base(target)
+	if len(args) > 1 {
+		name = args[1]
+	}
+
+	if info, err := os.Stat(target); err != nil {
+		return fmt.Errorf("LINK_BIN target not found: %w", err)
+	} else if info.IsDir() {
+		return fmt.Errorf("LINK_BIN target %s is a directory", args[0])
+	}
+
+	shim := lib.ShimPath(name)
+
+	// The shims directory is shared, so a staged run only notes the link
+	if ctx.Staging {
+		if ctx.TargetWorkDir != "" {
+			target = filepath.Join(ctx.TargetWorkDir, args[0])
+		}
+		if ctx.Links == nil {
+			ctx.Links = make(map[string]string)
+		}
+		ctx.Links[shim] = target
+		fmt.Printf("Staged command link: %s\n", name)
+		return nil
+	}
+
+	if err := ctx.CheckConflict(shim); err != nil {
+		return fmt.Errorf("command '%s' clashes with another package: %w", name, err)
+	}
+	if err := RecordWrite(ctx, shim); err != nil {
+		return err
+	}
+
+	// Track the link so it is removed with the package
+	ctx.AddFile(shim, "", false)
+
+	added, err := lib.LinkBin(target, shim)
+	if err != nil {
+		return fmt.Errorf("failed to link %s: %w", name, err)
+	}
+	fmt.Printf("Linked %s -> %s\n", name, target)
+	if added {
+		fmt.Printf("Added %s to PATH\n", config.ShimsDir())
+	}
+	return nil
+}
+
+func runSetLocation(ctx *model.InstallationContext, workDir string, args []string) error {
+	ctx.Installation.Location = filepath.Join(workDir, args[0])
+	return nil
+}
+
+func runDelete(ctx *model.InstallationContext, workDir string, args []string) error {
+	target := filepath.Join(workDir, args[0])
+	if err := ctx.CheckConflict(target); err != nil {
+		return err
+	}
+	if err := RecordDelete(ctx, target); err != nil {
+		return err
+	}
+	return lib.Delete(target)
+}
+
+// runMove implements MOVE and RENAME
+func runMove(ctx *model.InstallationContext, workDir string, args []string) error {
+	src := filepath.Join(workDir, args[0])
+	dst := filepath.Join(workDir, args[1])
+
+	if err := ctx.CheckConflict(dst); err != nil {
+		return err
+	}
+
+	if err := RecordMove(ctx, src, dst); err != nil {
+		return err
+	}
+
+	// Track the destination file
+	ctx.AddFile(dst, "", false)
+
+	return lib.Move(src, dst)
+}
+
+func runCopy(ctx *model.InstallationContext, workDir string, args []string) error {
+	src := filepath.Join(workDir, args[0])
+	dst := filepath.Join(workDir, args[1])
+
+	if err := ctx.CheckConflict(dst); err != nil {
+		return err
+	}
+
+	if err := RecordWrite(ctx, dst); err != nil {
+		return err
+	}
+
+	// Track the copied file
+	ctx.AddFile(dst, "", false)
+
+	return lib.Copy(src, dst)
+}
+
+// runConfig installs a configuration file. A config the user has changed
+// is kept, and the package's version is written next to it as .jpmnew.
+func runConfig(ctx *model.InstallationContext, workDir string, args []string) error {
+	src := filepath.Join(workDir, args[0])
+	dst := filepath.Join(workDir, args[1])
+
+	if info, err := os.Stat(src); err != nil {
+		return fmt.Errorf("CONFIG source not found: %w", err)
+	} else if info.IsDir() {
+		return fmt.Errorf("CONFIG source %s is a directory", args[0])
+	}
+
+	if err := ctx.CheckConflict(dst); err != nil {
+		return err
+	}
+
+	sum, err := lib.HashFile(src)
+	if err != nil {
+		return err
+	}
+
+	target := dst
+	if keepConfig(ctx, dst, sum) {
+		target = dst + ".jpmnew"
+		fmt.Printf("Keeping modified %s, new version written to %s\n", dst, target)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(target), err)
+	}
+	if err := RecordWrite(ctx, target); err != nil {
+		return err
+	}
+
+	// Track the config with the packaged content, so later edits are detected
+	ctx.AddConfig(dst, sum)
+
+	return lib.Copy(src, target)
+}
+
+// keepConfig reports whether the config file at path holds changes of the
+// user that the packaged version, with hash sum, must not overwrite: it
+// differs from what the previous install recorded, or jpm has no record of
+// it at all, e.g. because 'jpm remove' kept it
+func keepConfig(ctx *model.InstallationContext, path, sum string) bool {
+	current, err := lib.HashFile(path)
+	if err != nil || current == sum || ctx.CreatedHere(path) {
+		return false
+	}
+	recorded := ctx.RecordedFile(path)
+	if recorded == nil {
+		return true
+	}
+	return recorded.SHA256 != "" && current != recorded.SHA256
+}
+
+func runChmod(ctx *model.InstallationContext, workDir string, args []string) error {
+	target := filepath.Join(workDir, args[0])
+	RecordMode(ctx, target)
+
+	// Track as executable
+	ctx.AddFile(target, "binary", true)
+
+	return lib.MakeExecutable(target)
+}
+
+// runDownload fetches an extra artifact into the work directory. The file
+// is downloaded into a scratch directory first and only moved into place
+// once its checksum matches. A destination ending in a separator, or naming
+// an existing directory, keeps the downloaded file name.
+func runDownload(ctx *model.InstallationContext, workDir string, args []string) error {
+	rawURL, dest, sum := downloadArgs(args)
+
+	scratch, err := os.MkdirTemp(workDir, ".download-")
+	if err != nil {
+		return fmt.Errorf("failed to create download directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	if err := lib.Download(rawURL, scratch); err != nil {
+		return fmt.Errorf("failed to download %s: %w", rawURL, err)
+	}
+
+	entries, err := os.ReadDir(scratch)
+	if err != nil || len(entries) != 1 {
+		return fmt.Errorf("failed to download %s: no file was written", rawURL)
+	}
+	downloaded := filepath.Join(scratch, entries[0].Name())
+
+	actual, err := lib.HashFile(downloaded)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(actual, sum) {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", rawURL, strings.ToLower(sum), actual)
+	}
+
+	target := filepath.Join(workDir, entries[0].Name())
+	if dest != "" {
+		target = filepath.Join(workDir, dest)
+		if info, err := os.Stat(target); os.IsPathSeparator(dest[len(dest)-1]) || (err == nil && info.IsDir()) {
+			target = filepath.Join(target, entries[0].Name())
+		}
+	}
+
+	if err := ctx.CheckConflict(target); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(target), err)
+	}
+
+	if err := RecordWrite(ctx, target); err != nil {
+		return err
+	}
+	ctx.AddFile(target, "", false)
+
+	_ = os.Remove(target)
+	return lib.Move(downloaded, target)
+}
+
+// runScript executes a script shipped in the package. The script must live
+// inside the work directory and runs from its own directory with a minimal
+// environment plus JPM_* variables describing the installation.
+func runScript(ctx *model.InstallationContext, workDir string, args []string) error {
+	script := filepath.Join(workDir, args[0])
+
+	rel, err := filepath.Rel(workDir, script)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("script %s is outside the work directory", args[0])
+	}
+
+	// Scripts may change anything; a rebuild must not run them again
+	if ctx.Staging {
+		fmt.Printf("Skipping package script while staging: %s\n", args[0])
+		return nil
+	}
+
+	if ctx.ForbidScripts || !config.ScriptsAllowed() {
+		return fmt.Errorf("package scripts are disabled by policy, refusing to run %s", args[0])
+	}
+
+	if _, err := os.Stat(script); err != nil {
+		return fmt.Errorf("script not found: %w", err)
+	}
+
+	location := ctx.Installation.Location
+	if location == "" {
+		location = ctx.ExtractedPath
+	}
+
+	timeout := ctx.ScriptTimeout
+	if timeout == 0 {
+		timeout = config.ScriptTimeout()
+	}
+
+	result, err := lib.RunScript(lib.ScriptOptions{
+		Script: script,
+		Args:   args[1:],
+		Dir:    filepath.Dir(script),
+		Env: map[string]string{
+			"JPM_PACKAGE":  ctx.Installation.Name,
+			"JPM_VERSION":  ctx.Installation.Version,
+			"JPM_WORKDIR":  workDir,
+			"JPM_LOCATION": location,
+			"JPM_HOME":     config.Home(),
+			"JPM_OS":       runtime.GOOS,
+			"JPM_ARCH":     runtime.GOARCH,
+		},
+		Timeout: timeout,
+	})
+	if result != nil {
+		ctx.Scripts = append(ctx.Scripts, model.ScriptRun{
+			Script:   script,
+			Args:     args[1:],
+			ExitCode: result.ExitCode,
+			Stdout:   result.Stdout,
+			Stderr:   result.Stderr,
+			Duration: result.Duration,
+			RanAt:    time.Now(),
+		})
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package parser
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// conditionKeys are the platform properties a condition can test
+var conditionKeys = []string{"OS", "ARCH"}
+
+// Guard is one platform condition: every term must match, e.g. OS=linux
+// ARCH=amd64,arm64. Negate inverts the result, which is how ELSE is expressed.
+type Guard struct {
+	Terms  map[string][]string
+	Negate bool
+}
+
+// Matches reports whether the guard holds on the given platform
+func (g Guard) Matches(goos, goarch string) bool {
+	actual := map[string]string{"OS": goos, "ARCH": goarch}
+
+	match := true
+	for key, values := range g.Terms {
+		if !slices.Contains(values, actual[key]) {
+			match = false
+			break
+		}
+	}
+	return match != g.Negate
+}
+
+// parseGuard parses condition terms such as ["OS=linux", "arch=amd64,arm64"]
+func parseGuard(terms []string) (Guard, error) {
+	if len(terms) == 0 {
+		return Guard{}, fmt.Errorf("condition needs at least one KEY=value term")
+	}
+
+	guard := Guard{Terms: make(map[string][]string)}
+	for _, term := range terms {
+		key, value, ok := strings.Cut(term, "=")
+		key = strings.ToUpper(strings.TrimSpace(key))
+		if !ok || value == "" {
+			return Guard{}, fmt.Errorf("invalid condition '%s' (expected KEY=value)", term)
+		}
+		if !slices.Contains(conditionKeys, key) {
+			return Guard{}, fmt.Errorf("unknown condition key '%s' (available: %s)", key, strings.Join(conditionKeys, ", "))
+		}
+		if _, dup := guard.Terms[key]; dup {
+			return Guard{}, fmt.Errorf("condition key '%s' given twice", key)
+		}
+		for _, v := range strings.Split(strings.ToLower(value), ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				guard.Terms[key] = append(guard.Terms[key], v)
+			}
+		}
+	}
+	return guard, nil
+}
+
+// splitLineGuard separates a leading per-line guard such as "[os=windows]"
+// from the instruction that follows it. The guard is nil when there is none.
+func splitLineGuard(line string) (*Guard, string, error) {
+	if !strings.HasPrefix(line, "[") {
+		return nil, line, nil
+	}
+	end := strings.IndexByte(line, ']')
+	if end < 0 {
+		return nil, "", fmt.Errorf("unclosed '[' in line guard")
+	}
+
+	guard, err := parseGuard(strings.Fields(line[1:end]))
+	if err != nil {
+		return nil, "", err
+	}
+	return &guard, strings.TrimSpace(line[end+1:]), nil
+}
+
+// blockStack tracks the IF/ELSE/END blocks enclosing the current line
+type blockStack struct {
+	guards []Guard
+	lines  []int
+	inElse []bool
+}
+
+func (b *blockStack) push(g Guard, line int) {
+	b.guards = append(b.guards, g)
+	b.lines = append(b.lines, line)
+	b.inElse = append(b.inElse, false)
+}
+
+func (b *blockStack) flip() error {
+	top := len(b.guards) - 1
+	if top < 0 {
+		return fmt.Errorf("ELSE without IF")
+	}
+	if b.inElse[top] {
+		return fmt.Errorf("second ELSE for IF on line %d", b.lines[top])
+	}
+	b.guards[top].Negate = true
+	b.inElse[top] = true
+	return nil
+}
+
+func (b *blockStack) pop() error {
+	top := len(b.guards) - 1
+	if top < 0 {
+		return fmt.Errorf("END without IF")
+	}
+	b.guards = b.guards[:top]
+	b.lines = b.lines[:top]
+	b.inElse = b.inElse[:top]
+	return nil
+}
+
+// current returns a copy of the guards of all open blocks
+func (b *blockStack) current() []Guard {
+	if len(b.guards) == 0 {
+		return nil
+	}
+	return slices.Clone(b.guards)
+}
+
+// Applies reports whether the instruction runs on the given platform
+func (inc *Instruction) Applies(goos, goarch string) bool {
+	for _, g := range inc.Guards {
+		if !g.Matches(goos, goarch) {
+			return false
+		}
+	}
+	return true
+}
+
+// AppliesHere reports whether the instruction runs on this machine
+func (inc *Instruction) AppliesHere() bool {
+	return inc.Applies(runtime.GOOS, runtime.GOARCH)
+}
+
+// terms returns the guard's conditions as text, e.g. "OS=linux ARCH=amd64,arm64"
+func (g Guard) terms() string {
+	var terms []string
+	for _, key := range conditionKeys {
+		if values, ok := g.Terms[key]; ok {
+			terms = append(terms, key+"="+strings.Join(values, ","))
+		}
+	}
+	return strings.Join(terms, " ")
+}
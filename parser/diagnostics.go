@@ -0,0 +1,161 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Severity tells whether a diagnostic stops the instructions from being used
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is one problem found while parsing instructions. Line and
+// Column are 1-based; zero means the problem has no single position.
+type Diagnostic struct {
+	Severity   Severity
+	Line       int
+	Column     int
+	Message    string
+	Suggestion string // replacement for the offending word, if one is likely
+}
+
+func (d Diagnostic) Error() string {
+	var b strings.Builder
+	switch {
+	case d.Line > 0 && d.Column > 0:
+		fmt.Fprintf(&b, "line %d:%d: ", d.Line, d.Column)
+	case d.Line > 0:
+		fmt.Fprintf(&b, "line %d: ", d.Line)
+	}
+	if d.Severity == SeverityWarning {
+		b.WriteString("warning: ")
+	}
+	b.WriteString(d.Message)
+	if d.Suggestion != "" {
+		fmt.Fprintf(&b, " (did you mean %s?)", d.Suggestion)
+	}
+	return b.String()
+}
+
+// Diagnostics is everything found in one set of instructions, in line order
+type Diagnostics []Diagnostic
+
+// HasErrors reports whether any diagnostic is an error
+func (ds Diagnostics) HasErrors() bool {
+	return slices.ContainsFunc(ds, func(d Diagnostic) bool { return d.Severity == SeverityError })
+}
+
+// Warnings returns only the warnings
+func (ds Diagnostics) Warnings() Diagnostics {
+	var warnings Diagnostics
+	for _, d := range ds {
+		if d.Severity == SeverityWarning {
+			warnings = append(warnings, d)
+		}
+	}
+	return warnings
+}
+
+// Err joins all errors into one, or returns nil when there are none
+func (ds Diagnostics) Err() error {
+	var errs []error
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			errs = append(errs, d)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sort orders diagnostics by position, keeping the report order for ties
+func (ds Diagnostics) sort() {
+	slices.SortStableFunc(ds, func(a, b Diagnostic) int {
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return a.Column - b.Column
+	})
+}
+
+// reporter collects diagnostics for one parse
+type reporter struct {
+	diags Diagnostics
+}
+
+func (r *reporter) errorf(line, col int, format string, args ...any) {
+	r.add(SeverityError, line, col, "", format, args...)
+}
+
+func (r *reporter) warnf(line, col int, format string, args ...any) {
+	r.add(SeverityWarning, line, col, "", format, args...)
+}
+
+func (r *reporter) add(sev Severity, line, col int, suggestion, format string, args ...any) {
+	r.diags = append(r.diags, Diagnostic{
+		Severity:   sev,
+		Line:       line,
+		Column:     col,
+		Message:    fmt.Sprintf(format, args...),
+		Suggestion: suggestion,
+	})
+}
+
+// keywords are the words that may start a line, for suggestions
+func keywords() []string {
+	words := slices.Clone(blockKeywords)
+	for name := range tokenMap {
+		words = append(words, name)
+	}
+	slices.Sort(words)
+	return words
+}
+
+// suggestCommand returns the keyword closest to a misspelled command, or ""
+// when none is close enough to be a likely typo
+func suggestCommand(word string) string {
+	word = strings.ToUpper(word)
+	limit := max(1, len(word)/3)
+
+	best, bestDist := "", limit+1
+	for _, candidate := range keywords() {
+		if d := editDistance(word, candidate); d < bestDist {
+			best, bestDist = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
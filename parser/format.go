@@ -0,0 +1,111 @@
+package parser
+
+import (
+	"strings"
+)
+
+// FormatSource rewrites instructions in canonical form. Instruction text
+// keeps its comments, blank lines and block structure while commands are
+// upper-cased, arguments quoted only where needed, spacing normalised and
+// blocks indented by two spaces; continued lines are joined. A JSON manifest
+// is re-encoded. Text with errors is returned unchanged with the errors.
+func (p *Parser) FormatSource(data string) (string, error) {
+	install, remove, diags := p.Diagnose(data)
+	if err := diags.Err(); err != nil {
+		return data, err
+	}
+	if IsManifest(data) {
+		return NewManifest(install, remove).Encode()
+	}
+
+	lines := strings.Split(strings.TrimRight(data, "\n"), "\n")
+	lx := &lexer{
+		lines:    lines,
+		comments: p.AllowComments,
+		report:   func(int, int, Severity, string) {},
+	}
+
+	var out []string
+	depth := 0
+	emit := func(indent int, text string) {
+		out = append(out, strings.Repeat("  ", max(indent, 0))+text)
+	}
+
+	for i := 0; i < len(lines); {
+		line := strings.TrimSpace(lines[i])
+
+		switch {
+		case line == "":
+			// Keep single blank lines between statements
+			if len(out) > 0 && out[len(out)-1] != "" {
+				out = append(out, "")
+			}
+			i++
+			continue
+		case p.AllowComments && strings.HasPrefix(line, "#"):
+			emit(depth, "# "+strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			i++
+			continue
+		case strings.EqualFold(strings.TrimSuffix(line, ":"), "ON_REMOVE"):
+			depth = 0
+			emit(0, "ON_REMOVE")
+			i++
+			continue
+		}
+
+		// Diagnose has already accepted every line, so errors cannot occur here
+		lineGuard, rest, _ := splitLineGuard(line)
+		ll, _ := lx.lex(i, columnOf(line, rest)-1+columnOf(lines[i], line)-1)
+		i = ll.next
+		words := fieldTexts(ll.fields)
+		if len(words) == 0 {
+			continue
+		}
+
+		var text string
+		switch strings.ToUpper(words[0]) {
+		case "IF":
+			guard, _ := parseGuard(words[1:])
+			emit(depth, "IF "+guard.terms())
+			depth++
+		case "ELSE":
+			emit(depth-1, "ELSE")
+		case "END":
+			depth--
+			emit(depth, "END")
+		default:
+			token := stringToToken(words[0])
+			switch {
+			case strings.EqualFold(words[0], "USE"):
+				parts := []string{"USE"}
+				for _, word := range words[1:] {
+					parts = append(parts, quoteArg(word))
+				}
+				text = strings.Join(parts, " ")
+			case token == INVALID:
+				// An unknown command skipped outside strict mode stays as written
+				text = ll.text
+				lineGuard = nil
+			default:
+				inc := Instruction{Token: token, Args: words[1:]}
+				text = inc.Format()
+			}
+			if lineGuard != nil {
+				text = "[" + lineGuard.terms() + "] " + text
+			}
+			if ll.comment != "" {
+				text += "  # " + ll.comment
+			}
+			emit(depth, text)
+			continue
+		}
+		if ll.comment != "" {
+			out[len(out)-1] += "  # " + ll.comment
+		}
+	}
+
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	return strings.Join(out, "\n") + "\n", nil
+}
@@ -0,0 +1,253 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The instruction language, in EBNF. Keywords, commands and condition keys
+// are case-insensitive. ws is one or more spaces or tabs.
+//
+//	text        = { line newline } [ line ] ;
+//	line        = [ ws ] [ statement ] [ ws ] [ comment ] ;
+//	statement   = header | block | [ guard [ ws ] ] ( instruction | use ) ;
+//	header      = "ON_REMOVE" [ ":" ] ;
+//	block       = "IF" ws condition { ws condition } | "ELSE" | "END" ;
+//	guard       = "[" condition { ws condition } "]" ;
+//	condition   = ( "OS" | "ARCH" ) "=" value { "," value } ;
+//	instruction = command { ws argument } [ ws continuation ] ;
+//	use         = "USE" ws macro-name { ws param-name "=" argument } [ ws continuation ] ;
+//	command     = "DOWNLOAD" | "EXTRACT" | "EXTRACT_TAR" | "EXTRACT_TARGZ"
+//	            | "MOVE" | "COPY" | "RENAME" | "DELETE" | "CHMOD"
+//	            | "ADD_TO_PATH" | "SET_LOCATION" | "RUN_SCRIPT"
+//	            | "SET_ENV" | "APPEND_ENV" | "PREPEND_ENV" | "LINK_BIN" | "CONFIG"
+//	            | "TEMPLATE"
+//	            | ? a command added with Register ? ;
+//	argument    = ( bare | quoted ) { bare-char | quoted } ;
+//	bare        = bare-char - "#" { bare-char } ;
+//	bare-char   = ? any character except whitespace, '"' and "'" ? ;
+//	quoted      = '"' { escape | ? any character except '"' and "\" ? | "\" } '"'
+//	            | "'" { escape | ? any character except "'" and "\" ? | "\" } "'" ;
+//	escape      = "\" ( '"' | "'" | "\" ) ;
+//	comment     = "#" { ? any character ? } ;
+//	continuation = "\" newline line ;
+//
+// A backslash only escapes a quote or another backslash inside quotes, so
+// Windows paths need no doubling. A comment starts at a "#" that begins a
+// word, and a "\" standing alone as the last word joins the next line.
+// Quotes may only open at the start of a word; elsewhere they are kept
+// literally and reported as a warning.
+
+// field is one word of an instruction
+type field struct {
+	text   string
+	line   int // line number of the word's first character
+	col    int // 1-based column of the word's first character
+	quoted bool
+}
+
+func fieldTexts(fields []field) []string {
+	texts := make([]string, len(fields))
+	for i, f := range fields {
+		texts[i] = f.text
+	}
+	return texts
+}
+
+// columnOf returns the 1-based column at which sub, a trimmed part of
+// line, starts within line
+func columnOf(line, sub string) int {
+	start := len(line) - len(sub)
+	if !strings.HasSuffix(line, sub) {
+		start = strings.Index(line, sub)
+	}
+	if start < 0 {
+		return 1
+	}
+	return utf8.RuneCountInString(line[:start]) + 1
+}
+
+// lexer splits instruction lines into words
+type lexer struct {
+	lines    []string
+	offset   int               // lines before lines[0] in the original text
+	comments bool              // whether '#' starts a comment
+	params   map[string]string // USE macro parameters substituted into each word
+	report   func(line, col int, sev Severity, msg string)
+}
+
+// logicalLine is one instruction read by the lexer
+type logicalLine struct {
+	fields  []field
+	text    string // the source text, continuations joined by a space
+	comment string // trailing comments, without their '#'
+	next    int    // index of the first line after the instruction
+}
+
+// lex reads one instruction starting at rune column start of lines[i],
+// following line continuations. ok is false when the instruction cannot be
+// used at all; ll.next is set either way.
+func (lx *lexer) lex(i, start int) (ll logicalLine, ok bool) {
+	var parts, comments []string
+	for {
+		lineNum := lx.offset + i + 1
+		lineFields, comment, continued, lineOK := lx.lexLine(lx.lines[i], lineNum, start)
+		ll.fields = append(ll.fields, lineFields...)
+		if comment != "" {
+			comments = append(comments, comment)
+		}
+		i++
+
+		part := strings.TrimSpace(lx.lines[i-1])
+		if continued {
+			part = strings.TrimSpace(strings.TrimSuffix(part, `\`))
+		}
+		if part != "" {
+			parts = append(parts, part)
+		}
+
+		if !lineOK {
+			return logicalLine{next: lx.skipContinued(i, continued)}, false
+		}
+		if !continued {
+			break
+		}
+		if i >= len(lx.lines) {
+			lx.report(lineNum, 0, SeverityWarning, "line continuation at end of input")
+			break
+		}
+		start = 0
+	}
+	ll.text = strings.Join(parts, " ")
+	ll.comment = strings.Join(comments, " ")
+	ll.next = i
+	return ll, true
+}
+
+// skipContinued returns the first line after a broken instruction, so its
+// continuation lines are not parsed as instructions of their own
+func (lx *lexer) skipContinued(i int, continued bool) int {
+	for continued && i < len(lx.lines) {
+		trimmed := strings.TrimSpace(lx.lines[i])
+		continued = trimmed == `\` || strings.HasSuffix(trimmed, ` \`) || strings.HasSuffix(trimmed, "\t\\")
+		i++
+	}
+	return i
+}
+
+// lexLine splits one physical line, from rune column start on, into words
+// and a trailing comment. continued reports a trailing lone backslash.
+func (lx *lexer) lexLine(line string, lineNum, start int) (fields []field, comment string, continued, ok bool) {
+	var current strings.Builder
+	wordStart := -1
+	quoted := false
+	quoteChar, quoteAt := rune(0), 0
+
+	flush := func() {
+		if wordStart >= 0 {
+			text := current.String()
+			if lx.params != nil {
+				text = substituteParams(text, lx.params)
+			}
+			fields = append(fields, field{text: text, line: lineNum, col: wordStart + 1, quoted: quoted})
+			current.Reset()
+			wordStart = -1
+			quoted = false
+		}
+	}
+
+	runes := []rune(line)
+	for i := start; i < len(runes); i++ {
+		ch := runes[i]
+		switch {
+		case quoteChar != 0:
+			switch {
+			case ch == '\\' && i+1 < len(runes) && strings.ContainsRune(`"'\`, runes[i+1]):
+				// Escaped quote or backslash
+				i++
+				current.WriteRune(runes[i])
+			case ch == quoteChar:
+				// End of quoted string
+				quoteChar = 0
+			default:
+				current.WriteRune(ch)
+			}
+		case ch == '"' || ch == '\'':
+			if wordStart < 0 {
+				// Start of quoted string (only at word boundaries)
+				wordStart = i
+				quoted = true
+				quoteChar, quoteAt = ch, i
+			} else {
+				lx.report(lineNum, i+1, SeverityWarning,
+					fmt.Sprintf("%c in the middle of a word is kept literally; quote the whole argument instead", ch))
+				current.WriteRune(ch)
+			}
+		case ch == '#' && wordStart < 0 && lx.comments:
+			// Comment to the end of the line
+			comment = strings.TrimSpace(string(runes[i+1:]))
+			i = len(runes)
+		case unicode.IsSpace(ch):
+			// Word separator outside quotes
+			flush()
+		default:
+			// Regular character (including backslashes)
+			if wordStart < 0 {
+				wordStart = i
+			}
+			current.WriteRune(ch)
+		}
+	}
+
+	if quoteChar != 0 {
+		lx.report(lineNum, quoteAt+1, SeverityError, fmt.Sprintf("unclosed %c quote", quoteChar))
+		return nil, "", false, false
+	}
+	flush()
+
+	// A lone backslash as the last word continues the instruction on the next line
+	if n := len(fields); n > 0 && fields[n-1].text == `\` && !fields[n-1].quoted {
+		return fields[:n-1], comment, true, true
+	}
+	return fields, comment, false, true
+}
+
+// quoteArg returns arg as the lexer would need to see it to read it back
+// unchanged, quoting only when necessary
+func quoteArg(arg string) string {
+	needsQuotes := arg == "" || arg == `\` || strings.HasPrefix(arg, "#") ||
+		strings.ContainsFunc(arg, func(r rune) bool { return unicode.IsSpace(r) || r == '"' || r == '\'' })
+	if !needsQuotes {
+		return arg
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	runes := []rune(arg)
+	for i, r := range runes {
+		switch {
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '\\' && (i+1 == len(runes) || strings.ContainsRune(`"'\`, runes[i+1])):
+			// Only backslashes the lexer would read as an escape need doubling
+			b.WriteString(`\\`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Format returns the instruction in canonical form: the command in upper
+// case followed by its arguments, quoted only where needed. Platform guards
+// are not included.
+func (inc *Instruction) Format() string {
+	parts := []string{inc.Token.String()}
+	for _, arg := range inc.Args {
+		parts = append(parts, quoteArg(arg))
+	}
+	return strings.Join(parts, " ")
+}
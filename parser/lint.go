@@ -0,0 +1,237 @@
+package parser
+
+import (
+	"jpm/lib"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// LintOptions configures Lint
+type LintOptions struct {
+	// Artifact is the file name of the release download, when known
+	Artifact string
+}
+
+// Lint looks for instructions that parse but probably do not do what their
+// author meant. Every finding is a warning on the instruction's line.
+func Lint(instructions []Instruction, opts LintOptions) Diagnostics {
+	r := &reporter{}
+	for i := range instructions {
+		inc := &instructions[i]
+		switch inc.Token {
+		case EXTRACT, EXTRACT_TAR, EXTRACT_TAR_GZ:
+			lintArchive(instructions, i, opts.Artifact, r)
+		case MOVE, COPY, RENAME:
+			lintUnused(instructions, i, r)
+		case CHMOD:
+			lintChmod(instructions, i, opts.Artifact, r)
+		}
+		lintPlatformPaths(inc, r)
+	}
+	r.diags.sort()
+	return r.diags
+}
+
+// archiveTokens maps lib.DetectArchiveType results to the command that extracts them
+var archiveTokens = map[string]Token{
+	"zip":    EXTRACT,
+	"tar":    EXTRACT_TAR,
+	"tar.gz": EXTRACT_TAR_GZ,
+}
+
+// lintArchive checks that an extracted file fits the command and is the
+// release artifact or something an earlier instruction put in place
+func lintArchive(instructions []Instruction, i int, artifact string, r *reporter) {
+	inc := &instructions[i]
+	source := lintPath(inc.Args[0])
+
+	if token, ok := archiveTokens[lib.DetectArchiveType(source)]; ok && token != inc.Token {
+		r.add(SeverityWarning, inc.LineNumber, 0, token.String(),
+			"%v cannot extract '%s'", inc.Token, inc.Args[0])
+	}
+
+	if artifact == "" || matchesVars(path.Base(source), artifact) {
+		return
+	}
+	for _, prev := range instructions[:i] {
+		if dest := producedPath(&prev); dest != "" && dest == source {
+			return
+		}
+	}
+	r.warnf(inc.LineNumber, 0, "'%s' does not match the release artifact '%s'", inc.Args[0], artifact)
+}
+
+// lintUnused reports a MOVE, COPY or RENAME whose result is deleted before
+// anything uses it, and a MOVE or RENAME whose result is moved again
+func lintUnused(instructions []Instruction, i int, r *reporter) {
+	inc := &instructions[i]
+	source, dest := lintPath(inc.Args[0]), lintPath(inc.Args[1])
+
+	for j := i + 1; j < len(instructions); j++ {
+		next := &instructions[j]
+		same := guardKey(next.Guards) == guardKey(inc.Guards)
+
+		switch {
+		case next.Token == DELETE && within(dest, lintPath(next.Args[0])) && same:
+			r.warnf(inc.LineNumber, 0, "'%s' is deleted on line %d before anything uses it", inc.Args[1], next.LineNumber)
+			return
+		case (next.Token == MOVE || next.Token == RENAME) && (inc.Token == MOVE || inc.Token == RENAME) &&
+			lintPath(next.Args[0]) == dest && same:
+			if lintPath(next.Args[1]) == source {
+				r.warnf(next.LineNumber, 0, "%v moves '%s' back to where line %d took it from; drop both",
+					next.Token, next.Args[0], inc.LineNumber)
+			} else {
+				r.warnf(next.LineNumber, 0, "'%s' was moved here on line %d; use a single MOVE %s %s",
+					next.Args[0], inc.LineNumber, quoteArg(inc.Args[0]), quoteArg(next.Args[1]))
+			}
+			return
+		case next.Token == RUN_SCRIPT:
+			// A script may use anything
+			return
+		}
+
+		for _, arg := range lintArgs(next) {
+			p := lintPath(arg)
+			if within(p, dest) || within(dest, p) {
+				return
+			}
+		}
+	}
+}
+
+// lintChmod reports a CHMOD on a path no earlier instruction produces, or
+// one that was moved away or deleted before it
+func lintChmod(instructions []Instruction, i int, artifact string, r *reporter) {
+	inc := &instructions[i]
+	target := lintPath(inc.Args[0])
+
+	for j := i - 1; j >= 0; j-- {
+		prev := &instructions[j]
+		if produced := producedPath(prev); produced != "" && (within(target, produced) || within(produced, target)) {
+			return
+		}
+		switch prev.Token {
+		case MOVE, RENAME, DELETE:
+			if removed := lintPath(prev.Args[0]); within(target, removed) {
+				r.warnf(inc.LineNumber, 0, "CHMOD on '%s', which line %d %s", inc.Args[0], prev.LineNumber,
+					map[Token]string{MOVE: "moved away", RENAME: "renamed", DELETE: "deleted"}[prev.Token])
+				return
+			}
+		}
+	}
+
+	// Without extraction the artifact itself is the only file in the root
+	if (artifact == "" && !strings.Contains(target, "/")) || matchesVars(target, artifact) {
+		return
+	}
+	r.warnf(inc.LineNumber, 0, "CHMOD on '%s', which no earlier instruction extracts, downloads or moves into place", inc.Args[0])
+}
+
+var windowsPath = regexp.MustCompile(`^[A-Za-z]:[\\/]`)
+
+// lintPlatformPaths reports paths that only make sense on one OS in an
+// instruction that is not limited to an OS
+func lintPlatformPaths(inc *Instruction, r *reporter) {
+	for _, g := range inc.Guards {
+		if _, ok := g.Terms["OS"]; ok {
+			return
+		}
+	}
+
+	for _, arg := range lintArgs(inc) {
+		lower := strings.ToLower(arg)
+		switch {
+		case windowsPath.MatchString(arg) || strings.Contains(arg, `\`):
+			r.warnf(inc.LineNumber, 0, "'%s' is a Windows path; use '/' separators or an OS guard", arg)
+		case strings.HasSuffix(lower, ".exe") || strings.HasSuffix(lower, ".bat") ||
+			strings.HasSuffix(lower, ".cmd") || strings.HasSuffix(lower, ".ps1"):
+			r.warnf(inc.LineNumber, 0, "'%s' only exists on Windows; use ${EXE} or an OS guard", arg)
+		case strings.HasPrefix(arg, "/") && inc.Token == ADD_TO_PATH:
+			r.warnf(inc.LineNumber, 0, "'%s' is a Unix path; add an OS guard", arg)
+		case strings.HasPrefix(arg, "/"):
+			r.warnf(inc.LineNumber, 0, "'%s' is resolved inside the install root; drop the leading '/'", arg)
+		case inc.Token == RUN_SCRIPT && strings.HasSuffix(lower, ".sh"):
+			r.warnf(inc.LineNumber, 0, "'%s' does not run on Windows; add an OS guard", arg)
+		}
+	}
+}
+
+// lintArgs returns the arguments of an instruction that are paths
+func lintArgs(inc *Instruction) []string {
+	var paths []string
+	params, values := inc.boundArgs()
+	for i, p := range params {
+		if p.Kind != ParamValue {
+			paths = append(paths, values[i]...)
+		}
+	}
+	return paths
+}
+
+// producedPath returns the path an instruction creates, "." when it may
+// create anything in the install root, or "" when it creates nothing
+func producedPath(inc *Instruction) string {
+	switch inc.Token {
+	case EXTRACT, EXTRACT_TAR, EXTRACT_TAR_GZ:
+		if len(inc.Args) > 1 {
+			return lintPath(inc.Args[1])
+		}
+		return "."
+	case MOVE, COPY, RENAME:
+		return lintPath(inc.Args[1])
+	case DOWNLOAD:
+		rawURL, dest, _ := inc.downloadArgs()
+		if dest == "" {
+			dest = path.Base(rawURL)
+		}
+		return lintPath(dest)
+	case RUN_SCRIPT:
+		return "."
+	}
+	return ""
+}
+
+// lintPath normalises an instruction path for comparison
+func lintPath(p string) string {
+	return path.Clean(strings.ReplaceAll(p, `\`, "/"))
+}
+
+// within reports whether p is root or lies under it
+func within(p, root string) bool {
+	return root == "." || p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/")
+}
+
+// matchesVars reports whether name matches s, taking each ${VAR} in s to
+// stand for any text
+func matchesVars(s, name string) bool {
+	if name == "" {
+		return false
+	}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for {
+		start := strings.Index(s, "${")
+		end := strings.Index(s[max(start, 0):], "}")
+		if start < 0 || end < 0 {
+			pattern.WriteString(regexp.QuoteMeta(s))
+			break
+		}
+		pattern.WriteString(regexp.QuoteMeta(s[:start]) + ".*")
+		s = s[start+end+1:]
+	}
+	pattern.WriteString("$")
+	return regexp.MustCompile(pattern.String()).MatchString(name)
+}
+
+// guardKey identifies a list of guards, for comparing instructions
+func guardKey(guards []Guard) string {
+	keys := make([]string, len(guards))
+	for i, g := range guards {
+		keys[i] = g.terms()
+		if g.Negate {
+			keys[i] = "!" + keys[i]
+		}
+	}
+	return strings.Join(keys, ";")
+}
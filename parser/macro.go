@@ -0,0 +1,205 @@
+package parser
+
+import (
+	"fmt"
+	"jpm/model"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// MacroSource looks up the named instruction snippets that USE expands.
+// db.RemoteDB is one, backed by the registry.
+type MacroSource interface {
+	GetMacro(name string) (*model.Macro, error)
+}
+
+// macroScope is the USE expansion that lines are parsed in
+type macroScope struct {
+	stack  []string          // macros being expanded, outermost first
+	params map[string]string // parameter values of the innermost macro
+	cache  map[string]*model.Macro
+}
+
+func newMacroScope() *macroScope {
+	return &macroScope{cache: make(map[string]*model.Macro)}
+}
+
+// lookup fetches a macro once per parse
+func (s *macroScope) lookup(source MacroSource, name string) (*model.Macro, error) {
+	if m, ok := s.cache[name]; ok {
+		return m, nil
+	}
+	if source == nil {
+		return nil, fmt.Errorf("USE %s: no macro registry is available", name)
+	}
+	m, err := source.GetMacro(name)
+	if err != nil {
+		return nil, err
+	}
+	s.cache[name] = m
+	return m, nil
+}
+
+// checkUse validates a USE instruction kept unexpanded
+func checkUse(args []string) error {
+	for i, arg := range args[1:] {
+		if _, _, ok := strings.Cut(arg, "="); !ok {
+			return &argError{index: i + 1, err: fmt.Errorf("USE arguments are name=value, got '%s'", arg)}
+		}
+	}
+	return nil
+}
+
+func runUse(ctx *model.InstallationContext, workDir string, args []string) error {
+	return fmt.Errorf("USE %s was not expanded; parse the instructions with a macro registry", args[0])
+}
+
+// useFields turns a USE instruction back into the words of its line
+func useFields(inc Instruction) []field {
+	fields := []field{{text: "USE"}}
+	for _, arg := range inc.Args {
+		fields = append(fields, field{text: arg})
+	}
+	return fields
+}
+
+// macroParam is one parameter of a macro
+type macroParam struct {
+	name, def  string
+	hasDefault bool
+}
+
+var macroParamName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// parseMacroParams reads a macro's parameter list, e.g. "bin dir=bin".
+// Names are lower case so they cannot be confused with ${VAR} variables.
+func parseMacroParams(m *model.Macro) ([]macroParam, error) {
+	var params []macroParam
+	for _, word := range strings.Fields(m.Params) {
+		name, def, hasDefault := strings.Cut(word, "=")
+		if !macroParamName.MatchString(name) {
+			return nil, fmt.Errorf("macro %s has an invalid parameter '%s' (use lower-case letters, digits and '_')", m.Name, name)
+		}
+		if slices.ContainsFunc(params, func(p macroParam) bool { return p.name == name }) {
+			return nil, fmt.Errorf("macro %s declares parameter '%s' twice", m.Name, name)
+		}
+		params = append(params, macroParam{name: name, def: def, hasDefault: hasDefault})
+	}
+	return params, nil
+}
+
+// expandUse parses a USE line: the macro's body is parsed with its
+// parameters filled in, in place of the line. The resulting instructions
+// keep the USE line's number and guards, and are checked like any other.
+// Problems in the body are reported at the USE line.
+func (p *Parser) expandUse(fields []field, lineNum int, guards []Guard, scope *macroScope, r *reporter) []Instruction {
+	use := fields[0]
+	if len(fields) < 2 {
+		r.errorf(lineNum, use.col, "USE requires a macro name")
+		return nil
+	}
+	name := fields[1].text
+
+	if i := slices.Index(scope.stack, name); i >= 0 {
+		cycle := append(slices.Clone(scope.stack[i:]), name)
+		r.errorf(lineNum, fields[1].col, "macro recursion: %s", strings.Join(cycle, " -> "))
+		return nil
+	}
+
+	m, err := scope.lookup(p.Macros, name)
+	if err != nil {
+		r.errorf(lineNum, fields[1].col, "%v", err)
+		return nil
+	}
+	params, err := parseMacroParams(m)
+	if err != nil {
+		r.errorf(lineNum, fields[1].col, "%v", err)
+		return nil
+	}
+
+	values := make(map[string]string)
+	ok := true
+	for _, arg := range fields[2:] {
+		key, value, isPair := strings.Cut(arg.text, "=")
+		switch {
+		case !isPair:
+			r.errorf(arg.line, arg.col, "USE arguments are name=value, got '%s'", arg.text)
+			ok = false
+		case !slices.ContainsFunc(params, func(p macroParam) bool { return p.name == key }):
+			r.errorf(arg.line, arg.col, "macro %s has no parameter '%s' (parameters: %s)", name, key, m.Params)
+			ok = false
+		default:
+			if _, dup := values[key]; dup {
+				r.errorf(arg.line, arg.col, "parameter '%s' given twice", key)
+				ok = false
+			}
+			values[key] = value
+		}
+	}
+	for _, param := range params {
+		if _, given := values[param.name]; given {
+			continue
+		}
+		if !param.hasDefault {
+			r.errorf(lineNum, use.col, "macro %s requires %s=<value>", name, param.name)
+			ok = false
+			continue
+		}
+		values[param.name] = param.def
+	}
+	if !ok {
+		return nil
+	}
+
+	inner := &macroScope{stack: append(slices.Clone(scope.stack), name), params: values, cache: scope.cache}
+	sub := &reporter{}
+	body := p.parseLines(strings.Split(m.Body, "\n"), 0, sub, inner)
+	for _, d := range sub.diags {
+		r.add(d.Severity, lineNum, use.col, d.Suggestion, "in macro %s, line %d: %s", name, d.Line, d.Message)
+	}
+	if sub.diags.HasErrors() {
+		return nil
+	}
+	if len(body) == 0 {
+		r.warnf(lineNum, use.col, "macro %s has no instructions", name)
+	}
+
+	for i := range body {
+		inc := &body[i]
+		inc.LineNumber = lineNum
+		inc.Guards = append(slices.Clone(guards), inc.Guards...)
+		inc.RawLine = inc.Format()
+		if inc.Macro == "" {
+			inc.Macro = name
+		} else {
+			inc.Macro = name + " > " + inc.Macro
+		}
+	}
+	return body
+}
+
+// substituteParams replaces each ${name} in s for which params has a value;
+// other references are left for variable expansion to check
+func substituteParams(s string, params map[string]string) string {
+	var out strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			out.WriteString(s)
+			return out.String()
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			out.WriteString(s)
+			return out.String()
+		}
+		out.WriteString(s[:start])
+		if value, ok := params[s[start+2:start+end]]; ok {
+			out.WriteString(value)
+		} else {
+			out.WriteString(s[start : start+end+1])
+		}
+		s = s[start+end+1:]
+	}
+}
@@ -0,0 +1,442 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Manifest is the structured JSON form of a release's instructions. It
+// compiles into the same instructions as the line-based text:
+//
+//	{
+//	  "steps": [
+//	    {"command": "EXTRACT_TARGZ", "source": "tool.tar.gz"},
+//	    {"command": "CHMOD", "path": "tool/bin/tool", "when": [{"os": ["linux", "darwin"]}]},
+//	    {"command": "ADD_TO_PATH", "path": "tool/bin"}
+//	  ],
+//	  "on_remove": [
+//	    {"command": "RUN_SCRIPT", "script": "tool/uninstall.sh"}
+//	  ]
+//	}
+type Manifest struct {
+	Steps    []ManifestStep `json:"steps"`
+	OnRemove []ManifestStep `json:"on_remove,omitempty"`
+}
+
+// ManifestStep is one instruction with named arguments. The fields a
+// command takes are the names of its handler's parameters.
+type ManifestStep struct {
+	Command string   `json:"command"`
+	Source  string   `json:"source,omitempty"`
+	Dest    string   `json:"dest,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Script  string   `json:"script,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	SHA256  string   `json:"sha256,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Value   string   `json:"value,omitempty"`
+
+	// When limits the step to platforms; every condition must hold
+	When []ManifestCondition `json:"when,omitempty"`
+
+	// Fields holds the other fields, for parameters of registered commands
+	// that are none of the above
+	Fields map[string]string `json:"-"`
+}
+
+// stepKeys are the JSON names of ManifestStep's own fields
+var stepKeys = append([]string{"command", "when"}, stepFieldNames...)
+
+// UnmarshalJSON reads the step's own fields strictly and keeps any other
+// string field in Fields, to be checked against the command's parameters
+func (s *ManifestStep) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	own := make(map[string]json.RawMessage)
+	for key, value := range raw {
+		if slices.Contains(stepKeys, key) {
+			own[key] = value
+			continue
+		}
+		var str string
+		if err := json.Unmarshal(value, &str); err != nil {
+			return fmt.Errorf("field '%s' must be a string", key)
+		}
+		if s.Fields == nil {
+			s.Fields = make(map[string]string)
+		}
+		s.Fields[key] = str
+	}
+
+	data, err := json.Marshal(own)
+	if err != nil {
+		return err
+	}
+	type plain ManifestStep
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(s))
+}
+
+// MarshalJSON writes Fields after the step's own fields
+func (s ManifestStep) MarshalJSON() ([]byte, error) {
+	type plain ManifestStep
+	own, err := encodeJSON(plain(s))
+	if err != nil {
+		return nil, err
+	}
+	out := bytes.TrimSuffix(own, []byte("}"))
+
+	keys := make([]string, 0, len(s.Fields))
+	for key := range s.Fields {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		name, err := encodeJSON(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := encodeJSON(s.Fields[key])
+		if err != nil {
+			return nil, err
+		}
+		out = append(append(append(append(out, ','), name...), ':'), value...)
+	}
+	return append(out, '}'), nil
+}
+
+// encodeJSON marshals v without escaping HTML, like Encode
+func encodeJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// ManifestCondition is the structured form of a Guard
+type ManifestCondition struct {
+	OS   []string `json:"os,omitempty"`
+	Arch []string `json:"arch,omitempty"`
+	Not  bool     `json:"not,omitempty"`
+}
+
+// IsManifest reports whether instruction data is a JSON manifest rather
+// than instruction text
+func IsManifest(data string) bool {
+	return strings.HasPrefix(strings.TrimSpace(data), "{")
+}
+
+// DecodeManifest reads a JSON manifest, rejecting unknown fields
+func DecodeManifest(data string) (*Manifest, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var m Manifest
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("invalid manifest: unexpected data after the manifest")
+	}
+	return &m, nil
+}
+
+// Encode returns the manifest as indented JSON
+func (m *Manifest) Encode() (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// diagnoseManifest compiles a JSON manifest, reporting problems per step
+func (p *Parser) diagnoseManifest(data string) (install, remove []Instruction, diags Diagnostics) {
+	r := &reporter{}
+	m, err := DecodeManifest(data)
+	if err != nil {
+		r.errorf(0, 0, "%v", err)
+		return nil, nil, r.diags
+	}
+
+	scope := newMacroScope()
+	install = p.compileSteps(m.Steps, "steps", scope, r)
+	remove = p.compileSteps(m.OnRemove, "on_remove", scope, r)
+	if len(install) == 0 && !r.diags.HasErrors() {
+		r.errorf(0, 0, "no valid instructions found")
+	}
+	return install, remove, r.diags
+}
+
+func (p *Parser) compileSteps(steps []ManifestStep, section string, scope *macroScope, r *reporter) []Instruction {
+	var instructions []Instruction
+	for i, step := range steps {
+		inc, err := step.instruction()
+		if err == nil {
+			err = inc.validate()
+		}
+		if err != nil {
+			r.errorf(0, 0, "%s[%d]: %v", section, i, err)
+			continue
+		}
+		inc.LineNumber = i + 1
+		inc.RawLine = inc.Format()
+
+		if inc.Token == USE && !p.KeepMacros {
+			sub := &reporter{}
+			body := p.expandUse(useFields(inc), i+1, inc.Guards, scope, sub)
+			for _, d := range sub.diags {
+				r.add(d.Severity, 0, 0, d.Suggestion, "%s[%d]: %s", section, i, d.Message)
+			}
+			instructions = append(instructions, body...)
+			continue
+		}
+		instructions = append(instructions, inc)
+	}
+	return instructions
+}
+
+// instruction compiles one step
+func (s ManifestStep) instruction() (Instruction, error) {
+	token := stringToToken(s.Command)
+	if token == INVALID {
+		if suggestion := suggestCommand(s.Command); suggestion != "" {
+			return Instruction{}, fmt.Errorf("invalid command '%s' (did you mean %s?)", s.Command, suggestion)
+		}
+		return Instruction{}, fmt.Errorf("invalid command '%s'", s.Command)
+	}
+
+	params := handlers[token].Params()
+	names := slices.Clone(stepFieldNames)
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		taken := slices.ContainsFunc(params, func(p Param) bool { return p.Name == name })
+		if s.field(name) != nil && !taken {
+			return Instruction{}, fmt.Errorf("%v does not take '%s'", token, name)
+		}
+	}
+
+	var args []string
+	for _, p := range params {
+		values := s.field(p.Name)
+		if len(values) == 0 {
+			if !p.Optional {
+				return Instruction{}, fmt.Errorf("%v requires '%s'", token, p.Name)
+			}
+			continue
+		}
+		for _, value := range values {
+			args = append(args, p.Prefix+value)
+		}
+	}
+
+	inc := Instruction{Token: token, Args: args}
+	for _, c := range s.When {
+		guard, err := c.guard()
+		if err != nil {
+			return Instruction{}, err
+		}
+		inc.Guards = append(inc.Guards, guard)
+	}
+	return inc, nil
+}
+
+// stepFieldNames are the argument fields of ManifestStep, by JSON name.
+// Parameters with other names are kept in Fields.
+var stepFieldNames = []string{"source", "dest", "path", "script", "args", "url", "sha256", "name", "value"}
+
+func (s ManifestStep) field(name string) []string {
+	var value string
+	switch name {
+	case "source":
+		value = s.Source
+	case "dest":
+		value = s.Dest
+	case "path":
+		value = s.Path
+	case "script":
+		value = s.Script
+	case "args":
+		return s.Args
+	case "url":
+		value = s.URL
+	case "sha256":
+		value = s.SHA256
+	case "name":
+		value = s.Name
+	case "value":
+		value = s.Value
+	default:
+		value = s.Fields[name]
+	}
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
+func (s *ManifestStep) setField(name, value string) {
+	switch name {
+	case "source":
+		s.Source = value
+	case "dest":
+		s.Dest = value
+	case "path":
+		s.Path = value
+	case "script":
+		s.Script = value
+	case "args":
+		s.Args = append(s.Args, value)
+	case "url":
+		s.URL = value
+	case "sha256":
+		s.SHA256 = value
+	case "name":
+		s.Name = value
+	case "value":
+		s.Value = value
+	default:
+		if s.Fields == nil {
+			s.Fields = make(map[string]string)
+		}
+		s.Fields[name] = value
+	}
+}
+
+func (c ManifestCondition) guard() (Guard, error) {
+	var terms []string
+	if len(c.OS) > 0 {
+		terms = append(terms, "OS="+strings.Join(c.OS, ","))
+	}
+	if len(c.Arch) > 0 {
+		terms = append(terms, "ARCH="+strings.Join(c.Arch, ","))
+	}
+	guard, err := parseGuard(terms)
+	if err != nil {
+		return Guard{}, fmt.Errorf("invalid condition: %w", err)
+	}
+	guard.Negate = c.Not
+	return guard, nil
+}
+
+// NewManifest builds the structured form of parsed instructions
+func NewManifest(install, remove []Instruction) *Manifest {
+	m := &Manifest{
+		Steps: manifestSteps(install),
+	}
+	if len(remove) > 0 {
+		m.OnRemove = manifestSteps(remove)
+	}
+	return m
+}
+
+func manifestSteps(instructions []Instruction) []ManifestStep {
+	steps := []ManifestStep{}
+	for _, inc := range instructions {
+		step := ManifestStep{Command: inc.Token.String()}
+		params, values := inc.boundArgs()
+		for i, p := range params {
+			for _, value := range values[i] {
+				step.setField(p.Name, strings.TrimPrefix(value, p.Prefix))
+			}
+		}
+
+		for _, g := range inc.Guards {
+			step.When = append(step.When, ManifestCondition{
+				OS:   g.Terms["OS"],
+				Arch: g.Terms["ARCH"],
+				Not:  g.Negate,
+			})
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// FormatText returns instructions as instruction text, with an ON_REMOVE
+// section when remove is not empty. Consecutive steps with the same platform
+// guards share an IF block; a lone step with one plain guard gets a line guard.
+func FormatText(install, remove []Instruction) string {
+	var b strings.Builder
+	writeInstructions(&b, install)
+	if len(remove) > 0 {
+		b.WriteString("\nON_REMOVE\n")
+		writeInstructions(&b, remove)
+	}
+	return b.String()
+}
+
+func writeInstructions(b *strings.Builder, instructions []Instruction) {
+	var open []Guard
+	indent := func() string { return strings.Repeat("  ", len(open)) }
+	closeTo := func(depth int) {
+		for len(open) > depth {
+			open = open[:len(open)-1]
+			fmt.Fprintf(b, "%sEND\n", indent())
+		}
+	}
+
+	for i, inc := range instructions {
+		guards := inc.Guards
+
+		if len(guards) == 1 && !guards[0].Negate && !sharesGuard(instructions, i+1, guards[0]) &&
+			(len(open) == 0 || open[0].terms() != guards[0].terms()) {
+			closeTo(0)
+			fmt.Fprintf(b, "[%s] %s\n", guards[0].terms(), inc.Format())
+			continue
+		}
+
+		k := 0
+		for k < len(open) && k < len(guards) && sameGuard(open[k], guards[k]) {
+			k++
+		}
+
+		// The other branch of the innermost open block
+		if k == len(open)-1 && k < len(guards) && !open[k].Negate && guards[k].Negate &&
+			open[k].terms() == guards[k].terms() {
+			open = open[:k]
+			fmt.Fprintf(b, "%sELSE\n", indent())
+			open = append(open, guards[k])
+			k++
+		} else {
+			closeTo(k)
+		}
+
+		for _, g := range guards[k:] {
+			fmt.Fprintf(b, "%sIF %s\n", indent(), g.terms())
+			if g.Negate {
+				fmt.Fprintf(b, "%sELSE\n", indent())
+			}
+			open = append(open, g)
+		}
+		fmt.Fprintf(b, "%s%s\n", indent(), inc.Format())
+	}
+	closeTo(0)
+}
+
+// sharesGuard reports whether the instruction at i starts with g or its ELSE
+func sharesGuard(instructions []Instruction, i int, g Guard) bool {
+	return i < len(instructions) && len(instructions[i].Guards) > 0 &&
+		instructions[i].Guards[0].terms() == g.terms()
+}
+
+func sameGuard(a, b Guard) bool {
+	return a.Negate == b.Negate && a.terms() == b.terms()
+}
@@ -3,10 +3,12 @@ package parser
 import (
 	"errors"
 	"fmt"
-	"jpm/lib"
 	"jpm/model"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"time"
 )
 
 type Token int
@@ -24,6 +26,13 @@ const (
 	ADD_TO_PATH
 	SET_LOCATION
 	RUN_SCRIPT
+	SET_ENV
+	APPEND_ENV
+	PREPEND_ENV
+	LINK_BIN
+	CONFIG
+	TEMPLATE
+	USE // a USE line kept unexpanded, see Parser.KeepMacros
 	INVALID
 )
 
@@ -40,6 +49,13 @@ var tokenMap = map[string]Token{
 	"ADD_TO_PATH":   ADD_TO_PATH,
 	"SET_LOCATION":  SET_LOCATION,
 	"RUN_SCRIPT":    RUN_SCRIPT,
+	"SET_ENV":       SET_ENV,
+	"APPEND_ENV":    APPEND_ENV,
+	"PREPEND_ENV":   PREPEND_ENV,
+	"LINK_BIN":      LINK_BIN,
+	"CONFIG":        CONFIG,
+	"TEMPLATE":      TEMPLATE,
+	"USE":           USE,
 }
 
 func stringToToken(tokenStr string) Token {
@@ -49,426 +65,503 @@ func stringToToken(tokenStr string) Token {
 	return INVALID
 }
 
+// String returns the instruction keyword for a token
+func (t Token) String() string {
+	for name, token := range tokenMap {
+		if token == t {
+			return name
+		}
+	}
+	return "INVALID"
+}
+
 // Instruction represents a parsed instruction with validation
 type Instruction struct {
 	Token      Token
 	Args       []string
 	RawLine    string
 	LineNumber int
+	Guards     []Guard // platform conditions from enclosing IF blocks and the line's own [guard]
+	Macro      string  // USE macro the instruction was expanded from, outermost first; "" when written out
 }
 
 // Validate checks if the instruction has valid arguments
 func (inc *Instruction) Validate() error {
-	switch inc.Token {
-	case EXTRACT, EXTRACT_TAR, EXTRACT_TAR_GZ:
-		if len(inc.Args) < 1 || len(inc.Args) > 2 {
-			return fmt.Errorf("line %d: EXTRACT requires 1-2 arguments (source [destination])", inc.LineNumber)
-		}
-	case ADD_TO_PATH, SET_LOCATION, DELETE, CHMOD:
-		if len(inc.Args) != 1 {
-			return fmt.Errorf("line %d: %v requires exactly 1 argument", inc.LineNumber, inc.Token)
-		}
-	case MOVE, COPY, RENAME:
-		if len(inc.Args) != 2 {
-			return fmt.Errorf("line %d: %v requires exactly 2 arguments (source destination)", inc.LineNumber, inc.Token)
-		}
-	case RUN_SCRIPT:
-		if len(inc.Args) < 1 {
-			return fmt.Errorf("line %d: RUN_SCRIPT requires at least 1 argument", inc.LineNumber)
-		}
+	if err := inc.validate(); err != nil {
+		return fmt.Errorf("line %d: %w", inc.LineNumber, err)
 	}
 	return nil
 }
 
-// Run executes the instruction and updates the installation model (backward compatibility)
-func (inc *Instruction) Run(ins *model.Installation, workDir string) error {
-	switch inc.Token {
-	case EXTRACT:
-		return inc.runExtract(workDir)
-	case EXTRACT_TAR:
-		return inc.runExtractTar(workDir, false)
-	case EXTRACT_TAR_GZ:
-		return inc.runExtractTar(workDir, true)
-	case ADD_TO_PATH:
-		return inc.runAddToPath(ins, workDir)
-	case SET_LOCATION:
-		return inc.runSetLocation(ins, workDir)
-	case DELETE:
-		return inc.runDelete(workDir)
-	case MOVE:
-		return inc.runMove(workDir)
-	case COPY:
-		return inc.runCopy(workDir)
-	case RENAME:
-		return inc.runRename(workDir)
-	case CHMOD:
-		return inc.runChmod(workDir)
-	default:
-		return fmt.Errorf("unimplemented instruction: %v", inc.Token)
-	}
+// argError is a validation error caused by one argument, so diagnostics
+// can point at its column
+type argError struct {
+	index int
+	err   error
 }
 
-// RunWithContext executes the instruction with full installation context tracking
-func (inc *Instruction) RunWithContext(ctx *model.InstallationContext, workDir string) error {
-	switch inc.Token {
-	case EXTRACT:
-		return inc.runExtractWithContext(ctx, workDir)
-	case EXTRACT_TAR:
-		return inc.runExtractTarWithContext(ctx, workDir, false)
-	case EXTRACT_TAR_GZ:
-		return inc.runExtractTarWithContext(ctx, workDir, true)
-	case ADD_TO_PATH:
-		return inc.runAddToPathWithContext(ctx, workDir)
-	case SET_LOCATION:
-		return inc.runSetLocationWithContext(ctx, workDir)
-	case DELETE:
-		return inc.runDeleteWithContext(ctx, workDir)
-	case MOVE:
-		return inc.runMoveWithContext(ctx, workDir)
-	case COPY:
-		return inc.runCopyWithContext(ctx, workDir)
-	case RENAME:
-		return inc.runRenameWithContext(ctx, workDir)
-	case CHMOD:
-		return inc.runChmodWithContext(ctx, workDir)
-	default:
-		return fmt.Errorf("unimplemented instruction: %v", inc.Token)
-	}
-}
+func (e *argError) Error() string { return e.err.Error() }
+func (e *argError) Unwrap() error { return e.err }
 
-// Legacy implementation methods (for backward compatibility)
-func (inc *Instruction) runExtract(workDir string) error {
-	source := filepath.Join(workDir, inc.Args[0])
-	dest := workDir
-	if len(inc.Args) > 1 {
-		dest = filepath.Join(workDir, inc.Args[1])
+func (inc *Instruction) validate() error {
+	for i, arg := range inc.Args {
+		if _, err := expandVars(arg, func(string) string { return "" }); err != nil {
+			return &argError{index: i, err: err}
+		}
 	}
 
-	_, err := lib.ExtractZip(source, dest)
-	if err != nil {
-		return fmt.Errorf("failed to extract %s: %w", source, err)
+	h, ok := handlers[inc.Token]
+	if !ok {
+		return fmt.Errorf("invalid command '%v'", inc.Token)
 	}
-
-	// Optionally delete the archive after extraction
-	if err := lib.Delete(source); err != nil {
-		fmt.Printf("Warning: failed to delete archive %s: %v\n", source, err)
+	if _, err := bind(inc.Token, h.Params(), inc.Args); err != nil {
+		return err
 	}
-	return nil
+	return h.Validate(inc.Args)
 }
 
-func (inc *Instruction) runExtractTar(workDir string, gzipped bool) error {
-	source := filepath.Join(workDir, inc.Args[0])
-	dest := workDir
-	if len(inc.Args) > 1 {
-		dest = filepath.Join(workDir, inc.Args[1])
-	}
+// Variables are the names that may be used as ${NAME} in instruction arguments
+var Variables = []string{"NAME", "VERSION", "OS", "ARCH", "EXE", "WORKDIR", "PREFIX"}
 
-	var err error
-	if gzipped {
-		_, err = lib.ExtractTarGz(source, dest)
-	} else {
-		_, err = lib.ExtractTar(source, dest)
+// variableValues resolves the instruction variables for an installation.
+// PREFIX is the location set by SET_LOCATION, or the work directory before that.
+func variableValues(ctx *model.InstallationContext, workDir string) map[string]string {
+	exe := ""
+	if runtime.GOOS == "windows" {
+		exe = ".exe"
 	}
 
-	if err != nil {
-		return fmt.Errorf("failed to extract tar %s: %w", source, err)
+	prefix := ctx.Installation.Location
+	if prefix == "" {
+		prefix = workDir
 	}
 
-	if err := lib.Delete(source); err != nil {
-		fmt.Printf("Warning: failed to delete archive %s: %v\n", source, err)
+	return map[string]string{
+		"NAME":    ctx.Installation.Name,
+		"VERSION": ctx.Installation.Version,
+		"OS":      runtime.GOOS,
+		"ARCH":    runtime.GOARCH,
+		"EXE":     exe,
+		"WORKDIR": workDir,
+		"PREFIX":  prefix,
 	}
-
-	return nil
 }
 
-func (inc *Instruction) runAddToPath(ins *model.Installation, workDir string) error {
-	pathToAdd := inc.Args[0]
-	if !filepath.IsAbs(pathToAdd) {
-		pathToAdd = filepath.Join(workDir, pathToAdd)
-	}
-
-	sysPath, err := lib.AddToPath(pathToAdd)
-	if err != nil {
-		return fmt.Errorf("failed to add to PATH: %w", err)
-	}
+// expandVars replaces each ${NAME} in s using value. Unknown names and
+// unterminated references are errors.
+func expandVars(s string, value func(name string) string) (string, error) {
+	var out strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			out.WriteString(s)
+			return out.String(), nil
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference in '%s'", s)
+		}
 
-	fmt.Printf("Added to PATH: %s\n", pathToAdd)
-	ins.SysPath = sysPath
-	return nil
-}
+		name := s[start+2 : start+end]
+		if !slices.Contains(Variables, name) {
+			return "", fmt.Errorf("unknown variable ${%s} (available: %s)", name, strings.Join(Variables, ", "))
+		}
 
-func (inc *Instruction) runSetLocation(ins *model.Installation, workDir string) error {
-	location := filepath.Join(workDir, inc.Args[0])
-	ins.Location = location
-	return nil
+		out.WriteString(s[:start])
+		out.WriteString(value(name))
+		s = s[start+end+1:]
+	}
 }
 
-func (inc *Instruction) runDelete(workDir string) error {
-	target := filepath.Join(workDir, inc.Args[0])
-	return lib.Delete(target)
-}
+// resolve returns a copy of the instruction with variables in its arguments expanded
+func (inc *Instruction) resolve(ctx *model.InstallationContext, workDir string) (*Instruction, error) {
+	values := variableValues(ctx, workDir)
 
-func (inc *Instruction) runMove(workDir string) error {
-	src := filepath.Join(workDir, inc.Args[0])
-	dst := filepath.Join(workDir, inc.Args[1])
-	return lib.Move(src, dst)
+	resolved := *inc
+	resolved.Args = make([]string, len(inc.Args))
+	for i, arg := range inc.Args {
+		expanded, err := expandVars(arg, func(name string) string { return values[name] })
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", inc.LineNumber, err)
+		}
+		resolved.Args[i] = expanded
+	}
+	return &resolved, nil
 }
 
-func (inc *Instruction) runCopy(workDir string) error {
-	src := filepath.Join(workDir, inc.Args[0])
-	dst := filepath.Join(workDir, inc.Args[1])
-	return lib.Copy(src, dst)
-}
+// Targets returns the paths the instruction will create or replace, as far
+// as they are known before it runs
+func (inc *Instruction) Targets(ctx *model.InstallationContext, workDir string) []string {
+	inc, err := inc.resolve(ctx, workDir)
+	if err != nil {
+		return nil
+	}
 
-func (inc *Instruction) runRename(workDir string) error {
-	return inc.runMove(workDir)
+	var targets []string
+	params, values := inc.boundArgs()
+	for i, p := range params {
+		if !p.Creates {
+			continue
+		}
+		for _, value := range values[i] {
+			targets = append(targets, filepath.Join(workDir, value))
+		}
+	}
+	return targets
 }
 
-func (inc *Instruction) runChmod(workDir string) error {
-	target := filepath.Join(workDir, inc.Args[0])
-	return lib.MakeExecutable(target)
+// Run executes the instruction and updates the installation model. It is
+// kept for backward compatibility; nothing it does is recorded for undo.
+func (inc *Instruction) Run(ins *model.Installation, workDir string) error {
+	return inc.RunWithContext(&model.InstallationContext{Installation: ins, WorkDir: workDir}, workDir)
 }
 
-// Context-aware implementation methods
-func (inc *Instruction) runExtractWithContext(ctx *model.InstallationContext, workDir string) error {
-	source := filepath.Join(workDir, inc.Args[0])
-	dest := workDir
-	if len(inc.Args) > 1 {
-		dest = filepath.Join(workDir, inc.Args[1])
+// RunWithContext executes the instruction with full installation context
+// tracking and adds a step to the context's trace
+func (inc *Instruction) RunWithContext(ctx *model.InstallationContext, workDir string) error {
+	step := model.TraceStep{
+		Step:    len(ctx.Trace) + 1,
+		RawLine: inc.RawLine,
+		Args:    inc.Args,
+		Status:  model.TraceSuccess,
+		RanAt:   time.Now(),
 	}
+	files := len(ctx.Files)
 
-	extractedPath, err := lib.ExtractZip(source, dest)
+	err := inc.run(ctx, workDir, &step)
+
+	step.Duration = time.Since(step.RanAt)
 	if err != nil {
-		return fmt.Errorf("failed to extract %s: %w", source, err)
+		step.Status = model.TraceFailed
+		step.Error = err.Error()
 	}
-
-	// Track extracted location
-	if ctx.ExtractedPath == "" {
-		ctx.ExtractedPath = extractedPath
+	for _, f := range ctx.Files[min(files, len(ctx.Files)):] {
+		step.Files = append(step.Files, f.FilePath)
 	}
+	ctx.Trace = append(ctx.Trace, step)
+	return err
+}
 
-	// Track the archive file
-	ctx.AddFile(source, "archive", false)
-
-	// Optionally delete the archive after extraction
-	if err := lib.Delete(source); err != nil {
-		fmt.Printf("Warning: failed to delete archive %s: %v\n", source, err)
-	}
-	return nil
+// Skip adds a skipped step to the context's trace without running the
+// instruction, for instructions guarded for another platform
+func (inc *Instruction) Skip(ctx *model.InstallationContext) {
+	ctx.Trace = append(ctx.Trace, model.TraceStep{
+		Step:    len(ctx.Trace) + 1,
+		RawLine: inc.RawLine,
+		Args:    inc.Args,
+		Status:  model.TraceSkipped,
+		RanAt:   time.Now(),
+	})
 }
 
-func (inc *Instruction) runExtractTarWithContext(ctx *model.InstallationContext, workDir string, gzipped bool) error {
-	source := filepath.Join(workDir, inc.Args[0])
-	dest := workDir
-	if len(inc.Args) > 1 {
-		dest = filepath.Join(workDir, inc.Args[1])
+func (inc *Instruction) run(ctx *model.InstallationContext, workDir string, step *model.TraceStep) error {
+	// Instructions guarded for another platform are no-ops
+	if !inc.AppliesHere() {
+		step.Status = model.TraceSkipped
+		return nil
 	}
 
-	var extractedPath string
-	var err error
-	if gzipped {
-		extractedPath, err = lib.ExtractTarGz(source, dest)
-	} else {
-		extractedPath, err = lib.ExtractTar(source, dest)
+	h, ok := handlers[inc.Token]
+	if !ok {
+		return fmt.Errorf("unimplemented instruction: %v", inc.Token)
 	}
 
+	inc, err := inc.resolve(ctx, workDir)
 	if err != nil {
-		return fmt.Errorf("failed to extract tar %s: %w", source, err)
-	}
-
-	// Track extracted location
-	if ctx.ExtractedPath == "" {
-		ctx.ExtractedPath = extractedPath
+		return err
 	}
-
-	// Track the archive file
-	ctx.AddFile(source, "archive", false)
-
-	if err := lib.Delete(source); err != nil {
-		fmt.Printf("Warning: failed to delete archive %s: %v\n", source, err)
+	step.Args = inc.Args
+	if err := inc.checkPaths(ctx, workDir); err != nil {
+		return err
 	}
-
-	return nil
+	return h.Run(ctx, workDir, inc.Args)
 }
 
-func (inc *Instruction) runAddToPathWithContext(ctx *model.InstallationContext, workDir string) error {
-	pathToAdd := inc.Args[0]
-	if !filepath.IsAbs(pathToAdd) {
-		pathToAdd = filepath.Join(workDir, pathToAdd)
-	}
-
-	sysPath, err := lib.AddToPath(pathToAdd)
-	if err != nil {
-		return fmt.Errorf("failed to add to PATH: %w", err)
-	}
+// Parser holds parsing state and configuration
+type Parser struct {
+	AllowComments bool
 
-	fmt.Printf("Added to PATH: %s\n", pathToAdd)
-	ctx.Installation.SysPath = sysPath
+	// StrictMode rejects unknown commands. Without it they are reported as
+	// warnings and the line is skipped, so instructions written for a newer
+	// jpm still parse.
+	StrictMode bool
 
-	// Track environment modification
-	ctx.AddEnvMod("path_addition", "PATH", sysPath, "")
+	// Macros resolves USE lines. Without it, USE is an error.
+	Macros MacroSource
 
-	return nil
+	// KeepMacros keeps each USE line as a USE instruction instead of
+	// expanding it, for converting and formatting instructions without the
+	// registry. Such instructions cannot run.
+	KeepMacros bool
 }
 
-func (inc *Instruction) runSetLocationWithContext(ctx *model.InstallationContext, workDir string) error {
-	location := filepath.Join(workDir, inc.Args[0])
-	ctx.Installation.Location = location
-	return nil
+// NewParser creates a new parser with default settings
+func NewParser() *Parser {
+	return &Parser{
+		AllowComments: true,
+		StrictMode:    true,
+	}
 }
 
-func (inc *Instruction) runDeleteWithContext(ctx *model.InstallationContext, workDir string) error {
-	target := filepath.Join(workDir, inc.Args[0])
-	return lib.Delete(target)
+// Parse parses instruction text into a list of validated instructions.
+// An ON_REMOVE section, if present, is validated but not returned.
+func (p *Parser) Parse(data string) ([]Instruction, error) {
+	install, _, err := p.ParseSections(data)
+	return install, err
 }
 
-func (inc *Instruction) runMoveWithContext(ctx *model.InstallationContext, workDir string) error {
-	src := filepath.Join(workDir, inc.Args[0])
-	dst := filepath.Join(workDir, inc.Args[1])
-
-	// Track the destination file
-	ctx.AddFile(dst, "moved", false)
-
-	return lib.Move(src, dst)
+// ParseSections parses instruction text into its install steps and the
+// steps of its optional ON_REMOVE section, which run when the package is
+// removed. The error joins every error found; warnings are dropped.
+func (p *Parser) ParseSections(data string) (install, remove []Instruction, err error) {
+	install, remove, diags := p.Diagnose(data)
+	if err := diags.Err(); err != nil {
+		return nil, nil, err
+	}
+	return install, remove, nil
 }
 
-func (inc *Instruction) runCopyWithContext(ctx *model.InstallationContext, workDir string) error {
-	src := filepath.Join(workDir, inc.Args[0])
-	dst := filepath.Join(workDir, inc.Args[1])
-
-	// Track the copied file
-	ctx.AddFile(dst, "copied", false)
+// Diagnose parses instruction text, or a JSON manifest, like ParseSections but keeps going after
+// a bad line, returning every error and warning with its position. The
+// instructions are only usable when the diagnostics hold no errors.
+func (p *Parser) Diagnose(data string) (install, remove []Instruction, diags Diagnostics) {
+	if IsManifest(data) {
+		return p.diagnoseManifest(data)
+	}
 
-	return lib.Copy(src, dst)
-}
+	r := &reporter{}
+	if strings.TrimSpace(data) == "" {
+		r.errorf(0, 0, "empty instruction set")
+		return nil, nil, r.diags
+	}
 
-func (inc *Instruction) runRenameWithContext(ctx *model.InstallationContext, workDir string) error {
-	return inc.runMoveWithContext(ctx, workDir)
-}
+	lines := strings.Split(data, "\n")
+	header, duplicates := findRemoveHeader(lines)
+	for _, dup := range duplicates {
+		r.errorf(dup+1, 1, "duplicate ON_REMOVE section (first on line %d)", header+1)
+	}
 
-func (inc *Instruction) runChmodWithContext(ctx *model.InstallationContext, workDir string) error {
-	target := filepath.Join(workDir, inc.Args[0])
+	installLines := lines
+	if header >= 0 {
+		installLines = lines[:header]
+	}
+	scope := newMacroScope()
+	install = p.parseLines(installLines, 0, r, scope)
+	if header >= 0 {
+		remove = p.parseLines(lines[header+1:], header+1, r, scope)
+	}
 
-	// Track as executable
-	ctx.AddFile(target, "binary", true)
+	if len(install) == 0 && !r.diags.HasErrors() {
+		r.errorf(0, 0, "no valid instructions found")
+	}
 
-	return lib.MakeExecutable(target)
+	r.diags.sort()
+	return install, remove, r.diags
 }
 
-// Parser holds parsing state and configuration
-type Parser struct {
-	AllowComments bool
-	StrictMode    bool
+// ParseRemove parses a stored ON_REMOVE section, as returned by RemoveSection.
+// An empty section is valid.
+func (p *Parser) ParseRemove(section string) ([]Instruction, error) {
+	r := &reporter{}
+	hooks := p.parseLines(strings.Split(section, "\n"), 0, r, newMacroScope())
+	if err := r.diags.Err(); err != nil {
+		return nil, err
+	}
+	return hooks, nil
 }
 
-// NewParser creates a new parser with default settings
-func NewParser() *Parser {
-	return &Parser{
-		AllowComments: true,
-		StrictMode:    true,
+// RemoveSection returns the text of the ON_REMOVE section, or "" when there
+// is none. For a JSON manifest, the on_remove steps are returned as text.
+func RemoveSection(data string) string {
+	if IsManifest(data) {
+		_, remove, diags := NewParser().diagnoseManifest(data)
+		if diags.HasErrors() || len(remove) == 0 {
+			return ""
+		}
+		return FormatText(remove, nil)
 	}
+
+	lines := strings.Split(data, "\n")
+	header, duplicates := findRemoveHeader(lines)
+	if header < 0 || len(duplicates) > 0 {
+		return ""
+	}
+	return strings.Join(lines[header+1:], "\n")
 }
 
-// Parse parses instruction text into a list of validated instructions
-func (p *Parser) Parse(data string) ([]Instruction, error) {
-	if strings.TrimSpace(data) == "" {
-		return nil, errors.New("empty instruction set")
+// findRemoveHeader returns the index of the first ON_REMOVE line, or -1,
+// and the indexes of any further ones
+func findRemoveHeader(lines []string) (header int, duplicates []int) {
+	header = -1
+	for i, line := range lines {
+		line = strings.TrimSuffix(strings.TrimSpace(line), ":")
+		if !strings.EqualFold(line, "ON_REMOVE") {
+			continue
+		}
+		if header >= 0 {
+			duplicates = append(duplicates, i)
+			continue
+		}
+		header = i
 	}
+	return header, duplicates
+}
 
-	lines := strings.Split(data, "\n")
+// parseLines parses and validates instruction lines, reporting problems to
+// r and leaving bad lines out; offset is the number of lines before them in
+// the original text, for line numbers in diagnostics. scope is the USE
+// expansion the lines belong to.
+func (p *Parser) parseLines(lines []string, offset int, r *reporter, scope *macroScope) []Instruction {
 	var instructions []Instruction
+	var blocks blockStack
+	locationLine := 0
+
+	lx := &lexer{
+		lines:    lines,
+		offset:   offset,
+		comments: p.AllowComments,
+		params:   scope.params,
+		report: func(line, col int, sev Severity, msg string) {
+			r.add(sev, line, col, "", "%s", msg)
+		},
+	}
 
-	for lineNum, line := range lines {
-		line = strings.TrimSpace(line)
+	for i := 0; i < len(lines); {
+		lineNum := offset + i + 1
+		raw := lines[i]
+		line := strings.TrimSpace(raw)
 
 		// Skip empty lines and comments
 		if line == "" || (p.AllowComments && strings.HasPrefix(line, "#")) {
+			i++
 			continue
 		}
+		col := columnOf(raw, line)
 
-		instruction, err := p.parseLine(line, lineNum+1)
+		lineGuard, rest, err := splitLineGuard(line)
 		if err != nil {
-			return nil, err
+			r.errorf(lineNum, col, "%v", err)
+			i++
+			continue
 		}
 
-		if err := instruction.Validate(); err != nil {
-			return nil, err
+		ll, ok := lx.lex(i, col-1+columnOf(line, rest)-1)
+		i = ll.next
+		if !ok {
+			continue
+		}
+		fields := ll.fields
+		if len(fields) == 0 {
+			r.errorf(lineNum, col, "empty instruction")
+			continue
+		}
+		command := fields[0]
+
+		// Platform blocks: IF <KEY=value...> / ELSE / END
+		if handled, err := p.parseBlock(&blocks, fields, lineNum); handled {
+			if lineGuard != nil {
+				r.errorf(lineNum, col, "a line guard cannot be applied to %s", strings.ToUpper(command.text))
+			} else if err != nil {
+				r.errorf(command.line, command.col, "%v", err)
+			}
+			continue
+		}
+
+		// USE <macro> name=value...
+		if strings.EqualFold(command.text, "USE") && !p.KeepMacros {
+			guards := blocks.current()
+			if lineGuard != nil {
+				guards = append(guards, *lineGuard)
+			}
+			instructions = append(instructions, p.expandUse(fields, lineNum, guards, scope, r)...)
+			continue
+		}
+
+		instruction, ok := p.parseLine(fields, lineNum, r)
+		if !ok {
+			continue
+		}
+		instruction.RawLine = ll.text
+		instruction.Guards = blocks.current()
+		if lineGuard != nil {
+			instruction.Guards = append(instruction.Guards, *lineGuard)
+		}
+
+		if err := instruction.validate(); err != nil {
+			at := command
+			var argErr *argError
+			if errors.As(err, &argErr) {
+				at = fields[argErr.index+1]
+			}
+			r.errorf(at.line, at.col, "%v", err)
+			continue
+		}
+
+		if instruction.Token == SET_LOCATION {
+			if locationLine > 0 && len(instruction.Guards) == 0 {
+				r.warnf(command.line, command.col, "SET_LOCATION overrides the location set on line %d", locationLine)
+			}
+			locationLine = lineNum
 		}
 
 		instructions = append(instructions, instruction)
 	}
 
-	if len(instructions) == 0 {
-		return nil, errors.New("no valid instructions found")
+	for _, line := range blocks.lines {
+		r.errorf(line, 0, "IF without END")
 	}
 
-	return instructions, nil
+	return instructions
 }
 
-// parseLine parses a single instruction line
-func (p *Parser) parseLine(line string, lineNum int) (Instruction, error) {
-	// Handle quoted arguments (e.g., paths with spaces)
-	parts := p.smartSplit(line)
+// parseBlock handles IF, ELSE and END lines, reporting whether the line was one
+func (p *Parser) parseBlock(blocks *blockStack, fields []field, lineNum int) (bool, error) {
+	args := fieldTexts(fields[1:])
 
-	if len(parts) < 1 {
-		return Instruction{}, fmt.Errorf("line %d: empty instruction", lineNum)
+	switch strings.ToUpper(fields[0].text) {
+	case "IF":
+		guard, err := parseGuard(args)
+		if err != nil {
+			return true, err
+		}
+		blocks.push(guard, lineNum)
+	case "ELSE":
+		if len(args) > 0 {
+			return true, fmt.Errorf("ELSE takes no arguments")
+		}
+		return true, blocks.flip()
+	case "END":
+		if len(args) > 0 {
+			return true, fmt.Errorf("END takes no arguments")
+		}
+		return true, blocks.pop()
+	default:
+		return false, nil
 	}
+	return true, nil
+}
 
-	token := stringToToken(parts[0])
+// parseLine turns the words of a line into an instruction. Unknown
+// commands are errors in strict mode and skipped with a warning otherwise.
+func (p *Parser) parseLine(fields []field, lineNum int, r *reporter) (Instruction, bool) {
+	command := fields[0]
+	token := stringToToken(command.text)
 	if token == INVALID {
-		return Instruction{}, fmt.Errorf("line %d: invalid command '%s'", lineNum, parts[0])
+		sev := SeverityError
+		msg := fmt.Sprintf("invalid command '%s'", command.text)
+		if !p.StrictMode {
+			sev = SeverityWarning
+			msg = fmt.Sprintf("unknown command '%s', line skipped", command.text)
+		}
+		r.add(sev, command.line, command.col, suggestCommand(command.text), "%s", msg)
+		return Instruction{}, false
 	}
 
 	return Instruction{
 		Token:      token,
-		Args:       parts[1:],
-		RawLine:    line,
+		Args:       fieldTexts(fields[1:]),
 		LineNumber: lineNum,
-	}, nil
-}
-
-// smartSplit splits a line while respecting quoted strings
-func (p *Parser) smartSplit(line string) []string {
-	var parts []string
-	var current strings.Builder
-	inQuotes := false
-	quoteChar := rune(0)
-
-	runes := []rune(line)
-	for i := 0; i < len(runes); i++ {
-		ch := runes[i]
-
-		switch {
-		case (ch == '"' || ch == '\'') && !inQuotes && (i == 0 || runes[i-1] == ' '):
-			// Start of quoted string (only at word boundaries)
-			inQuotes = true
-			quoteChar = ch
-		case ch == quoteChar && inQuotes:
-			// End of quoted string
-			inQuotes = false
-			quoteChar = 0
-		case ch == ' ' && !inQuotes:
-			// Word separator outside quotes
-			if current.Len() > 0 {
-				parts = append(parts, current.String())
-				current.Reset()
-			}
-		default:
-			// Regular character (including backslashes)
-			current.WriteRune(ch)
-		}
-	}
-
-	if current.Len() > 0 {
-		parts = append(parts, current.String())
-	}
-
-	// If we ended with unclosed quotes, return error indication
-	if inQuotes && len(parts) == 0 {
-		return []string{line}
-	}
-
-	return parts
+	}, true
 }
 
 // Convenience function for backward compatibility
@@ -1,73 +1,89 @@
 package parser
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"jpm/config"
+	"jpm/lib"
+	"jpm/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
-func TestParserBasicInstructions(t *testing.T) {
-	tests := []struct {
-		name        string
-		input       string
-		wantLen     int
-		wantTokens  []Token
-		shouldError bool
-	}{
-		{
-			name:       "Simple extract and add to path",
-			input:      "EXTRACT main.zip\nADD_TO_PATH main",
-			wantLen:    2,
-			wantTokens: []Token{EXTRACT, ADD_TO_PATH},
-		},
-		{
-			name:       "Extract with destination",
-			input:      "EXTRACT main.zip extracted/",
-			wantLen:    1,
-			wantTokens: []Token{EXTRACT},
-		},
-		{
-			name:       "Multiple extracts",
-			input:      "EXTRACT app.zip\nEXTRACT libs.zip libs/\nEXTRACT data.zip data/",
-			wantLen:    3,
-			wantTokens: []Token{EXTRACT, EXTRACT, EXTRACT},
-		},
-		{
-			name:        "Empty input",
-			input:       "",
-			shouldError: true,
-		},
-		{
-			name:        "Invalid command",
-			input:       "INVALID_CMD arg",
-			shouldError: true,
-		},
-		{
-			name:       "Comments and empty lines",
-			input:      "# This is a comment\nEXTRACT app.zip\n\n# Another comment\nADD_TO_PATH bin",
-			wantLen:    2,
-			wantTokens: []Token{EXTRACT, ADD_TO_PATH},
-		},
-		{
-			name:       "Tar archives",
-			input:      "EXTRACT_TAR app.tar\nEXTRACT_TARGZ lib.tar.gz libs/",
-			wantLen:    2,
-			wantTokens: []Token{EXTRACT_TAR, EXTRACT_TAR_GZ},
-		},
-		{
-			name:       "File operations",
-			input:      "MOVE temp/app bin/app\nCOPY config.txt backup/config.txt\nDELETE temp/",
-			wantLen:    3,
-			wantTokens: []Token{MOVE, COPY, DELETE},
-		},
-		{
-			name:       "Make executable",
-			input:      "EXTRACT app.zip\nCHMOD app/binary",
-			wantLen:    2,
-			wantTokens: []Token{EXTRACT, CHMOD},
-		},
-	}
+var basicInstructionTests = []struct {
+	name        string
+	input       string
+	wantLen     int
+	wantTokens  []Token
+	shouldError bool
+}{
+	{
+		name:       "Simple extract and add to path",
+		input:      "EXTRACT main.zip\nADD_TO_PATH main",
+		wantLen:    2,
+		wantTokens: []Token{EXTRACT, ADD_TO_PATH},
+	},
+	{
+		name:       "Extract with destination",
+		input:      "EXTRACT main.zip extracted/",
+		wantLen:    1,
+		wantTokens: []Token{EXTRACT},
+	},
+	{
+		name:       "Multiple extracts",
+		input:      "EXTRACT app.zip\nEXTRACT libs.zip libs/\nEXTRACT data.zip data/",
+		wantLen:    3,
+		wantTokens: []Token{EXTRACT, EXTRACT, EXTRACT},
+	},
+	{
+		name:        "Empty input",
+		input:       "",
+		shouldError: true,
+	},
+	{
+		name:        "Invalid command",
+		input:       "INVALID_CMD arg",
+		shouldError: true,
+	},
+	{
+		name:       "Comments and empty lines",
+		input:      "# This is a comment\nEXTRACT app.zip\n\n# Another comment\nADD_TO_PATH bin",
+		wantLen:    2,
+		wantTokens: []Token{EXTRACT, ADD_TO_PATH},
+	},
+	{
+		name:       "Tar archives",
+		input:      "EXTRACT_TAR app.tar\nEXTRACT_TARGZ lib.tar.gz libs/",
+		wantLen:    2,
+		wantTokens: []Token{EXTRACT_TAR, EXTRACT_TAR_GZ},
+	},
+	{
+		name:       "File operations",
+		input:      "MOVE temp/app bin/app\nCOPY config.txt backup/config.txt\nDELETE temp/",
+		wantLen:    3,
+		wantTokens: []Token{MOVE, COPY, DELETE},
+	},
+	{
+		name:       "Make executable",
+		input:      "EXTRACT app.zip\nCHMOD app/binary",
+		wantLen:    2,
+		wantTokens: []Token{EXTRACT, CHMOD},
+	},
+}
 
+func TestParserBasicInstructions(t *testing.T) {
 	parser := NewParser()
-	for _, tt := range tests {
+	for _, tt := range basicInstructionTests {
 		t.Run(tt.name, func(t *testing.T) {
 			instructions, err := parser.Parse(tt.input)
 
@@ -97,46 +113,46 @@ func TestParserBasicInstructions(t *testing.T) {
 	}
 }
 
-func TestParserQuotedArguments(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    string
-		wantArgs [][]string
-	}{
-		{
-			name:     "Quoted path with spaces",
-			input:    `MOVE "Program Files/app" bin/app`,
-			wantArgs: [][]string{{"Program Files/app", "bin/app"}},
-		},
-		{
-			name:     "Single quotes",
-			input:    `COPY 'my file.txt' 'backup/my file.txt'`,
-			wantArgs: [][]string{{"my file.txt", "backup/my file.txt"}},
-		},
-		{
-			name:     "Mixed quotes",
-			input:    `EXTRACT "my archive.zip" 'output folder'`,
-			wantArgs: [][]string{{"my archive.zip", "output folder"}},
-		},
-		{
-			name:     "Windows paths without spaces",
-			input:    `MOVE app\bin\program.exe dest\program.exe`,
-			wantArgs: [][]string{{`app\bin\program.exe`, `dest\program.exe`}},
-		},
-		{
-			name:     "Windows paths with spaces (quoted)",
-			input:    `MOVE "C:\Program Files\app.exe" "D:\My Apps\app.exe"`,
-			wantArgs: [][]string{{`C:\Program Files\app.exe`, `D:\My Apps\app.exe`}},
-		},
-		{
-			name:     "Mixed forward and backward slashes",
-			input:    `COPY app/bin\file.txt backup\app/file.txt`,
-			wantArgs: [][]string{{`app/bin\file.txt`, `backup\app/file.txt`}},
-		},
-	}
+var quotedArgumentTests = []struct {
+	name     string
+	input    string
+	wantArgs [][]string
+}{
+	{
+		name:     "Quoted path with spaces",
+		input:    `MOVE "Program Files/app" bin/app`,
+		wantArgs: [][]string{{"Program Files/app", "bin/app"}},
+	},
+	{
+		name:     "Single quotes",
+		input:    `COPY 'my file.txt' 'backup/my file.txt'`,
+		wantArgs: [][]string{{"my file.txt", "backup/my file.txt"}},
+	},
+	{
+		name:     "Mixed quotes",
+		input:    `EXTRACT "my archive.zip" 'output folder'`,
+		wantArgs: [][]string{{"my archive.zip", "output folder"}},
+	},
+	{
+		name:     "Windows paths without spaces",
+		input:    `MOVE app\bin\program.exe dest\program.exe`,
+		wantArgs: [][]string{{`app\bin\program.exe`, `dest\program.exe`}},
+	},
+	{
+		name:     "Windows paths with spaces (quoted)",
+		input:    `MOVE "C:\Program Files\app.exe" "D:\My Apps\app.exe"`,
+		wantArgs: [][]string{{`C:\Program Files\app.exe`, `D:\My Apps\app.exe`}},
+	},
+	{
+		name:     "Mixed forward and backward slashes",
+		input:    `COPY app/bin\file.txt backup\app/file.txt`,
+		wantArgs: [][]string{{`app/bin\file.txt`, `backup\app/file.txt`}},
+	},
+}
 
+func TestParserQuotedArguments(t *testing.T) {
 	parser := NewParser()
-	for _, tt := range tests {
+	for _, tt := range quotedArgumentTests {
 		t.Run(tt.name, func(t *testing.T) {
 			instructions, err := parser.Parse(tt.input)
 			if err != nil {
@@ -208,6 +224,36 @@ func TestParserValidation(t *testing.T) {
 			input:       "EXTRACT app.zip extracted/",
 			shouldError: false,
 		},
+		{
+			name:        "SET_ENV without value",
+			input:       "SET_ENV JAVA_HOME",
+			shouldError: true,
+		},
+		{
+			name:        "SET_ENV with invalid name",
+			input:       "SET_ENV JAVA-HOME /opt/java",
+			shouldError: true,
+		},
+		{
+			name:        "APPEND_ENV to PATH",
+			input:       "APPEND_ENV PATH bin",
+			shouldError: true,
+		},
+		{
+			name:        "Valid PREPEND_ENV",
+			input:       "PREPEND_ENV MANPATH ${PREFIX}/share/man",
+			shouldError: false,
+		},
+		{
+			name:        "LINK_BIN with a path as name",
+			input:       "LINK_BIN tool/bin/tool bin/tool",
+			shouldError: true,
+		},
+		{
+			name:        "Valid LINK_BIN with name",
+			input:       "LINK_BIN tool/bin/tool${EXE} tool",
+			shouldError: false,
+		},
 	}
 
 	parser := NewParser()
@@ -226,14 +272,13 @@ func TestParserValidation(t *testing.T) {
 	}
 }
 
-func TestParserComplexScenarios(t *testing.T) {
-	tests := []struct {
-		name  string
-		input string
-	}{
-		{
-			name: "Complete installation flow",
-			input: `# Download and extract main application
+var complexScenarioTests = []struct {
+	name  string
+	input string
+}{
+	{
+		name: "Complete installation flow",
+		input: `# Download and extract main application
 EXTRACT app-v1.2.3.zip
 CHMOD app/bin/myapp
 
@@ -249,10 +294,10 @@ ADD_TO_PATH /opt/myapp/bin
 
 # Cleanup
 DELETE libs.tar.gz`,
-		},
-		{
-			name: "Multi-component application",
-			input: `EXTRACT frontend.zip
+	},
+	{
+		name: "Multi-component application",
+		input: `EXTRACT frontend.zip
 EXTRACT backend.zip
 EXTRACT_TAR database.tar
 MOVE frontend/ app/frontend
@@ -261,17 +306,18 @@ MOVE database/ app/db
 ADD_TO_PATH app/backend/bin
 CHMOD app/backend/bin/server
 SET_LOCATION app/`,
-		},
-		{
-			name: "Windows-style paths",
-			input: `EXTRACT app.zip
+	},
+	{
+		name: "Windows-style paths",
+		input: `EXTRACT app.zip
 MOVE app\bin\program.exe "C:\Program Files\MyApp\program.exe"
 ADD_TO_PATH "C:\Program Files\MyApp"`,
-		},
-	}
+	},
+}
 
+func TestParserComplexScenarios(t *testing.T) {
 	parser := NewParser()
-	for _, tt := range tests {
+	for _, tt := range complexScenarioTests {
 		t.Run(tt.name, func(t *testing.T) {
 			instructions, err := parser.Parse(tt.input)
 			if err != nil {
@@ -360,6 +406,243 @@ func TestInstructionRun(t *testing.T) {
 	// - Cleanup
 }
 
+func TestRunScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell script")
+	}
+	t.Setenv("JPM_ALLOW_SCRIPTS", "true")
+	t.Setenv("JPM_TEST_SECRET", "leaked")
+
+	workDir := t.TempDir()
+	script := "#!/bin/sh\necho \"$JPM_PACKAGE $JPM_VERSION $1\"\necho \"secret=$JPM_TEST_SECRET\" >&2\n"
+	if err := os.WriteFile(filepath.Join(workDir, "setup.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := model.NewInstallationContext("tool", "1.2.3", workDir)
+	inc := Instruction{Token: RUN_SCRIPT, Args: []string{"setup.sh", "hello"}}
+	if err := inc.RunWithContext(ctx, workDir); err != nil {
+		t.Fatalf("RUN_SCRIPT: %v", err)
+	}
+	if len(ctx.Scripts) != 1 {
+		t.Fatalf("got %d recorded script runs, want 1", len(ctx.Scripts))
+	}
+	if got := ctx.Scripts[0].Stdout; got != "tool 1.2.3 hello\n" {
+		t.Errorf("stdout: got %q", got)
+	}
+	if got := ctx.Scripts[0].Stderr; got != "secret=\n" {
+		t.Errorf("environment not filtered, stderr: %q", got)
+	}
+
+	// Timeouts
+	if err := os.WriteFile(filepath.Join(workDir, "slow.sh"), []byte("exec sleep 5\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx.ScriptTimeout = 100 * time.Millisecond
+	slow := Instruction{Token: RUN_SCRIPT, Args: []string{"slow.sh"}}
+	if err := slow.RunWithContext(ctx, workDir); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	// Scripts outside the work directory and forbidden scripts are refused
+	escape := Instruction{Token: RUN_SCRIPT, Args: []string{"../setup.sh"}}
+	if err := escape.RunWithContext(ctx, workDir); err == nil {
+		t.Errorf("expected script outside the work directory to be refused")
+	}
+	ctx.ForbidScripts = true
+	if err := inc.RunWithContext(ctx, workDir); err == nil {
+		t.Errorf("expected script to be refused by policy")
+	}
+
+	// A staged rebuild does not run scripts again
+	staged := model.NewInstallationContext("tool", "1.2.3", workDir)
+	staged.Staging = true
+	if err := inc.RunWithContext(staged, workDir); err != nil || len(staged.Scripts) != 0 {
+		t.Errorf("script ran while staging: %v, %d run(s)", err, len(staged.Scripts))
+	}
+}
+
+func TestDownload(t *testing.T) {
+	const body = "complete -W 'run build' tool\n"
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(body)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	parse := func(line string) Instruction {
+		t.Helper()
+		instructions, err := Parse(line)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", line, err)
+		}
+		return instructions[0]
+	}
+
+	if _, err := Parse("DOWNLOAD " + server.URL + "/tool.bash completions/"); err == nil {
+		t.Errorf("expected DOWNLOAD without a checksum to be rejected")
+	}
+
+	workDir := t.TempDir()
+	ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+
+	inc := parse("DOWNLOAD " + server.URL + "/tool.bash completions/ sha256=" + sum)
+	if err := inc.RunWithContext(ctx, workDir); err != nil {
+		t.Fatalf("DOWNLOAD: %v", err)
+	}
+	want := filepath.Join(workDir, "completions", "tool.bash")
+	if data, err := os.ReadFile(want); err != nil || string(data) != body {
+		t.Fatalf("downloaded file: %q, %v", data, err)
+	}
+	if len(ctx.Files) != 1 || ctx.Files[0].FilePath != want {
+		t.Errorf("tracked files: %+v", ctx.Files)
+	}
+
+	bad := parse("DOWNLOAD " + server.URL + "/tool.fish sha256=" + strings.Repeat("0", 64))
+	if err := bad.RunWithContext(ctx, workDir); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "tool.fish")); !os.IsNotExist(err) {
+		t.Errorf("file with a bad checksum was kept")
+	}
+}
+
+func TestVariableInterpolation(t *testing.T) {
+	if _, err := Parse("MOVE tool-${VERSION}/tool bin/tool${EXE}"); err != nil {
+		t.Fatalf("known variables rejected: %v", err)
+	}
+	for _, input := range []string{"MOVE tool-${RELEASE}/tool bin/tool", "CHMOD bin/${NAME"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("Parse(%q): expected error", input)
+		}
+	}
+
+	workDir := t.TempDir()
+	ctx := model.NewInstallationContext("tool", "1.2.3", workDir)
+	inc := Instruction{Token: MOVE, Args: []string{"tool-${VERSION}-${OS}-${ARCH}/tool${EXE}", "${NAME}/bin"}}
+
+	resolved, err := inc.resolve(ctx, workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exe := ""
+	if runtime.GOOS == "windows" {
+		exe = ".exe"
+	}
+	want := "tool-1.2.3-" + runtime.GOOS + "-" + runtime.GOARCH + "/tool" + exe
+	if resolved.Args[0] != want || resolved.Args[1] != "tool/bin" {
+		t.Errorf("got %q, want [%q %q]", resolved.Args, want, "tool/bin")
+	}
+	if inc.Args[0] != "tool-${VERSION}-${OS}-${ARCH}/tool${EXE}" {
+		t.Errorf("resolve modified the original instruction")
+	}
+
+	location := Instruction{Token: SET_LOCATION, Args: []string{"${PREFIX}"}}
+	resolved, _ = location.resolve(ctx, workDir)
+	if resolved.Args[0] != workDir {
+		t.Errorf("PREFIX before SET_LOCATION: got %q, want %q", resolved.Args[0], workDir)
+	}
+}
+
+func TestParserConditionals(t *testing.T) {
+	input := `EXTRACT tool.zip
+IF OS=linux,darwin
+  CHMOD tool/bin/tool
+  IF ARCH=arm64
+    MOVE tool/lib-arm64 tool/lib
+  END
+ELSE
+  RENAME tool/bin/tool tool/bin/tool.exe
+END
+[os=windows] ADD_TO_PATH tool/bin`
+
+	instructions, err := Parse(input)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(instructions) != 5 {
+		t.Fatalf("got %d instructions, want 5", len(instructions))
+	}
+
+	platforms := []struct {
+		goos, goarch string
+		want         []Token
+	}{
+		{"linux", "amd64", []Token{EXTRACT, CHMOD}},
+		{"darwin", "arm64", []Token{EXTRACT, CHMOD, MOVE}},
+		{"windows", "amd64", []Token{EXTRACT, RENAME, ADD_TO_PATH}},
+	}
+	for _, pl := range platforms {
+		var got []Token
+		for _, inc := range instructions {
+			if inc.Applies(pl.goos, pl.goarch) {
+				got = append(got, inc.Token)
+			}
+		}
+		if !slices.Equal(got, pl.want) {
+			t.Errorf("%s/%s: got %v, want %v", pl.goos, pl.goarch, got, pl.want)
+		}
+	}
+
+	invalid := []string{
+		"IF OS=linux\nCHMOD a",
+		"CHMOD a\nEND",
+		"CHMOD a\nELSE\nEND",
+		"IF OS=linux\nCHMOD a\nELSE\nCHMOD b\nELSE\nCHMOD c\nEND",
+		"IF\nCHMOD a\nEND",
+		"IF DISTRO=debian\nCHMOD a\nEND",
+		"[os=linux CHMOD a",
+		"[os=linux]",
+	}
+	for _, input := range invalid {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("Parse(%q): expected error", input)
+		}
+	}
+}
+
+func TestParserRemoveSection(t *testing.T) {
+	input := `EXTRACT tool.zip
+ADD_TO_PATH tool/bin
+
+ON_REMOVE
+RUN_SCRIPT tool/uninstall.sh
+[os=windows] DELETE tool/cache`
+
+	install, remove, err := NewParser().ParseSections(input)
+	if err != nil {
+		t.Fatalf("ParseSections: %v", err)
+	}
+	if len(install) != 2 || len(remove) != 2 {
+		t.Fatalf("got %d install and %d remove steps, want 2 and 2", len(install), len(remove))
+	}
+	if remove[0].Token != RUN_SCRIPT || remove[0].LineNumber != 5 {
+		t.Errorf("first remove step: %v on line %d", remove[0].Token, remove[0].LineNumber)
+	}
+
+	// The stored section parses back to the same steps
+	stored, err := NewParser().ParseRemove(RemoveSection(input))
+	if err != nil || len(stored) != 2 || stored[1].RawLine != "[os=windows] DELETE tool/cache" {
+		t.Errorf("ParseRemove(RemoveSection()): %+v, %v", stored, err)
+	}
+	if RemoveSection("EXTRACT tool.zip") != "" {
+		t.Errorf("expected no remove section")
+	}
+
+	invalid := []string{
+		"ON_REMOVE\nDELETE tool",
+		"EXTRACT tool.zip\nON_REMOVE\nDELETE a\nON_REMOVE\nDELETE b",
+		"EXTRACT tool.zip\nIF OS=linux\nON_REMOVE\nDELETE a\nEND",
+		"EXTRACT tool.zip\nON_REMOVE\nBOGUS a",
+	}
+	for _, input := range invalid {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("Parse(%q): expected error", input)
+		}
+	}
+}
+
 func BenchmarkParser(b *testing.B) {
 	input := `# Installation instructions
 EXTRACT app.zip
@@ -377,3 +660,1171 @@ DELETE temp/`
 		_, _ = parser.Parse(input)
 	}
 }
+
+func TestUndoLog(t *testing.T) {
+	workDir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(workDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(workDir, name))
+		if err != nil {
+			return "<missing>"
+		}
+		return string(data)
+	}
+
+	write("tool", "new binary")
+	write("settings.conf", "user settings")
+	write("notes.txt", "user notes")
+
+	ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+	ctx.BackupDir = filepath.Join(t.TempDir(), "backup")
+	steps := []Instruction{
+		{Token: COPY, Args: []string{"tool", "tool-copy"}},
+		{Token: COPY, Args: []string{"tool", "settings.conf"}},
+		{Token: DELETE, Args: []string{"notes.txt"}},
+	}
+	for _, inc := range steps {
+		if err := inc.RunWithContext(ctx, workDir); err != nil {
+			t.Fatalf("%v: %v", inc.Args, err)
+		}
+	}
+
+	kinds := make([]string, len(ctx.Undo))
+	for i, rec := range ctx.Undo {
+		kinds[i] = rec.Kind
+	}
+	want := []string{model.UndoCreated, model.UndoBackup, model.UndoBackup}
+	if !slices.Equal(kinds, want) {
+		t.Fatalf("undo kinds: got %v, want %v", kinds, want)
+	}
+
+	if err := lib.ReplayUndo(ctx.Undo, false); err != nil {
+		t.Fatalf("ReplayUndo: %v", err)
+	}
+	if got := read("tool-copy"); got != "<missing>" {
+		t.Errorf("created file not removed: %q", got)
+	}
+	if got := read("settings.conf"); got != "user settings" {
+		t.Errorf("overwritten file not restored: %q", got)
+	}
+	if got := read("notes.txt"); got != "user notes" {
+		t.Errorf("deleted file not restored: %q", got)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	workDir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(workDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(workDir, name))
+		if err != nil {
+			return "<missing>"
+		}
+		return string(data)
+	}
+	conf := filepath.Join(workDir, "app.conf")
+
+	// install runs CONFIG with the manifest of the previous install
+	install := func(recorded []model.InstalledFile) *model.InstallationContext {
+		t.Helper()
+		ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+		ctx.OwnersOf = func(path string) ([]model.FileOwner, error) {
+			var owners []model.FileOwner
+			for _, f := range recorded {
+				if f.FilePath == path {
+					owners = append(owners, model.FileOwner{PackageName: "tool", File: f})
+				}
+			}
+			return owners, nil
+		}
+		inc := Instruction{Token: CONFIG, Args: []string{"app.conf.default", "app.conf"}}
+		if err := inc.RunWithContext(ctx, workDir); err != nil {
+			t.Fatal(err)
+		}
+		return ctx
+	}
+
+	write("app.conf.default", "v1")
+	ctx := install(nil)
+	if got := read("app.conf"); got != "v1" {
+		t.Fatalf("fresh install: got %q", got)
+	}
+	recorded := ctx.Files
+	if len(recorded) != 1 || recorded[0].FileType != "user_config" || recorded[0].SHA256 == "" {
+		t.Fatalf("config not tracked: %+v", recorded)
+	}
+
+	// An untouched config is upgraded
+	write("app.conf.default", "v2")
+	ctx = install(recorded)
+	if got := read("app.conf"); got != "v2" {
+		t.Fatalf("untouched config: got %q, want v2", got)
+	}
+	recorded = ctx.Files
+
+	// An edited one is kept, with the new version alongside
+	write("app.conf", "tuned")
+	write("app.conf.default", "v3")
+	ctx = install(recorded)
+	if got, next := read("app.conf"), read("app.conf.jpmnew"); got != "tuned" || next != "v3" {
+		t.Fatalf("edited config: got %q and .jpmnew %q", got, next)
+	}
+	if sum, _ := lib.HashFile(filepath.Join(workDir, "app.conf.jpmnew")); ctx.Files[0].SHA256 != sum {
+		t.Errorf("recorded hash is not the packaged content's")
+	}
+	if !lib.ConfigModified(ctx.Files[0]) {
+		t.Errorf("edited config not reported as modified")
+	}
+
+	// A config jpm has no record of, e.g. kept by 'jpm remove', stays too
+	_ = os.Remove(conf + ".jpmnew")
+	install(nil)
+	if got := read("app.conf"); got != "tuned" {
+		t.Errorf("unrecorded config overwritten: got %q", got)
+	}
+}
+
+func TestConfigKeepsTypeAfterChmod(t *testing.T) {
+	workDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workDir, "app.conf.default"), []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+	for _, inc := range []Instruction{
+		{Token: CONFIG, Args: []string{"app.conf.default", "app.conf"}},
+		{Token: CHMOD, Args: []string{"app.conf"}},
+	} {
+		if err := inc.RunWithContext(ctx, workDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, err := lib.BuildManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(workDir, "app.conf")
+	for _, f := range manifest {
+		if f.FilePath == conf && f.FileType != "user_config" {
+			t.Fatalf("config recorded as %q after CHMOD", f.FileType)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	workDir := t.TempDir()
+	pkgDir := filepath.Join(workDir, "tool")
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := "#!/bin/sh\n# {{.Name}} {{.Version}} on {{.OS}}\nexport JAVA_HOME={{installed \"jdk\"}}\nexec \"{{.Location}}/bin/tool{{.Exe}}\" \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(pkgDir, "tool.tmpl"), []byte(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pkgDir, "bad.tmpl"), []byte("{{.Nope}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := model.NewInstallationContext("tool", "1.2.0", workDir)
+	ctx.Installation.Location = pkgDir
+	ctx.Installed = func(name string) (*model.Installation, error) {
+		if name == "jdk" {
+			return &model.Installation{Name: "jdk", Location: "/opt/jdk"}, nil
+		}
+		return nil, nil
+	}
+
+	inc := Instruction{Token: TEMPLATE, Args: []string{"tool/tool.tmpl", "bin/tool-wrapper"}}
+	if err := inc.RunWithContext(ctx, workDir); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(workDir, "bin", "tool-wrapper")
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#!/bin/sh\n# tool 1.2.0 on " + runtime.GOOS + "\nexport JAVA_HOME=/opt/jdk\nexec \"" + ctx.Installation.Location + "/bin/tool" + variableValues(ctx, workDir)["EXE"] + "\" \"$@\"\n"
+	if string(data) != want {
+		t.Errorf("rendered:\n%s\nwant:\n%s", data, want)
+	}
+	if info, _ := os.Stat(dst); runtime.GOOS != "windows" && info.Mode().Perm() != 0755 {
+		t.Errorf("mode %v, want 0755", info.Mode().Perm())
+	}
+	if len(ctx.Files) != 1 || ctx.Files[0].FilePath != dst {
+		t.Errorf("rendered file not tracked: %+v", ctx.Files)
+	}
+
+	// An unknown field and a package that is not installed both fail
+	ctx.Installed = func(string) (*model.Installation, error) { return nil, nil }
+	for _, args := range [][]string{{"tool/bad.tmpl", "bad"}, {"tool/tool.tmpl", "other"}} {
+		inc := Instruction{Token: TEMPLATE, Args: args}
+		if err := inc.RunWithContext(ctx, workDir); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+		if _, err := os.Stat(filepath.Join(workDir, args[1])); !os.IsNotExist(err) {
+			t.Errorf("%v: output written despite the error", args)
+		}
+	}
+}
+
+// A repair rebuilds the package in a staging directory; the rendered file
+// must match what the real installation produced
+func TestTemplateStaged(t *testing.T) {
+	render := func(ctx *model.InstallationContext, dir string) []byte {
+		t.Helper()
+		src := "home={{.Location}}\nwork={{.WorkDir}}\n"
+		if err := os.MkdirAll(filepath.Join(dir, "tool"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "tool", "env.tmpl"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, inc := range []Instruction{
+			{Token: SET_LOCATION, Args: []string{"tool"}},
+			{Token: TEMPLATE, Args: []string{"tool/env.tmpl", "tool/env"}},
+		} {
+			if err := inc.RunWithContext(ctx, dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "tool", "env"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	workDir, staging := t.TempDir(), t.TempDir()
+	installed := render(model.NewInstallationContext("tool", "1.0", workDir), workDir)
+
+	ctx := model.NewInstallationContext("tool", "1.0", staging)
+	ctx.Staging = true
+	ctx.TargetWorkDir = workDir
+	staged := render(ctx, staging)
+
+	if string(staged) != string(installed) {
+		t.Errorf("staged render:\n%s\nwant:\n%s", staged, installed)
+	}
+	if strings.Contains(string(staged), staging) {
+		t.Errorf("staged render refers to the staging directory:\n%s", staged)
+	}
+}
+
+func TestLinkBinStaged(t *testing.T) {
+	t.Setenv(config.HomeEnvVar, t.TempDir())
+
+	workDir, staging := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(staging, "tool", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(staging, "tool", "bin", "tool"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := model.NewInstallationContext("tool", "1.0", staging)
+	ctx.Staging = true
+	ctx.TargetWorkDir = workDir
+	inc := Instruction{Token: LINK_BIN, Args: []string{"tool/bin/tool", "tl"}}
+	if err := inc.RunWithContext(ctx, staging); err != nil {
+		t.Fatalf("LINK_BIN: %v", err)
+	}
+
+	shim := lib.ShimPath("tl")
+	if _, err := os.Lstat(shim); !os.IsNotExist(err) {
+		t.Errorf("staged LINK_BIN created %s", shim)
+	}
+	if got, want := ctx.Links[shim], filepath.Join(workDir, "tool", "bin", "tool"); got != want {
+		t.Errorf("staged link target: got %q, want %q", got, want)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	workDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workDir, "tool"), []byte("binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	instructions, err := NewParser().Parse(`COPY tool ${NAME}-${VERSION}
+[os=plan9] DELETE tool
+MOVE missing elsewhere`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+	for _, inc := range instructions {
+		_ = inc.RunWithContext(ctx, workDir)
+	}
+
+	if len(ctx.Trace) != 3 {
+		t.Fatalf("got %d trace steps, want 3", len(ctx.Trace))
+	}
+	copied, skipped, failed := ctx.Trace[0], ctx.Trace[1], ctx.Trace[2]
+
+	if copied.Step != 1 || copied.Status != model.TraceSuccess || copied.RawLine != "COPY tool ${NAME}-${VERSION}" {
+		t.Errorf("copy step: %+v", copied)
+	}
+	if !slices.Equal(copied.Args, []string{"tool", "tool-1.0.0"}) {
+		t.Errorf("copy args not expanded: %q", copied.Args)
+	}
+	if !slices.Equal(copied.Files, []string{filepath.Join(workDir, "tool-1.0.0")}) {
+		t.Errorf("copy files: %q", copied.Files)
+	}
+	if skipped.Status != model.TraceSkipped {
+		t.Errorf("guarded step: got %s, want skipped", skipped.Status)
+	}
+	if failed.Status != model.TraceFailed || failed.Error == "" {
+		t.Errorf("failed step: %+v", failed)
+	}
+}
+
+func TestSandboxPaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creates symlinks")
+	}
+
+	root := t.TempDir()
+	workDir := filepath.Join(root, "work")
+	outside := filepath.Join(root, "outside")
+	for _, dir := range []string{workDir, outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "keep.txt"), []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "tool"), []byte("tool"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(workDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	refused := []Instruction{
+		{Token: DELETE, Args: []string{"../outside/keep.txt"}},
+		{Token: DELETE, Args: []string{"."}},
+		{Token: COPY, Args: []string{"tool", "link/tool"}},
+		{Token: CHMOD, Args: []string{"link/keep.txt"}},
+		{Token: SET_LOCATION, Args: []string{"../.."}},
+		{Token: ADD_TO_PATH, Args: []string{outside}},
+	}
+	for _, inc := range refused {
+		ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+		if err := inc.RunWithContext(ctx, workDir); err == nil {
+			t.Errorf("%s %v: expected to be refused", inc.Token, inc.Args)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "keep.txt")); err != nil {
+		t.Fatalf("file outside the root was touched: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "tool")); err == nil {
+		t.Fatal("COPY wrote through a symlink out of the root")
+	}
+
+	// A granted path is allowed, even when reached through a symlink
+	ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+	ctx.AllowedPaths = []string{outside}
+	inc := Instruction{Token: COPY, Args: []string{"tool", "link/tool"}}
+	if err := inc.RunWithContext(ctx, workDir); err != nil {
+		t.Fatalf("granted COPY: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "tool")); err != nil {
+		t.Errorf("granted COPY did not write: %v", err)
+	}
+}
+
+func TestOwnershipConflicts(t *testing.T) {
+	workDir := t.TempDir()
+	shared := filepath.Join(workDir, "bin", "tool")
+	if err := os.MkdirAll(filepath.Dir(shared), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(shared, []byte("other"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("bin/tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("mine")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "tool.zip"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newContext := func(overwrite bool) *model.InstallationContext {
+		ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+		ctx.AddFile(filepath.Join(workDir, "tool.zip"), "", false)
+		ctx.AllowOverwrite = overwrite
+		ctx.OwnersOf = func(path string) ([]model.FileOwner, error) {
+			if path == shared {
+				return []model.FileOwner{{PackageName: "other", File: model.InstalledFile{FilePath: shared}}}, nil
+			}
+			return nil, nil
+		}
+		return ctx
+	}
+
+	for _, inc := range []Instruction{
+		{Token: EXTRACT, Args: []string{"tool.zip"}},
+		{Token: DELETE, Args: []string{"bin/tool"}},
+	} {
+		if err := inc.RunWithContext(newContext(false), workDir); err == nil {
+			t.Errorf("%s %v: expected an ownership conflict", inc.Token, inc.Args)
+		}
+		if data, err := os.ReadFile(shared); err != nil || string(data) != "other" {
+			t.Fatalf("%s %v: other package's file changed: %q, %v", inc.Token, inc.Args, data, err)
+		}
+	}
+
+	// --overwrite takes the file over
+	inc := Instruction{Token: EXTRACT, Args: []string{"tool.zip"}}
+	if err := inc.RunWithContext(newContext(true), workDir); err != nil {
+		t.Fatalf("EXTRACT with overwrite: %v", err)
+	}
+	if data, _ := os.ReadFile(shared); string(data) != "mine" {
+		t.Errorf("overwrite extract: got %q", data)
+	}
+}
+
+// One package must not reach into another package's directory in the
+// shared working directory
+func TestSandboxOtherPackage(t *testing.T) {
+	workDir := t.TempDir()
+	otherDir := filepath.Join(workDir, "other")
+	for _, dir := range []string{otherDir, filepath.Join(workDir, "tool")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(otherDir, "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	owners := func(path string) ([]model.FileOwner, error) {
+		below, _ := lib.WithinRoot(path, otherDir)
+		within, _ := lib.WithinRoot(otherDir, path)
+		if below || within {
+			return []model.FileOwner{{PackageName: "other", File: model.InstalledFile{FilePath: path}}}, nil
+		}
+		return nil, nil
+	}
+
+	refused := []Instruction{
+		{Token: DELETE, Args: []string{"other"}},
+		{Token: CHMOD, Args: []string{"other/run.sh"}},
+		{Token: RUN_SCRIPT, Args: []string{"other/run.sh"}},
+	}
+	for _, located := range []bool{false, true} {
+		for _, inc := range refused {
+			ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+			ctx.OwnersOf = owners
+			if located {
+				// Once the package has its own directory, unrecorded paths are out of reach too
+				ctx.OwnersOf = nil
+				ctx.Installation.Location = filepath.Join(workDir, "tool")
+			}
+			if err := inc.RunWithContext(ctx, workDir); err == nil {
+				t.Errorf("%s %v (location set: %v): expected to be refused", inc.Token, inc.Args, located)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(otherDir, "run.sh")); err != nil {
+		t.Fatalf("other package's directory was touched: %v", err)
+	}
+
+	// The package's own directory stays reachable
+	ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+	ctx.OwnersOf = owners
+	ctx.Installation.Location = filepath.Join(workDir, "tool")
+	inc := Instruction{Token: DELETE, Args: []string{"tool"}}
+	if err := inc.RunWithContext(ctx, workDir); err != nil {
+		t.Errorf("DELETE of the package's own directory: %v", err)
+	}
+}
+
+func TestParserDiagnostics(t *testing.T) {
+	input := "EXTRACT app.zip\n" +
+		"  EXTRAKT_TARGZ libs.tar.gz\n" +
+		"MOVE \"unclosed bin/app\n" +
+		"COPY a\n" +
+		"DELETE it\"s\n"
+
+	_, _, diags := NewParser().Diagnose(input)
+
+	type want struct {
+		sev        Severity
+		line, col  int
+		suggestion string
+	}
+	wants := []want{
+		{SeverityError, 2, 3, "EXTRACT_TARGZ"},
+		{SeverityError, 3, 6, ""},
+		{SeverityError, 4, 1, ""},
+		{SeverityWarning, 5, 10, ""},
+	}
+	if len(diags) != len(wants) {
+		t.Fatalf("got %d diagnostics, want %d:\n%v", len(diags), len(wants), diags.Err())
+	}
+	for i, w := range wants {
+		d := diags[i]
+		if d.Severity != w.sev || d.Line != w.line || d.Column != w.col || d.Suggestion != w.suggestion {
+			t.Errorf("diagnostic %d: got %v (%v at %d:%d, suggestion %q), want %v at %d:%d, suggestion %q",
+				i, d, d.Severity, d.Line, d.Column, d.Suggestion, w.sev, w.line, w.col, w.suggestion)
+		}
+	}
+
+	// Parse reports every error, not just the first
+	_, err := NewParser().Parse(input)
+	if err == nil || !strings.Contains(err.Error(), "line 2:3") || !strings.Contains(err.Error(), "line 4:1") {
+		t.Errorf("Parse error should list all errors, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "did you mean EXTRACT_TARGZ?") {
+		t.Errorf("missing suggestion: %v", err)
+	}
+
+	// Without strict mode, unknown commands are skipped with a warning
+	lenient := NewParser()
+	lenient.StrictMode = false
+	instructions, err := lenient.Parse("EXTRACT app.zip\nFUTURE_COMMAND x\nCHMOD bin/app")
+	if err != nil {
+		t.Fatalf("lenient parse: %v", err)
+	}
+	if len(instructions) != 2 {
+		t.Errorf("lenient parse: got %d instructions, want 2", len(instructions))
+	}
+	if _, err := NewParser().Parse("EXTRACT app.zip\nFUTURE_COMMAND x"); err == nil {
+		t.Error("strict parse accepted an unknown command")
+	}
+}
+
+func TestParserEscapesAndContinuations(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		wantArgs [][]string
+		wantLine []int
+	}{
+		{
+			name:     "Escaped quotes",
+			input:    `COPY "say \"hi\" it's" 'it\'s "fine"'`,
+			wantArgs: [][]string{{`say "hi" it's`, `it's "fine"`}},
+		},
+		{
+			name:     "Escaped backslash before closing quote",
+			input:    `MOVE app "C:\Program Files\App\\"`,
+			wantArgs: [][]string{{"app", `C:\Program Files\App\`}},
+		},
+		{
+			name:     "Backslashes outside quotes are literal",
+			input:    `MOVE app\bin\x.exe dest\`,
+			wantArgs: [][]string{{`app\bin\x.exe`, `dest\`}},
+		},
+		{
+			name:     "Line continuation",
+			input:    "MOVE \\\n    build/output/app \\\n    bin/app\nCHMOD bin/app",
+			wantArgs: [][]string{{"build/output/app", "bin/app"}, {"bin/app"}},
+			wantLine: []int{1, 4},
+		},
+		{
+			name:     "Inline comments",
+			input:    "EXTRACT app.zip   # unpack\nCOPY a#1 \"b # c\" # done",
+			wantArgs: [][]string{{"app.zip"}, {"a#1", "b # c"}},
+		},
+		{
+			name:     "Comment after continuation",
+			input:    "COPY a \\\n  b # copy a to b",
+			wantArgs: [][]string{{"a", "b"}},
+		},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instructions, err := parser.Parse(tt.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(instructions) != len(tt.wantArgs) {
+				t.Fatalf("got %d instructions, want %d", len(instructions), len(tt.wantArgs))
+			}
+			for i, want := range tt.wantArgs {
+				if !slices.Equal(instructions[i].Args, want) {
+					t.Errorf("instruction %d: got %q, want %q", i, instructions[i].Args, want)
+				}
+				if tt.wantLine != nil && instructions[i].LineNumber != tt.wantLine[i] {
+					t.Errorf("instruction %d: got line %d, want %d", i, instructions[i].LineNumber, tt.wantLine[i])
+				}
+			}
+		})
+	}
+
+	// Diagnostics on continuation lines point at the physical line
+	_, _, diags := parser.Diagnose("EXTRACT app.zip\nMOVE \\\n  a \\\n  ${NOPE}")
+	if len(diags) != 1 || diags[0].Line != 4 || diags[0].Column != 3 {
+		t.Errorf("got diagnostics %v, want one at 4:3", diags)
+	}
+}
+
+func TestParserRoundTrip(t *testing.T) {
+	var inputs []string
+	for _, tt := range basicInstructionTests {
+		if !tt.shouldError {
+			inputs = append(inputs, tt.input)
+		}
+	}
+	for _, tt := range quotedArgumentTests {
+		inputs = append(inputs, tt.input)
+	}
+	for _, tt := range complexScenarioTests {
+		inputs = append(inputs, tt.input)
+	}
+	inputs = append(inputs,
+		`COPY "say \"hi\"" "it's"`,
+		`MOVE "C:\Program Files\App\\" "#not a comment"`,
+		`COPY "" "\" "a\\'b"`,
+		"DELETE \"tab\there\"",
+	)
+
+	parser := NewParser()
+	for _, input := range inputs {
+		instructions, err := parser.Parse(input)
+		if err != nil {
+			t.Fatalf("parse %q: %v", input, err)
+		}
+
+		formatted := make([]string, len(instructions))
+		for i := range instructions {
+			formatted[i] = instructions[i].Format()
+		}
+		text := strings.Join(formatted, "\n")
+
+		again, err := parser.Parse(text)
+		if err != nil {
+			t.Fatalf("reparse %q: %v", text, err)
+		}
+		if len(again) != len(instructions) {
+			t.Fatalf("reparse %q: got %d instructions, want %d", text, len(again), len(instructions))
+		}
+		for i := range instructions {
+			if again[i].Token != instructions[i].Token || !slices.Equal(again[i].Args, instructions[i].Args) {
+				t.Errorf("round trip of %q changed instruction %d: %q -> %q",
+					input, i, instructions[i].Args, again[i].Args)
+			}
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	text := `EXTRACT_TARGZ tool.tar.gz
+IF OS=linux,darwin
+  CHMOD tool/bin/tool
+ELSE
+  RENAME tool/bin/tool "tool/bin/my tool.exe"
+END
+[os=windows] DELETE tool/x64.exe
+DOWNLOAD https://example.com/extra.bin extras/ sha256=` + strings.Repeat("ab", 32) + `
+RUN_SCRIPT setup.sh --quiet
+ON_REMOVE
+RUN_SCRIPT tool/uninstall.sh`
+
+	manifest := `{
+  "steps": [
+    {"command": "EXTRACT_TARGZ", "source": "tool.tar.gz"},
+    {"command": "chmod", "path": "tool/bin/tool", "when": [{"os": ["linux", "darwin"]}]},
+    {"command": "RENAME", "source": "tool/bin/tool", "dest": "tool/bin/my tool.exe", "when": [{"os": ["linux", "darwin"], "not": true}]},
+    {"command": "DELETE", "path": "tool/x64.exe", "when": [{"os": ["windows"]}]},
+    {"command": "DOWNLOAD", "url": "https://example.com/extra.bin", "dest": "extras/", "sha256": "` + strings.Repeat("ab", 32) + `"},
+    {"command": "RUN_SCRIPT", "script": "setup.sh", "args": ["--quiet"]}
+  ],
+  "on_remove": [{"command": "RUN_SCRIPT", "script": "tool/uninstall.sh"}]
+}`
+
+	same := func(t *testing.T, got, want []Instruction) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("got %d instructions, want %d", len(got), len(want))
+		}
+		for i := range want {
+			if got[i].Token != want[i].Token || !slices.Equal(got[i].Args, want[i].Args) {
+				t.Errorf("instruction %d: got %v %q, want %v %q", i, got[i].Token, got[i].Args, want[i].Token, want[i].Args)
+			}
+			if len(got[i].Guards) != len(want[i].Guards) {
+				t.Errorf("instruction %d: got %d guards, want %d", i, len(got[i].Guards), len(want[i].Guards))
+				continue
+			}
+			for j := range want[i].Guards {
+				if !sameGuard(got[i].Guards[j], want[i].Guards[j]) {
+					t.Errorf("instruction %d guard %d: got %v, want %v", i, j, got[i].Guards[j], want[i].Guards[j])
+				}
+			}
+		}
+	}
+
+	parser := NewParser()
+	textInstall, textRemove, err := parser.ParseSections(text)
+	if err != nil {
+		t.Fatalf("parse text: %v", err)
+	}
+	jsonInstall, jsonRemove, err := parser.ParseSections(manifest)
+	if err != nil {
+		t.Fatalf("parse manifest: %v", err)
+	}
+	same(t, jsonInstall, textInstall)
+	same(t, jsonRemove, textRemove)
+
+	if got := RemoveSection(manifest); strings.TrimSpace(got) != "RUN_SCRIPT tool/uninstall.sh" {
+		t.Errorf("RemoveSection of a manifest: got %q", got)
+	}
+
+	// Converting either way compiles to the same instructions
+	encoded, err := NewManifest(textInstall, textRemove).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, fromJSONRemove, err := parser.ParseSections(encoded)
+	if err != nil {
+		t.Fatalf("parse converted manifest: %v\n%s", err, encoded)
+	}
+	same(t, fromJSON, textInstall)
+	same(t, fromJSONRemove, textRemove)
+
+	formatted := FormatText(jsonInstall, jsonRemove)
+	fromText, fromTextRemove, err := parser.ParseSections(formatted)
+	if err != nil {
+		t.Fatalf("parse converted text: %v\n%s", err, formatted)
+	}
+	same(t, fromText, textInstall)
+	same(t, fromTextRemove, textRemove)
+
+	invalid := map[string]string{
+		"unknown field":    `{"steps": [{"command": "DELETE", "path": "x", "force": true}]}`,
+		"field not taken":  `{"steps": [{"command": "DELETE", "path": "x", "url": "https://example.com"}]}`,
+		"missing field":    `{"steps": [{"command": "MOVE", "source": "x"}]}`,
+		"unknown command":  `{"steps": [{"command": "EXTRAKT", "source": "x"}]}`,
+		"bad condition":    `{"steps": [{"command": "DELETE", "path": "x", "when": [{}]}]}`,
+		"missing checksum": `{"steps": [{"command": "DOWNLOAD", "url": "https://example.com/x"}]}`,
+	}
+	for name, input := range invalid {
+		if _, err := parser.Parse(input); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		artifact string
+		want     []int // lines with findings
+	}{
+		{
+			name: "clean",
+			input: `EXTRACT_TARGZ tool-${VERSION}.tar.gz
+MOVE tool/bin/tool${EXE} bin/tool${EXE}
+CHMOD bin/tool${EXE}
+ADD_TO_PATH bin`,
+			artifact: "tool-1.2.0.tar.gz",
+		},
+		{name: "deleted unused", input: "EXTRACT tool.zip\nCOPY tool/a b/a\nDELETE b", want: []int{2}},
+		{name: "used before delete", input: "EXTRACT tool.zip\nCOPY tool/a b/a\nCHMOD b/a\nDELETE b"},
+		{name: "chmod never extracted", input: "EXTRACT tool.zip out\nCHMOD bin/tool", want: []int{2}},
+		{name: "chmod after move", input: "EXTRACT tool.zip out\nMOVE out/tool bin/tool\nCHMOD out/tool", want: []int{3}},
+		{name: "chmod bare artifact", input: "CHMOD tool-linux-amd64\nMOVE tool-linux-amd64 bin/tool"},
+		{name: "wrong archive command", input: "EXTRACT_TAR tool.zip", want: []int{1}},
+		{name: "not the artifact", input: "EXTRACT tool.zip", artifact: "tool-win.zip", want: []int{1}},
+		{name: "downloaded archive", input: "DOWNLOAD https://example.com/extra.zip sha256=" + strings.Repeat("ab", 32) + "\nEXTRACT extra.zip", artifact: "tool.zip"},
+		{name: "moved twice", input: "EXTRACT tool.zip\nMOVE a b\nMOVE b c\nADD_TO_PATH c", want: []int{3}},
+		{name: "moved back", input: "EXTRACT tool.zip\nRENAME a b\nRENAME b a\nADD_TO_PATH a", want: []int{3}},
+		{name: "windows paths", input: "EXTRACT tool.zip\nCHMOD bin\\tool\nADD_TO_PATH bin/tool.exe", want: []int{2, 3}},
+		{name: "guarded windows path", input: "EXTRACT tool.zip\n[os=windows] ADD_TO_PATH C:\\tool\\bin"},
+		{name: "unix only", input: "ADD_TO_PATH /usr/local/bin\nRUN_SCRIPT install.sh", want: []int{1, 2}},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instructions, err := parser.Parse(tt.input)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			diags := Lint(instructions, LintOptions{Artifact: tt.artifact})
+
+			var lines []int
+			for _, d := range diags {
+				if d.Severity != SeverityWarning {
+					t.Errorf("finding is not a warning: %v", d)
+				}
+				lines = append(lines, d.Line)
+			}
+			if !slices.Equal(lines, tt.want) {
+				t.Errorf("findings on lines %v, want %v: %v", lines, tt.want, diags)
+			}
+		})
+	}
+}
+
+func TestFormatSource(t *testing.T) {
+	input := `# header
+extract_targz   'tool.tar.gz'   out
+
+
+if os=linux,darwin arch=amd64
+chmod out/bin/tool   #  make it runnable
+   else
+  Delete "out/bin/tool" 
+end
+[arch=arm64 os=linux] ADD_TO_PATH "out/my bin"
+RUN_SCRIPT setup.sh \
+    --quiet
+on_remove:
+run_script "tool/uninstall.sh"
+`
+	want := `# header
+EXTRACT_TARGZ tool.tar.gz out
+
+IF OS=linux,darwin ARCH=amd64
+  CHMOD out/bin/tool  # make it runnable
+ELSE
+  DELETE out/bin/tool
+END
+[OS=linux ARCH=arm64] ADD_TO_PATH "out/my bin"
+RUN_SCRIPT setup.sh --quiet
+ON_REMOVE
+RUN_SCRIPT tool/uninstall.sh
+`
+
+	parser := NewParser()
+	got, err := parser.FormatSource(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Formatting is idempotent and keeps the instructions
+	again, err := parser.FormatSource(got)
+	if err != nil || again != got {
+		t.Errorf("formatting twice changed the text:\n%s", again)
+	}
+	before, _ := parser.Parse(input)
+	after, _ := parser.Parse(got)
+	if len(before) != len(after) {
+		t.Fatalf("got %d instructions after formatting, want %d", len(after), len(before))
+	}
+	for i := range before {
+		if before[i].Token != after[i].Token || !slices.Equal(before[i].Args, after[i].Args) {
+			t.Errorf("instruction %d changed: %v -> %v", i, before[i].Args, after[i].Args)
+		}
+	}
+
+	if _, err := parser.FormatSource("MOVE a"); err == nil {
+		t.Error("expected an error for invalid instructions")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	var ran []string
+	token, err := Register("write_unit", FuncHandler{
+		Args: []Param{
+			{Name: "source", Kind: ParamPath},
+			{Name: "dest", Kind: ParamPathNotRoot, Creates: true},
+			{Name: "args", Optional: true, Variadic: true},
+		},
+		Check: func(args []string) error {
+			if !strings.HasSuffix(args[1], ".service") {
+				return fmt.Errorf("WRITE_UNIT needs a .service file")
+			}
+			return nil
+		},
+		Exec: func(ctx *model.InstallationContext, workDir string, args []string) error {
+			ran = append(ran, args...)
+			dest := filepath.Join(workDir, args[1])
+			if err := RecordWrite(ctx, dest); err != nil {
+				return err
+			}
+			return lib.Copy(filepath.Join(workDir, args[0]), dest)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.String() != "WRITE_UNIT" {
+		t.Errorf("token name: got %s", token)
+	}
+
+	for name, h := range map[string]Handler{
+		"MOVE":      FuncHandler{},
+		"IF":        FuncHandler{},
+		"bad name":  FuncHandler{},
+		"BAD_FIELD": FuncHandler{Args: []Param{{Name: "when"}}},
+		"BAD_CASE":  FuncHandler{Args: []Param{{Name: "Unit"}}},
+		"BAD_ORDER": FuncHandler{Args: []Param{{Name: "source", Optional: true}, {Name: "dest"}}},
+		"BAD_LIST":  FuncHandler{Args: []Param{{Name: "args", Variadic: true}, {Name: "dest"}}},
+	} {
+		if _, err := Register(name, h); err == nil {
+			t.Errorf("Register(%q): expected an error", name)
+		}
+	}
+
+	parser := NewParser()
+	for input, wantErr := range map[string]bool{
+		"write_unit tool.service lib/tool.service --now": false,
+		"WRITE_UNIT tool.service":                        true,
+		"WRITE_UNIT tool.service lib/tool.conf":          true,
+	} {
+		if _, err := parser.Parse(input); (err != nil) != wantErr {
+			t.Errorf("%s: got error %v", input, err)
+		}
+	}
+
+	instructions, err := parser.Parse("WRITE_UNIT tool.service lib/tool.service --now")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := NewManifest(instructions, nil).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(encoded, `"dest": "lib/tool.service"`) {
+		t.Errorf("manifest field missing:\n%s", encoded)
+	}
+	again, err := parser.Parse(encoded)
+	if err != nil || !slices.Equal(again[0].Args, instructions[0].Args) {
+		t.Errorf("manifest round trip: %v %v", again, err)
+	}
+
+	workDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workDir, "tool.service"), []byte("[Unit]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+	if err := instructions[0].RunWithContext(ctx, workDir); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ran, []string{"tool.service", "lib/tool.service", "--now"}) {
+		t.Errorf("handler got %q", ran)
+	}
+	if len(ctx.Undo) != 1 || ctx.Undo[0].Kind != model.UndoCreated {
+		t.Errorf("undo log: %+v", ctx.Undo)
+	}
+	if got := instructions[0].Targets(ctx, workDir); !slices.Equal(got, []string{filepath.Join(workDir, "lib/tool.service")}) {
+		t.Errorf("targets: %v", got)
+	}
+
+	// Registered paths go through the sandbox like built-in ones
+	escape := Instruction{Token: token, Args: []string{"tool.service", "../x.service"}}
+	if err := escape.RunWithContext(ctx, workDir); err == nil {
+		t.Error("expected a path outside the install root to be refused")
+	}
+}
+
+func TestRegisterManifestField(t *testing.T) {
+	if _, err := Register("install_unit", FuncHandler{
+		Args: []Param{{Name: "unit", Kind: ParamPath}, {Name: "target", Optional: true}},
+		Exec: func(ctx *model.InstallationContext, workDir string, args []string) error { return nil },
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser()
+	instructions, err := parser.Parse(`{"steps": [{"command": "INSTALL_UNIT", "unit": "tool.service", "target": "multi-user"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(instructions[0].Args, []string{"tool.service", "multi-user"}) {
+		t.Errorf("args: %q", instructions[0].Args)
+	}
+
+	encoded, err := NewManifest(instructions, nil).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(encoded, `"unit": "tool.service"`) {
+		t.Errorf("manifest field missing:\n%s", encoded)
+	}
+	again, err := parser.Parse(encoded)
+	if err != nil || !slices.Equal(again[0].Args, instructions[0].Args) {
+		t.Errorf("manifest round trip: %v %v", again, err)
+	}
+
+	for name, input := range map[string]string{
+		"field of another command": `{"steps": [{"command": "DELETE", "path": "x", "unit": "tool.service"}]}`,
+		"unknown field":            `{"steps": [{"command": "INSTALL_UNIT", "unit": "tool.service", "force": "yes"}]}`,
+		"not a string":             `{"steps": [{"command": "INSTALL_UNIT", "unit": 1}]}`,
+	} {
+		if _, err := parser.Parse(input); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRegisterUndo(t *testing.T) {
+	enabled := map[string]bool{}
+	_, err := Register("enable_unit", FuncHandler{
+		Args: []Param{{Name: "name"}},
+		Exec: func(ctx *model.InstallationContext, workDir string, args []string) error {
+			RecordHandlerUndo(ctx, "enable_unit", "", args[0])
+			enabled[args[0]] = true
+			return nil
+		},
+		Revert: func(rec model.UndoRecord) error {
+			delete(enabled, rec.Value)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second step fails, so the install is rolled back like cmd/install does
+	workDir := t.TempDir()
+	instructions, err := NewParser().Parse("ENABLE_UNIT tool.service\nMOVE missing.txt moved.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := model.NewInstallationContext("tool", "1.0.0", workDir)
+	if err := instructions[0].RunWithContext(ctx, workDir); err != nil {
+		t.Fatal(err)
+	}
+	if !enabled["tool.service"] {
+		t.Fatal("handler did not run")
+	}
+	if err := instructions[1].RunWithContext(ctx, workDir); err == nil {
+		t.Fatal("expected moving a missing file to fail")
+	}
+
+	if err := lib.ReplayUndo(ctx.Undo, false); err != nil {
+		t.Fatalf("ReplayUndo: %v", err)
+	}
+	if enabled["tool.service"] {
+		t.Error("handler undo did not run")
+	}
+}
+
+// macroMap is a MacroSource for tests
+type macroMap map[string]*model.Macro
+
+func (m macroMap) GetMacro(name string) (*model.Macro, error) {
+	if macro, ok := m[name]; ok {
+		return macro, nil
+	}
+	return nil, fmt.Errorf("macro '%s' not found", name)
+}
+
+func TestMacros(t *testing.T) {
+	macros := macroMap{
+		"standard-binary": {
+			Name:   "standard-binary",
+			Params: "bin archive dir=bin",
+			Body: `EXTRACT_TARGZ ${archive}
+MOVE ${bin}/${bin}${EXE} "${dir}/${bin}${EXE}"
+CHMOD "${dir}/${bin}${EXE}"
+USE add-path dir=${dir}`,
+		},
+		"add-path":  {Name: "add-path", Params: "dir", Body: "ADD_TO_PATH ${dir}"},
+		"loop-a":    {Name: "loop-a", Body: "USE loop-b"},
+		"loop-b":    {Name: "loop-b", Body: "DELETE x\nUSE loop-a"},
+		"broken":    {Name: "broken", Body: "MOVE only-one"},
+		"bad-param": {Name: "bad-param", Params: "Bin", Body: "DELETE x"},
+	}
+	parser := NewParser()
+	parser.Macros = macros
+
+	instructions, err := parser.Parse(`[os=linux] USE standard-binary bin=tool archive=tool.tar.gz "dir=my bin"
+DELETE leftovers`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"EXTRACT_TARGZ tool.tar.gz",
+		`MOVE tool/tool${EXE} "my bin/tool${EXE}"`,
+		`CHMOD "my bin/tool${EXE}"`,
+		`ADD_TO_PATH "my bin"`,
+		"DELETE leftovers",
+	}
+	if len(instructions) != len(want) {
+		t.Fatalf("got %d instructions, want %d", len(instructions), len(want))
+	}
+	for i, inc := range instructions {
+		if inc.RawLine != want[i] && inc.Format() != want[i] {
+			t.Errorf("instruction %d: got %s, want %s", i, inc.Format(), want[i])
+		}
+		if i < 4 && (inc.LineNumber != 1 || len(inc.Guards) != 1) {
+			t.Errorf("instruction %d: line %d with %d guards, want line 1 with the USE guard", i, inc.LineNumber, len(inc.Guards))
+		}
+	}
+	if instructions[3].Macro != "standard-binary > add-path" || instructions[4].Macro != "" {
+		t.Errorf("macro origin: %q, %q", instructions[3].Macro, instructions[4].Macro)
+	}
+
+	for input, wantMsg := range map[string]string{
+		"USE loop-a":                 "macro recursion: loop-a -> loop-b -> loop-a",
+		"USE missing":                "macro 'missing' not found",
+		"USE add-path":               "requires dir=<value>",
+		"USE add-path dir=x other=y": "no parameter 'other'",
+		"USE add-path dir":           "name=value",
+		"USE broken":                 "in macro broken, line 1: MOVE requires exactly 2 arguments",
+		"USE bad-param":              "invalid parameter 'Bin'",
+		"USE standard-binary bin=a archive=b.zip dir=${NOPE}": "unknown variable ${NOPE}",
+	} {
+		_, _, diags := parser.Diagnose(input)
+		if err := diags.Err(); err == nil || !strings.Contains(err.Error(), wantMsg) {
+			t.Errorf("%s: got %v, want an error containing %q", input, err, wantMsg)
+		}
+	}
+
+	if _, err := NewParser().Parse("USE add-path dir=bin"); err == nil {
+		t.Error("expected USE without a macro source to fail")
+	}
+
+	// Converting keeps USE lines without looking them up
+	keep := NewParser()
+	keep.KeepMacros = true
+	text := "[OS=linux] USE add-path dir=bin\nDELETE leftovers\n"
+	install, remove, diags := keep.Diagnose(text)
+	if err := diags.Err(); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := NewManifest(install, remove).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	install, remove, diags = keep.Diagnose(encoded)
+	if err := diags.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := FormatText(install, remove); got != text {
+		t.Errorf("text -> json -> text:\n%s\nwant:\n%s", got, text)
+	}
+	if err := install[0].RunWithContext(model.NewInstallationContext("tool", "1.0", t.TempDir()), t.TempDir()); err == nil {
+		t.Error("expected an unexpanded USE to refuse to run")
+	}
+
+	// A manifest's USE steps are expanded like USE lines
+	install, _, diags = parser.Diagnose(encoded)
+	if err := diags.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(install) != 2 || install[0].Format() != "ADD_TO_PATH bin" || install[0].Macro != "add-path" {
+		t.Errorf("manifest USE not expanded: %q", FormatText(install, nil))
+	}
+}
@@ -0,0 +1,266 @@
+package parser
+
+import (
+	"fmt"
+	"jpm/lib"
+	"jpm/model"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Handler implements one instruction command. The built-in commands are
+// handlers too; programs embedding jpm add their own with Register.
+type Handler interface {
+	// Params describes the arguments, in the order they are written
+	Params() []Param
+
+	// Validate checks arguments that already fit Params. It runs at parse
+	// time, before ${VAR} references are expanded.
+	Validate(args []string) error
+
+	// Run executes the instruction with expanded arguments whose paths have
+	// passed the sandbox. Changes to the disk are recorded on ctx first,
+	// with RecordWrite and friends, so the step can be undone.
+	Run(ctx *model.InstallationContext, workDir string, args []string) error
+}
+
+// Undoer is implemented by handlers whose changes the built-in undo
+// records cannot describe, e.g. enabling a service. Run records such a
+// change with RecordHandlerUndo before making it; Undo reverses it when the
+// install fails, the package is removed or doctor rolls back an
+// interrupted install.
+type Undoer interface {
+	Undo(rec model.UndoRecord) error
+}
+
+// ParamKind tells the sandbox how to check an argument
+type ParamKind int
+
+const (
+	ParamValue       ParamKind = iota // not a path
+	ParamPath                         // a path inside the install root
+	ParamPathNotRoot                  // a path inside the install root, but not the root itself
+	ParamPathOrAbs                    // like ParamPath, but an absolute path is used as is
+)
+
+// Param is one argument of an instruction. Its Name is also its field in
+// JSON manifests: lower case letters, digits and '_', other than the step's
+// "command" and "when".
+type Param struct {
+	Name string
+	Kind ParamKind
+
+	// Prefix marks a keyword argument such as sha256=<hex>, which may
+	// appear anywhere after the first argument. Other arguments bind by
+	// position.
+	Prefix string
+
+	Optional bool
+	Variadic bool // takes all remaining arguments; only the last param, named "args"
+	Creates  bool // the path is created or replaced by the instruction
+}
+
+// FuncHandler is a Handler made of plain functions. A nil Check accepts
+// every argument list that fits Args. Revert, if set, reverses the records
+// Exec made with RecordHandlerUndo.
+type FuncHandler struct {
+	Args   []Param
+	Check  func(args []string) error
+	Exec   func(ctx *model.InstallationContext, workDir string, args []string) error
+	Revert func(rec model.UndoRecord) error
+}
+
+func (h FuncHandler) Params() []Param { return h.Args }
+
+func (h FuncHandler) Validate(args []string) error {
+	if h.Check == nil {
+		return nil
+	}
+	return h.Check(args)
+}
+
+func (h FuncHandler) Run(ctx *model.InstallationContext, workDir string, args []string) error {
+	return h.Exec(ctx, workDir, args)
+}
+
+func (h FuncHandler) Undo(rec model.UndoRecord) error {
+	if h.Revert == nil {
+		return fmt.Errorf("the command has no undo")
+	}
+	return h.Revert(rec)
+}
+
+// RecordHandlerUndo records a change of the registered command about to be
+// made, to be reversed by its handler's Undo. path and value are handed
+// back to Undo in the record.
+func RecordHandlerUndo(ctx *model.InstallationContext, command, path, value string) {
+	ctx.RecordUndo(handlerUndoKind(command), path, "", value)
+}
+
+// handlerUndoKind is the undo record kind of a registered command
+func handlerUndoKind(command string) string {
+	return "handler:" + strings.ToUpper(command)
+}
+
+// nextToken is the token handed to the next registered command
+var nextToken = INVALID + 1
+
+var (
+	commandName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	paramName   = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+)
+
+// Register adds a command that instruction text and manifests can then use
+// like a built-in one, and returns its token. Names are case-insensitive
+// and may not replace an existing command. Register is meant to be called
+// from init functions, before any instructions are parsed.
+func Register(name string, h Handler) (Token, error) {
+	name = strings.ToUpper(name)
+	if !commandName.MatchString(name) {
+		return INVALID, fmt.Errorf("invalid command name '%s' (use letters, digits and '_')", name)
+	}
+	if _, exists := tokenMap[name]; exists || slices.Contains(blockKeywords, name) {
+		return INVALID, fmt.Errorf("command %s already exists", name)
+	}
+	if err := checkParams(h.Params()); err != nil {
+		return INVALID, fmt.Errorf("command %s: %w", name, err)
+	}
+
+	token := nextToken
+	nextToken++
+	tokenMap[name] = token
+	handlers[token] = h
+	if u, ok := h.(Undoer); ok {
+		lib.RegisterUndo(handlerUndoKind(name), u.Undo)
+	}
+	return token, nil
+}
+
+// blockKeywords are the words with a meaning of their own at the start of a line
+var blockKeywords = []string{"IF", "ELSE", "END", "ON_REMOVE", "USE"}
+
+func checkParams(params []Param) error {
+	optional := false
+	for i, p := range params {
+		if !paramName.MatchString(p.Name) || p.Name == "command" || p.Name == "when" {
+			return fmt.Errorf("invalid parameter name '%s' (use lower case letters, digits and '_', but not 'command' or 'when')", p.Name)
+		}
+		if p.Variadic != (p.Name == "args") {
+			return fmt.Errorf("only the parameter 'args' takes several arguments")
+		}
+		if p.Variadic && i != len(params)-1 {
+			return fmt.Errorf("'args' must be the last parameter")
+		}
+		if p.Prefix != "" {
+			if i == 0 || p.Variadic {
+				return fmt.Errorf("keyword parameter '%s' cannot be first or take several arguments", p.Name)
+			}
+			continue
+		}
+		if optional && !p.Optional {
+			return fmt.Errorf("required parameter '%s' follows an optional one", p.Name)
+		}
+		optional = optional || p.Optional
+	}
+	return nil
+}
+
+// bind assigns arguments to params: keyword arguments by their prefix, the
+// rest in order. values[i] holds the arguments given for params[i].
+func bind(token Token, params []Param, args []string) (values [][]string, err error) {
+	values = make([][]string, len(params))
+	next := 0
+
+	for i, arg := range args {
+		keyword := -1
+		for j, p := range params {
+			if i > 0 && p.Prefix != "" && len(values[j]) == 0 && strings.HasPrefix(arg, p.Prefix) {
+				keyword = j
+				break
+			}
+		}
+		if keyword >= 0 {
+			values[keyword] = []string{arg}
+			continue
+		}
+
+		for next < len(params) && params[next].Prefix != "" {
+			next++
+		}
+		if next == len(params) {
+			return nil, countError(token, params)
+		}
+		values[next] = append(values[next], arg)
+		if !params[next].Variadic {
+			next++
+		}
+	}
+
+	for j, p := range params {
+		if len(values[j]) > 0 || p.Optional {
+			continue
+		}
+		if p.Prefix != "" {
+			return nil, fmt.Errorf("%v requires a %s<%s> argument", token, p.Prefix, p.Name)
+		}
+		return nil, countError(token, params)
+	}
+	return values, nil
+}
+
+func countError(token Token, params []Param) error {
+	least, most := 0, len(params)
+	var usage []string
+	for _, p := range params {
+		word := p.Name
+		if p.Prefix != "" {
+			word = p.Prefix + "<" + p.Name + ">"
+		}
+		if p.Variadic {
+			word += "..."
+			most = -1
+		}
+		if p.Optional {
+			word = "[" + word + "]"
+		} else {
+			least++
+		}
+		usage = append(usage, word)
+	}
+
+	var count string
+	switch {
+	case most < 0:
+		count = fmt.Sprintf("at least %d", least)
+	case least == most:
+		count = fmt.Sprintf("exactly %d", least)
+	default:
+		count = fmt.Sprintf("%d-%d", least, most)
+	}
+	noun := "arguments"
+	if least == 1 && most == 1 {
+		noun = "argument"
+	}
+	return fmt.Errorf("%v requires %s %s (%s)", token, count, noun, strings.Join(usage, " "))
+}
+
+// params returns the parameters of the instruction's command, or nil for
+// an unknown command
+func (inc *Instruction) params() []Param {
+	if h, ok := handlers[inc.Token]; ok {
+		return h.Params()
+	}
+	return nil
+}
+
+// boundArgs returns the instruction's arguments assigned to its parameters;
+// the instruction must be valid
+func (inc *Instruction) boundArgs() (params []Param, values [][]string) {
+	params = inc.params()
+	values, err := bind(inc.Token, params, inc.Args)
+	if err != nil {
+		return nil, nil
+	}
+	return params, values
+}
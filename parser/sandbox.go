@@ -0,0 +1,157 @@
+package parser
+
+import (
+	"fmt"
+	"jpm/lib"
+	"jpm/model"
+	"os"
+	"path/filepath"
+)
+
+// pathArg is one filesystem path an instruction operates on
+type pathArg struct {
+	path string
+	// notRoot refuses the install root itself, for instructions that
+	// would delete or relocate it wholesale
+	notRoot bool
+	// creates marks a destination the instruction makes; it may be anywhere
+	// in the working directory rather than inside the installation
+	creates bool
+}
+
+// pathArgs returns the paths the instruction touches, joined to workDir,
+// as its command's parameters describe them. Only ParamPathOrAbs takes
+// absolute paths as they are; everywhere else an absolute argument is
+// still relative to the work directory.
+func (inc *Instruction) pathArgs(workDir string) []pathArg {
+	var paths []pathArg
+	params, values := inc.boundArgs()
+	for i, p := range params {
+		if p.Kind == ParamValue {
+			continue
+		}
+		for _, value := range values[i] {
+			if p.Kind == ParamPathOrAbs && filepath.IsAbs(value) {
+				paths = append(paths, pathArg{path: filepath.Clean(value)})
+				continue
+			}
+			paths = append(paths, pathArg{
+				path:    filepath.Join(workDir, value),
+				notRoot: p.Kind == ParamPathNotRoot,
+				creates: p.Creates,
+			})
+		}
+	}
+	return paths
+}
+
+// checkPaths refuses to run an instruction that would reach outside the
+// install root, after resolving symlinks, unless the path lies inside one
+// of the paths explicitly granted to the package. Paths the instruction
+// reads or changes must also belong to this installation; see installRoots.
+func (inc *Instruction) checkPaths(ctx *model.InstallationContext, workDir string) error {
+	roots := installRoots(ctx, workDir)
+
+	for _, arg := range inc.pathArgs(workDir) {
+		if granted(ctx.AllowedPaths, arg.path) {
+			continue
+		}
+
+		inside, err := lib.WithinRoot(workDir, arg.path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", arg.path, err)
+		}
+		if !inside {
+			return fmt.Errorf("%s is outside the install root %s; grant it with 'jpm grant <package> %s' if this is intended",
+				arg.path, workDir, arg.path)
+		}
+		if arg.notRoot && samePath(workDir, arg.path) {
+			return fmt.Errorf("refusing to %s the install root %s", inc.Token, workDir)
+		}
+		if arg.creates {
+			continue
+		}
+
+		if err := checkOwnPath(ctx, workDir, roots, arg.path); err != nil {
+			return fmt.Errorf("refusing to %s %s: %w", inc.Token, arg.path, err)
+		}
+	}
+	return nil
+}
+
+// installRoots returns the paths that belong to the installation: its
+// location once SET_LOCATION ran, otherwise the directory it extracted
+// into, plus everything it created itself. An installation that has not
+// got a directory of its own yet is rooted at the working directory.
+func installRoots(ctx *model.InstallationContext, workDir string) []string {
+	var roots []string
+	switch {
+	case ctx.Installation.Location != "":
+		roots = append(roots, ctx.Installation.Location)
+	case ctx.ExtractedPath != "" && !samePath(ctx.ExtractedPath, workDir):
+		roots = append(roots, ctx.ExtractedPath)
+	default:
+		roots = append(roots, workDir)
+	}
+	for _, f := range ctx.Files {
+		roots = append(roots, f.FilePath)
+	}
+	return roots
+}
+
+// checkOwnPath reports an error unless path lies within one of the
+// installation's roots. The shared working directory only counts as a root
+// for paths no other package has recorded; paths that do not exist cannot
+// reach anything and are left to the instruction.
+func checkOwnPath(ctx *model.InstallationContext, workDir string, roots []string, path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	for _, root := range roots {
+		inside, err := lib.WithinRoot(root, path)
+		if err != nil || !inside {
+			continue
+		}
+		if !samePath(root, workDir) {
+			return nil
+		}
+		return checkNotOwned(ctx, path)
+	}
+	return fmt.Errorf("it is outside the installation's own directory %s", roots[0])
+}
+
+// checkNotOwned refuses a path that another package recorded, or a
+// directory holding such paths
+func checkNotOwned(ctx *model.InstallationContext, path string) error {
+	if ctx.OwnersOf == nil {
+		return nil
+	}
+	owners, err := ctx.OwnersOf(path)
+	if err != nil {
+		return fmt.Errorf("failed to check ownership: %w", err)
+	}
+	for _, owner := range owners {
+		if owner.PackageName != ctx.Installation.Name {
+			return fmt.Errorf("%s belongs to package '%s'", owner.File.FilePath, owner.PackageName)
+		}
+	}
+	return nil
+}
+
+// granted reports whether path lies inside one of the granted paths
+func granted(allowed []string, path string) bool {
+	for _, root := range allowed {
+		if ok, err := lib.WithinRoot(root, path); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// samePath reports whether a and b resolve to the same location
+func samePath(a, b string) bool {
+	ra, errA := lib.ResolvePath(a)
+	rb, errB := lib.ResolvePath(b)
+	return errA == nil && errB == nil && ra == rb
+}
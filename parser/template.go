@@ -0,0 +1,119 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"jpm/config"
+	"jpm/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is what TEMPLATE renders a file with. Other installed
+// packages are reached with the installed function, e.g.
+//
+//	JAVA_HOME={{installed "jdk"}}
+//	exec "{{.Location}}/bin/tool{{.Exe}}" "$@"
+type TemplateData struct {
+	Name     string // package name
+	Version  string // version being installed
+	Location string // location set by SET_LOCATION, or the working directory before that
+	WorkDir  string // absolute working directory
+	OS       string
+	Arch     string
+	Exe      string // ".exe" on Windows, empty elsewhere
+	Home     string // jpm's home directory
+}
+
+func templateData(ctx *model.InstallationContext, workDir string) TemplateData {
+	vars := variableValues(ctx, workDir)
+	location, dir := vars["PREFIX"], vars["WORKDIR"]
+
+	// A staged rebuild renders the paths the files are restored to
+	if ctx.Staging && ctx.TargetWorkDir != "" {
+		if rel, err := filepath.Rel(workDir, location); err == nil && !strings.HasPrefix(rel, "..") {
+			location = filepath.Join(ctx.TargetWorkDir, rel)
+		}
+		dir = ctx.TargetWorkDir
+	}
+
+	return TemplateData{
+		Name:     vars["NAME"],
+		Version:  vars["VERSION"],
+		Location: location,
+		WorkDir:  dir,
+		OS:       vars["OS"],
+		Arch:     vars["ARCH"],
+		Exe:      vars["EXE"],
+		Home:     config.Home(),
+	}
+}
+
+// installedFunc returns the location of another installed package
+func installedFunc(ctx *model.InstallationContext) func(name string) (string, error) {
+	return func(name string) (string, error) {
+		if ctx.Installed == nil {
+			return "", fmt.Errorf("installed packages cannot be looked up here")
+		}
+		inst, err := ctx.Installed(name)
+		if err != nil {
+			return "", err
+		}
+		if inst == nil {
+			return "", fmt.Errorf("package '%s' is not installed", name)
+		}
+		if inst.Location != "" {
+			return inst.Location, nil
+		}
+		return inst.WorkDir, nil
+	}
+}
+
+// runTemplate renders a text/template shipped in the package into dest,
+// which keeps the template's permissions so wrapper scripts stay executable.
+// Unknown fields are errors rather than empty output.
+func runTemplate(ctx *model.InstallationContext, workDir string, args []string) error {
+	src := filepath.Join(workDir, args[0])
+	dst := filepath.Join(workDir, args[1])
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("TEMPLATE source not found: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("TEMPLATE source %s is a directory", args[0])
+	}
+
+	tmpl, err := template.New(filepath.Base(src)).
+		Funcs(template.FuncMap{"installed": installedFunc(ctx)}).
+		ParseFiles(src)
+	if err != nil {
+		return fmt.Errorf("invalid template %s: %w", args[0], err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, templateData(ctx, workDir)); err != nil {
+		return fmt.Errorf("failed to render %s: %w", args[0], err)
+	}
+
+	if err := ctx.CheckConflict(dst); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(dst), err)
+	}
+	if err := RecordWrite(ctx, dst); err != nil {
+		return err
+	}
+
+	// Track the rendered file
+	ctx.AddFile(dst, "", false)
+
+	// Remove first so read-only targets can be replaced
+	_ = os.Remove(dst)
+	if err := os.WriteFile(dst, out.Bytes(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chmod(dst, info.Mode().Perm())
+}
@@ -0,0 +1,93 @@
+package parser
+
+import (
+	"fmt"
+	"jpm/lib"
+	"jpm/model"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// RecordWrite prepares undoing a write to path: a new path is recorded as
+// created, an existing one is backed up first
+func RecordWrite(ctx *model.InstallationContext, path string) error {
+	return recordChange(ctx, path, true)
+}
+
+// RecordDelete backs up path before it is deleted
+func RecordDelete(ctx *model.InstallationContext, path string) error {
+	return recordChange(ctx, path, false)
+}
+
+func recordChange(ctx *model.InstallationContext, path string, creating bool) error {
+	// Undoing the creation of an enclosing path already covers it
+	if ctx.CreatedHere(path) {
+		return nil
+	}
+
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		if creating {
+			ctx.RecordUndo(model.UndoCreated, path, "", "")
+		}
+		return nil
+	}
+
+	if ctx.BackupDir == "" {
+		return nil
+	}
+
+	kind := model.UndoBackup
+	if ctx.OwnedBySelf(path) {
+		kind = model.UndoReplaced
+	}
+
+	backup := filepath.Join(ctx.BackupDir, strconv.Itoa(len(ctx.Undo)+1))
+	if err := lib.Snapshot(path, backup); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+	ctx.RecordUndo(kind, path, backup, "")
+	return nil
+}
+
+// RecordMove prepares undoing a move of src to dst
+func RecordMove(ctx *model.InstallationContext, src, dst string) error {
+	if err := RecordWrite(ctx, dst); err != nil {
+		return err
+	}
+	if !ctx.CreatedHere(src) {
+		ctx.RecordUndo(model.UndoMoved, dst, "", src)
+	}
+	return nil
+}
+
+// RecordMode remembers the permissions of path before they change
+func RecordMode(ctx *model.InstallationContext, path string) {
+	if ctx.CreatedHere(path) {
+		return
+	}
+	if info, err := os.Stat(path); err == nil {
+		ctx.RecordUndo(model.UndoMode, path, "", strconv.FormatUint(uint64(info.Mode().Perm()), 8))
+	}
+}
+
+// recordExtract prepares undoing an extraction: the destination when it is
+// a dedicated directory, otherwise each top-level entry of the archive, and
+// the archive itself, which is deleted afterwards
+func recordExtract(ctx *model.InstallationContext, workDir, source, dest, format string) error {
+	targets := []string{dest}
+	if filepath.Clean(dest) == filepath.Clean(workDir) {
+		roots, err := lib.ArchiveRoots(source, dest, format)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", source, err)
+		}
+		targets = roots
+	}
+
+	for _, target := range targets {
+		if err := RecordWrite(ctx, target); err != nil {
+			return err
+		}
+	}
+	return RecordDelete(ctx, source)
+}